@@ -5,50 +5,197 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/hedlund/orbit/pkg/auth"
+	"github.com/hedlund/orbit/pkg/diskcache"
 	"github.com/hedlund/orbit/pkg/envconfig"
+	"github.com/hedlund/orbit/pkg/git"
+	"github.com/hedlund/orbit/pkg/gitea"
 	"github.com/hedlund/orbit/pkg/github"
+	"github.com/hedlund/orbit/pkg/gitlab"
+	"github.com/hedlund/orbit/pkg/local"
 	"github.com/hedlund/orbit/pkg/mcache"
+	"github.com/hedlund/orbit/pkg/redis"
+	"github.com/hedlund/orbit/pkg/registry"
 	"github.com/hedlund/orbit/pkg/router"
+	"github.com/hedlund/orbit/pkg/s3"
 	"github.com/hedlund/orbit/pkg/server"
 	"github.com/hedlund/orbit/services/modules"
+	"github.com/hedlund/orbit/services/providers"
 )
 
 type config struct {
-	Cache struct {
-		Enabled    bool          `envconfig:"ENABLED"`
-		Path       string        `envconfig:"PATH" default:"/tmp"`
-		Expiration time.Duration `envconfig:"EXPIRATION" default:"10s"`
+	// AdminAddr is where the metrics are served, under /debug/vars. They are
+	// kept off the public listener, and not served at all unless configured.
+	AdminAddr string `envconfig:"ADMIN_ADDR"`
+
+	// Backend is where modules are served from, `github`, `gitlab`, `gitea`
+	// (which also covers Forgejo), plain `git` repositories, a `local`
+	// directory tree, pre-built archives in an `s3` bucket or an upstream
+	// `registry`. Each is configured by variables prefixed by its name, e.g.
+	// GITLAB_BASE_URL. Providers are always served from GitHub.
+	Backend string   `envconfig:"BACKEND" default:"github"`
+	Routes  []string `envconfig:"ROUTES"`
+	Cache   struct {
+		Enabled bool `envconfig:"ENABLED"`
+		Config  modules.CacheConfig
+		Disk    diskcache.Config
+		Redis   redis.Config `envconfig:"REDIS_"`
 	} `envconfig:"CACHE_"`
-	Github  github.Config  `envconfig:"GITHUB_"`
-	Modules modules.Config `envconfig:"MODULES_"`
-	Server  server.Config
+	Github    github.Config    `envconfig:"GITHUB_"`
+	Hosts     []string         `envconfig:"GITHUB_HOSTS"`
+	Modules   modules.Config   `envconfig:"MODULES_"`
+	Providers providers.Config `envconfig:"PROVIDERS_"`
+	Server    server.Config
+	Upstream  registry.Config `envconfig:"UPSTREAM_"`
+
+	// UpstreamNamespaces are the patterns of the namespaces that may be looked
+	// up upstream, which should never include the ones of our own modules.
+	UpstreamNamespaces []string `envconfig:"UPSTREAM_NAMESPACES"`
+}
+
+type routeConfig struct {
+	Backend   string `envconfig:"BACKEND"`
+	System    string `envconfig:"SYSTEM"`
+	Namespace string `envconfig:"NAMESPACE"`
 }
 
 func main() {
 	var cfg config
 	envconfig.MustProcess(&cfg)
+	if err := cfg.Github.Validate(); err != nil {
+		panic(err)
+	}
 
 	log := slog.New(slog.NewTextHandler(os.Stdout, nil))
 
-	var repo modules.Repository
-	repo = github.New(cfg.Github, &http.Client{
+	client := &http.Client{
 		Timeout: 5 * time.Second,
-	})
+	}
+
+	// Additional GitHub hosts, such as GitHub Enterprise Servers, are named in
+	// GITHUB_HOSTS and configured using the same variables as the default one,
+	// prefixed by the name, e.g. GITHUB_GHES_BASE_URL and GITHUB_GHES_OWNERS.
+	var hosts []*github.Service
+	for _, name := range cfg.Hosts {
+		var hc github.Config
+		envconfig.MustProcess(&hc, "GITHUB_"+strings.ToUpper(name)+"_")
+		hc.Name = name
+		if err := hc.Validate(); err != nil {
+			panic(err)
+		}
+		log.Info("adding github host", "name", name, "url", hc.BaseURL, "owners", hc.Owners)
+		hosts = append(hosts, github.New(hc, client, log))
+	}
+	gh := github.NewHosts(github.New(cfg.Github, client, log), hosts...)
+
+	var repo modules.Repository = gh
+	if cfg.Backend != "github" {
+		b, err := newBackend(cfg.Backend, strings.ToUpper(cfg.Backend)+"_", client, log)
+		if err != nil {
+			panic(err)
+		}
+		repo = b
+	}
+
+	// Routes send modules to other backends, based on their system and
+	// namespace. They are named in ROUTES, and configured by variables
+	// prefixed by the name, e.g. ROUTE_CORP_BACKEND=gitlab, ROUTE_CORP_SYSTEM
+	// and ROUTE_CORP_NAMESPACE (as patterns, where empty matches anything),
+	// along with the variables of the backend, such as ROUTE_CORP_TOKEN. Any
+	// module not matched by a route is served by the default backend.
+	if len(cfg.Routes) > 0 {
+		var routes []modules.Route
+		for _, name := range cfg.Routes {
+			prefix := "ROUTE_" + strings.ToUpper(name) + "_"
+			var rc routeConfig
+			envconfig.MustProcess(&rc, prefix)
+			b, err := newBackend(rc.Backend, prefix, client, log)
+			if err != nil {
+				panic(fmt.Errorf("route %s: %w", name, err))
+			}
+			log.Info("adding route", "name", name, "backend", rc.Backend, "system", rc.System, "namespace", rc.Namespace)
+			routes = append(routes, modules.Route{
+				System:     rc.System,
+				Namespace:  rc.Namespace,
+				Repository: b,
+			})
+		}
+		router, err := modules.NewRouter(repo, routes...)
+		if err != nil {
+			panic(err)
+		}
+		repo = router
+	}
+
+	// Modules that cannot be found are looked up in the upstream registry, if
+	// one is configured, as long as they belong to the listed namespaces.
+	var upstream modules.Repository
+	if cfg.Upstream.URL != "" {
+		if err := cfg.Upstream.Validate(); err != nil {
+			panic(err)
+		}
+		if len(cfg.UpstreamNamespaces) == 0 {
+			panic(errors.New("missing upstream namespaces"))
+		}
+		log.Info("enabling upstream registry", "url", cfg.Upstream.URL, "namespaces", cfg.UpstreamNamespaces)
+		// The upstream has a client of its own, since the archives are
+		// downloaded through it, which takes longer than the usual timeout.
+		upstream = registry.New(cfg.Upstream, &http.Client{Timeout: cfg.Upstream.Timeout}, log)
+	}
 
 	if cfg.Cache.Enabled {
-		log.Info("enabling cache", "path", cfg.Cache.Path, "expiration", cfg.Cache.Expiration)
-		repo = modules.NewCache(
-			repo,
-			mcache.New[string, []string](cfg.Cache.Expiration),
-			modules.StoreInPath(cfg.Cache.Path),
-			log,
+		// The upstream modules are cached separately, since their access is
+		// not restricted like the ones of our own repositories.
+		var (
+			store, upstreamStore modules.KeyValueStore
+			files, upstreamFiles modules.FileStorage
 		)
+		if cfg.Cache.Redis.Addr != "" {
+			// Replicas share the cache through Redis.
+			if err := cfg.Cache.Redis.Validate(); err != nil {
+				panic(err)
+			}
+			log.Info("enabling shared cache", "addr", cfg.Cache.Redis.Addr, "expiration", cfg.Cache.Config.Expiration)
+			c := redis.New(cfg.Cache.Redis)
+			store = redis.NewStore(c, "versions:", cfg.Cache.Config.Expiration, log)
+			upstreamStore = redis.NewStore(c, "upstream:versions:", cfg.Cache.Config.Expiration, log)
+			files = redis.NewFiles(c, "files:")
+			upstreamFiles = redis.NewFiles(c, "upstream:files:")
+		} else {
+			log.Info("enabling cache", "path", cfg.Cache.Disk.Path, "expiration", cfg.Cache.Config.Expiration,
+				"max_bytes", cfg.Cache.Disk.MaxBytes, "max_age", cfg.Cache.Disk.MaxAge)
+			d, err := diskcache.New(cfg.Cache.Disk, log)
+			if err != nil {
+				panic(err)
+			}
+			store = mcache.New[string, []string](cfg.Cache.Config.Expiration)
+			upstreamStore = mcache.New[string, []string](cfg.Cache.Config.Expiration)
+			files = d
+			upstreamFiles = d.Sub("upstream")
+		}
+
+		repo = modules.NewCache(cfg.Cache.Config, repo, store, files, log)
+		if upstream != nil {
+			upstream = modules.NewCache(cfg.Cache.Config, upstream, upstreamStore, upstreamFiles, log)
+		}
+	}
+
+	if upstream != nil {
+		f, err := modules.NewFallback(repo, upstream, cfg.UpstreamNamespaces...)
+		if err != nil {
+			panic(err)
+		}
+		repo = f
 	}
 
 	h, err := modules.NewHTTP(cfg.Modules, log, repo)
@@ -56,20 +203,130 @@ func main() {
 		panic(err)
 	}
 
+	// The providers share the proxy secret with the modules, unless a separate
+	// one has been configured.
+	if len(cfg.Providers.ProxySecret) == 0 {
+		cfg.Providers.ProxySecret = cfg.Modules.ProxySecret
+	}
+	ph, err := providers.NewHTTP(cfg.Providers, log, &githubProviders{gh.Providers()})
+	if err != nil {
+		panic(err)
+	}
+
 	r := router.New()
 	r.Use(auth.TokenMiddleware)
 
 	r.Get("/v1/modules/:namespace/:name/:system/versions", h.ListVersions)
+	r.Get("/v1/modules/:namespace/:name/:system/:version", h.GetVersion)
 	r.Get("/v1/modules/:namespace/:name/:system/:version/download", h.DownloadURL)
 	r.Get("/v1/modules/:namespace/:name/:system/:version/proxy", h.ProxyDownload)
+	r.Get("/v1/providers/:namespace/:type/versions", ph.ListVersions)
+	r.Get("/v1/providers/:namespace/:type/:version/download/:os/:arch", ph.FindPackage)
+	r.Get("/v1/providers/:namespace/:type/:version/assets/:filename", ph.ProxyAsset)
 	r.Get("/.well-known/terraform.json", discovery)
 
+	if cfg.AdminAddr != "" {
+		go serveAdmin(cfg.AdminAddr, log)
+	}
+
 	if err := server.Start(cfg.Server, log, r); err != nil {
 		panic(err)
 	}
 }
 
+// newBackend creates a repository of the kind, configured by the variables
+// with the prefix.
+func newBackend(kind, prefix string, client *http.Client, log *slog.Logger) (modules.Repository, error) {
+	log.Info("creating backend", "backend", kind, "prefix", prefix)
+	switch kind {
+	case "github":
+		var c github.Config
+		if err := envconfig.Process(&c, prefix); err != nil {
+			return nil, err
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		c.Name = strings.ToLower(strings.TrimSuffix(prefix, "_"))
+		return github.New(c, client, log), nil
+	case "gitlab":
+		var c gitlab.Config
+		if err := envconfig.Process(&c, prefix); err != nil {
+			return nil, err
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		return gitlab.New(c, client, log), nil
+	case "gitea":
+		var c gitea.Config
+		if err := envconfig.Process(&c, prefix); err != nil {
+			return nil, err
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		return gitea.New(c, client, log), nil
+	case "git":
+		var c git.Config
+		if err := envconfig.Process(&c, prefix); err != nil {
+			return nil, err
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		g := git.New(c, log)
+		go g.Run(context.Background())
+		return g, nil
+	case "local":
+		var c local.Config
+		if err := envconfig.Process(&c, prefix); err != nil {
+			return nil, err
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		return local.New(c, log), nil
+	case "registry":
+		var c registry.Config
+		if err := envconfig.Process(&c, prefix); err != nil {
+			return nil, err
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		return registry.New(c, client, log), nil
+	case "s3":
+		var c s3.Config
+		if err := envconfig.Process(&c, prefix); err != nil {
+			return nil, err
+		}
+		if err := c.Validate(); err != nil {
+			return nil, err
+		}
+		return s3.New(c, client, log), nil
+	default:
+		return nil, fmt.Errorf("unknown backend: %q", kind)
+	}
+}
+
+// serveAdmin serves the metrics on a separate listener, which can be kept
+// private, unlike the registry itself.
+func serveAdmin(addr string, log *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /debug/vars", expvar.Handler())
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 2 * time.Second,
+	}
+	log.Info("admin listening", "addr", addr)
+	if err := srv.ListenAndServe(); err != nil {
+		log.Error("admin serve error", "err", err)
+	}
+}
+
 func discovery(w http.ResponseWriter, r *http.Request) {
 	w.Header().Add("Content-Type", "application/json")
-	w.Write([]byte(`{"modules.v1":"/v1/modules"}`))
+	w.Write([]byte(`{"modules.v1":"/v1/modules","providers.v1":"/v1/providers/"}`))
 }
@@ -0,0 +1,59 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"io"
+
+	"github.com/hedlund/orbit/pkg/github"
+	"github.com/hedlund/orbit/services/providers"
+)
+
+// githubProviders serves the provider registry protocol from GitHub releases,
+// keeping the GitHub client unaware of the protocol types.
+type githubProviders struct {
+	releases *github.Providers
+}
+
+func (p *githubProviders) ListVersions(ctx context.Context, namespace, name string) ([]providers.Version, error) {
+	releases, err := p.releases.ListVersions(ctx, namespace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := make([]providers.Version, 0, len(releases))
+	for _, r := range releases {
+		v := providers.Version{
+			Version:   r.Version,
+			Platforms: make([]providers.Platform, 0, len(r.Platforms)),
+		}
+		for _, pl := range r.Platforms {
+			v.Platforms = append(v.Platforms, providers.Platform{OS: pl.OS, Arch: pl.Arch})
+		}
+		versions = append(versions, v)
+	}
+	return versions, nil
+}
+
+func (p *githubProviders) FindPackage(ctx context.Context, namespace, name, version, os, arch string) (*providers.Package, error) {
+	pkg, err := p.releases.FindPackage(ctx, namespace, name, version, os, arch)
+	if err != nil {
+		return nil, err
+	}
+	return &providers.Package{
+		Protocols:           pkg.Protocols,
+		OS:                  pkg.OS,
+		Arch:                pkg.Arch,
+		Filename:            pkg.Filename,
+		SHASum:              pkg.SHASum,
+		SHASumsFilename:     pkg.SHASumsFilename,
+		SHASumsSignFilename: pkg.SHASumsSignFilename,
+	}, nil
+}
+
+func (p *githubProviders) ProxyAsset(ctx context.Context, namespace, name, version, filename string, w io.Writer) error {
+	return p.releases.ProxyAsset(ctx, namespace, name, version, filename, w)
+}
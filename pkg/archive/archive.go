@@ -0,0 +1,203 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrUnknownFormat = errors.New("unknown archive format")
+)
+
+// Default is the format the repositories produce, and the cache stores.
+const Default = "tar.gz"
+
+// Writer is the interface shared by all archive formats. It mirrors the
+// `tar.Writer`, so that entries can be copied verbatim from a tar stream, no
+// matter the format that is being written.
+type Writer interface {
+	WriteHeader(hdr *tar.Header) error
+	Write(b []byte) (int, error)
+	Close() error
+}
+
+type format struct {
+	contentType string
+	newWriter   func(w io.Writer) Writer
+}
+
+// formats is the registry of archive formats, keyed by the names used by the
+// `archive` query parameter.
+var formats = map[string]format{}
+
+// Register makes an archive format available by name, as used by the `archive`
+// query parameter understood by Terraform.
+func Register(name, contentType string, f func(w io.Writer) Writer) {
+	formats[name] = format{contentType, f}
+}
+
+func init() {
+	Register("tar", "application/x-tar", newTar)
+	Register("tar.gz", "application/gzip", newTarGz)
+	Register("tgz", "application/gzip", newTarGz)
+	Register("zip", "application/zip", newZip)
+	Register("tar.xz", "application/x-xz", newTarXz)
+	Register("txz", "application/x-xz", newTarXz)
+}
+
+// NewWriter creates a writer for the named archive format.
+func NewWriter(name string, w io.Writer) (Writer, error) {
+	f, ok := formats[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownFormat, name)
+	}
+	return f.newWriter(w), nil
+}
+
+// Supported checks if the named archive format has been registered.
+func Supported(name string) bool {
+	_, ok := formats[name]
+	return ok
+}
+
+// ContentType returns the MIME type of the named archive format.
+func ContentType(name string) string {
+	if f, ok := formats[name]; ok {
+		return f.contentType
+	}
+	return "application/octet-stream"
+}
+
+// Formats lists the names of all registered archive formats.
+func Formats() []string {
+	names := make([]string, 0, len(formats))
+	for name := range formats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Copy writes all entries of the tar stream to the archive writer.
+func Copy(w Writer, r *tar.Reader) error {
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// CopyDir writes the entries of the tar stream that are located in the dir to
+// the archive writer, relative to the dir. The first component of every path
+// is ignored, since the source archives of forges wrap the contents in a
+// single top-level directory, e.g. `owner-repo-sha/`. An empty dir (or ".")
+// copies the entire contents.
+func CopyDir(w Writer, r *tar.Reader, dir string) error {
+	return copyDir(w, r, dir, true)
+}
+
+// CopySubdir is like CopyDir, but for archives without a top-level directory,
+// such as the ones served by module registries.
+func CopySubdir(w Writer, r *tar.Reader, dir string) error {
+	return copyDir(w, r, dir, false)
+}
+
+func copyDir(w Writer, r *tar.Reader, dir string, strip bool) error {
+	dir = strings.Trim(path.Clean("/"+dir), "/")
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if strip {
+			var ok bool
+			if _, name, ok = strings.Cut(name, "/"); !ok {
+				continue
+			}
+		}
+		if dir != "" {
+			var ok bool
+			if name, ok = strings.CutPrefix(name, dir+"/"); !ok {
+				continue
+			}
+		}
+		if name == "" {
+			continue
+		}
+
+		hdr.Name = name
+		if err := w.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// Repack reads a gzipped tar stream, as produced in the default format, and
+// writes its entries to the archive writer.
+func Repack(w Writer, r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("read gzip: %w", err)
+	}
+	defer zr.Close()
+
+	return Copy(w, tar.NewReader(zr))
+}
+
+func newTar(w io.Writer) Writer {
+	return tar.NewWriter(w)
+}
+
+func newTarGz(w io.Writer) Writer {
+	zw := gzip.NewWriter(w)
+	return &compressedTar{
+		Writer: tar.NewWriter(zw),
+		c:      zw,
+	}
+}
+
+// compressedTar is a tar writer wrapped in a compressing writer, that closes
+// both in the correct order.
+type compressedTar struct {
+	*tar.Writer
+	c io.Closer
+}
+
+func (t *compressedTar) Close() error {
+	if err := t.Writer.Close(); err != nil {
+		t.c.Close()
+		return err
+	}
+	return t.c.Close()
+}
@@ -0,0 +1,442 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestRepackZip(t *testing.T) {
+	var src bytes.Buffer
+	w, err := NewWriter(Default, &src)
+	if err != nil {
+		t.Fatalf("new writer: %s", err)
+	}
+	writeEntries(t, w, map[string]string{
+		"main.tf":         "variable \"a\" {}",
+		"modules/b/b.tf":  "output \"b\" {}",
+		"modules/b/c.txt": "",
+	})
+
+	var dst bytes.Buffer
+	zw, err := NewWriter("zip", &dst)
+	if err != nil {
+		t.Fatalf("new zip writer: %s", err)
+	}
+	if err := Repack(zw, &src); err != nil {
+		t.Fatalf("repack: %s", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(dst.Bytes()), int64(dst.Len()))
+	if err != nil {
+		t.Fatalf("read zip: %s", err)
+	}
+	got := map[string]string{}
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatalf("open %s: %s", f.Name, err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		got[f.Name] = string(b)
+	}
+	if got["main.tf"] != `variable "a" {}` || got["modules/b/b.tf"] != `output "b" {}` || len(got) != 3 {
+		t.Errorf("unexpected zip entries: %#v", got)
+	}
+}
+
+func TestUnknownFormat(t *testing.T) {
+	if _, err := NewWriter("rar", io.Discard); err == nil {
+		t.Errorf("expected error for unknown format")
+	}
+}
+
+func writeEntries(t *testing.T, w Writer, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		hdr := &tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0644,
+			Size:     int64(len(content)),
+		}
+		if err := w.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header: %s", err)
+		}
+		if _, err := io.WriteString(w, content); err != nil {
+			t.Fatalf("write content: %s", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+}
+
+func TestCopyDir(t *testing.T) {
+	var src bytes.Buffer
+	tw := tar.NewWriter(&src)
+	for _, name := range []string{
+		"owner-repo-abc123/README.md",
+		"owner-repo-abc123/modules/vpc/",
+		"owner-repo-abc123/modules/vpc/main.tf",
+		"owner-repo-abc123/modules/vpc/sub/variables.tf",
+		"owner-repo-abc123/modules/vpcx/main.tf",
+	} {
+		hdr := &tar.Header{Name: name, Typeflag: tar.TypeReg, Mode: 0644}
+		if name[len(name)-1] == '/' {
+			hdr.Typeflag = tar.TypeDir
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header: %s", err)
+		}
+	}
+	tw.Close()
+
+	var (
+		dst bytes.Buffer
+		w   = tar.NewWriter(&dst)
+	)
+	if err := CopyDir(w, tar.NewReader(&src), "modules/vpc"); err != nil {
+		t.Fatalf("copy dir: %s", err)
+	}
+	w.Close()
+
+	var got []string
+	tr := tar.NewReader(&dst)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %s", err)
+		}
+		got = append(got, hdr.Name)
+	}
+	if len(got) != 2 || got[0] != "main.tf" || got[1] != "sub/variables.tf" {
+		t.Errorf("unexpected entries: %v", got)
+	}
+}
+
+func TestXz(t *testing.T) {
+	files := map[string]string{
+		"main.tf": "variable \"a\" {}",
+		// Large enough to span several chunks, and compressible.
+		"large.txt": strings.Repeat("0123456789abcdef", 1<<14),
+		// Not compressible, so stored in uncompressed chunks.
+		"random.bin": string(noise(1 << 16)),
+		"empty.txt":  "",
+	}
+
+	var buf bytes.Buffer
+	w, err := NewWriter("tar.xz", &buf)
+	if err != nil {
+		t.Fatalf("new writer: %s", err)
+	}
+	writeEntries(t, w, files)
+
+	b, err := unxz(buf.Bytes())
+	if err != nil {
+		t.Fatalf("decode: %s", err)
+	}
+	if got := readEntries(t, b); !equalEntries(got, files) {
+		t.Errorf("unexpected entries after round trip: %d files", len(got))
+	}
+	if buf.Len() >= len(b)*2/3 {
+		t.Errorf("expected compression: %d bytes for %d", buf.Len(), len(b))
+	}
+
+	// Check the output against the reference implementation too, if it
+	// happens to be installed.
+	if _, err := exec.LookPath("xz"); err != nil {
+		return
+	}
+	cmd := exec.Command("xz", "--decompress", "--stdout")
+	cmd.Stdin = bytes.NewReader(buf.Bytes())
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("xz: %s", err)
+	}
+	if got := readEntries(t, out); !equalEntries(got, files) {
+		t.Errorf("unexpected entries from xz: %d files", len(got))
+	}
+}
+
+// noise returns n bytes that don't compress.
+func noise(n int) []byte {
+	b := make([]byte, n)
+	x := uint32(2463534242)
+	for i := range b {
+		x ^= x << 13
+		x ^= x >> 17
+		x ^= x << 5
+		b[i] = byte(x)
+	}
+	return b
+}
+
+// unxz decodes the stream written by the xz writer, i.e. a single block of
+// LZMA2 chunks, verifying the headers and checksums as it goes.
+func unxz(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, xzMagic) || !bytes.HasSuffix(b, xzFooterMagic) {
+		return nil, errors.New("missing magic bytes")
+	}
+	if binary.LittleEndian.Uint32(b[8:12]) != crc32.ChecksumIEEE(b[6:8]) {
+		return nil, errors.New("stream header checksum mismatch")
+	}
+	block := b[12:]
+	size := int(block[0]+1) * 4
+	if binary.LittleEndian.Uint32(block[size-4:size]) != crc32.ChecksumIEEE(block[:size-4]) {
+		return nil, errors.New("block header checksum mismatch")
+	}
+
+	var (
+		d   lzmaDecoder
+		pos = size
+	)
+	for {
+		ctrl := block[pos]
+		switch {
+		case ctrl == 0x00:
+			pos++
+		case ctrl == 0x01 || ctrl == 0x02:
+			n := int(block[pos+1])<<8 | int(block[pos+2]) + 1
+			d.out = append(d.out, block[pos+3:pos+3+n]...)
+			pos += 3 + n
+			continue
+		case ctrl >= 0xa0:
+			n := int(ctrl&0x1f)<<16 | int(block[pos+1])<<8 | int(block[pos+2]) + 1
+			m := int(block[pos+3])<<8 | int(block[pos+4]) + 1
+			pos += 5
+			if ctrl >= 0xc0 {
+				if block[pos] != lzmaProps {
+					return nil, fmt.Errorf("unexpected LZMA properties: %#x", block[pos])
+				}
+				pos++
+			}
+			if err := d.chunk(block[pos:pos+m], n); err != nil {
+				return nil, err
+			}
+			pos += m
+			continue
+		default:
+			return nil, fmt.Errorf("unexpected LZMA2 control byte: %#x", ctrl)
+		}
+		break
+	}
+	pos += pad4(int64(pos - size))
+	if binary.LittleEndian.Uint32(block[pos:pos+4]) != crc32.ChecksumIEEE(d.out) {
+		return nil, errors.New("content checksum mismatch")
+	}
+	return d.out, nil
+}
+
+// lzmaDecoder is a straightforward LZMA decoder, for the chunks written by
+// the encoder, i.e. with the state reset at the start of every chunk.
+type lzmaDecoder struct {
+	out   []byte
+	in    []byte
+	rng   uint32
+	code  uint32
+	model lzmaModel
+}
+
+func (d *lzmaDecoder) chunk(in []byte, n int) error {
+	if len(in) < 5 || in[0] != 0 {
+		return errors.New("invalid range coder data")
+	}
+	d.in, d.rng, d.code = in[5:], 0xffffffff, binary.BigEndian.Uint32(in[1:5])
+	d.model.reset()
+	m := &d.model
+
+	end := len(d.out) + n
+	for len(d.out) < end {
+		posState := uint32(len(d.out)) & (lzmaPosStates - 1)
+		if d.bit(&m.isMatch[m.state][posState]) == 0 {
+			var prev byte
+			if len(d.out) > 0 {
+				prev = d.out[len(d.out)-1]
+			}
+			probs := m.literal[0x300*uint32(prev>>(8-lzmaLC)):]
+			sym := uint32(1)
+			if m.state >= 7 {
+				match := uint32(d.out[len(d.out)-int(m.reps[0])-1])
+				for sym < 0x100 {
+					mb := match >> 7 & 1
+					match <<= 1
+					b := d.bit(&probs[(1+mb)<<8+sym])
+					sym = sym<<1 | b
+					if b != mb {
+						break
+					}
+				}
+			}
+			for sym < 0x100 {
+				sym = sym<<1 | d.bit(&probs[sym])
+			}
+			d.out = append(d.out, byte(sym))
+			m.state = [lzmaStates]uint32{0, 0, 0, 0, 1, 2, 3, 4, 5, 6, 4, 5}[m.state]
+			continue
+		}
+
+		var length uint32
+		if d.bit(&m.isRep[m.state]) == 0 {
+			length = d.length(&m.length, posState)
+			slot := d.tree(m.posSlot[min(length-lzmaMinMatch, 3)][:], 6)
+			dist := slot
+			if slot >= 4 {
+				footer := int(slot>>1) - 1
+				dist = (2 | slot&1) << footer
+				if slot < 14 {
+					dist += d.reverse(m.posSpecial[dist-slot:], footer)
+				} else {
+					dist += d.direct(footer-4) << 4
+					dist += d.reverse(m.align[:], 4)
+				}
+			}
+			m.reps = [4]uint32{dist, m.reps[0], m.reps[1], m.reps[2]}
+			m.state = map[bool]uint32{true: 7, false: 10}[m.state < 7]
+		} else {
+			idx := 0
+			if d.bit(&m.isRepG0[m.state]) == 0 {
+				if d.bit(&m.isRep0Long[m.state][posState]) == 0 {
+					return errors.New("unexpected short rep")
+				}
+			} else if d.bit(&m.isRepG1[m.state]) == 0 {
+				idx = 1
+			} else {
+				idx = 2 + int(d.bit(&m.isRepG2[m.state]))
+			}
+			dist := m.reps[idx]
+			copy(m.reps[1:idx+1], m.reps[:idx])
+			m.reps[0] = dist
+			length = d.length(&m.repLength, posState)
+			m.state = map[bool]uint32{true: 8, false: 11}[m.state < 7]
+		}
+
+		from := len(d.out) - int(m.reps[0]) - 1
+		if from < 0 || len(d.out)+int(length) > end {
+			return fmt.Errorf("invalid match at %d", len(d.out))
+		}
+		for i := 0; i < int(length); i++ {
+			d.out = append(d.out, d.out[from+i])
+		}
+	}
+	if len(d.in) != 0 {
+		return fmt.Errorf("%d bytes left in chunk", len(d.in))
+	}
+	return nil
+}
+
+func (d *lzmaDecoder) bit(p *prob) uint32 {
+	var b uint32
+	bound := (d.rng >> lzmaProbBits) * uint32(*p)
+	if d.code < bound {
+		d.rng = bound
+		*p += (1<<lzmaProbBits - *p) >> 5
+	} else {
+		d.code -= bound
+		d.rng -= bound
+		*p -= *p >> 5
+		b = 1
+	}
+	d.normalize()
+	return b
+}
+
+func (d *lzmaDecoder) direct(n int) uint32 {
+	var v uint32
+	for ; n > 0; n-- {
+		d.rng >>= 1
+		v <<= 1
+		if d.code >= d.rng {
+			d.code -= d.rng
+			v |= 1
+		}
+		d.normalize()
+	}
+	return v
+}
+
+func (d *lzmaDecoder) normalize() {
+	if d.rng < 1<<24 && len(d.in) > 0 {
+		d.rng <<= 8
+		d.code = d.code<<8 | uint32(d.in[0])
+		d.in = d.in[1:]
+	}
+}
+
+func (d *lzmaDecoder) tree(probs []prob, n int) uint32 {
+	m := uint32(1)
+	for i := 0; i < n; i++ {
+		m = m<<1 | d.bit(&probs[m])
+	}
+	return m - 1<<n
+}
+
+func (d *lzmaDecoder) reverse(probs []prob, n int) uint32 {
+	m, v := uint32(1), uint32(0)
+	for i := 0; i < n; i++ {
+		b := d.bit(&probs[m])
+		m = m<<1 | b
+		v |= b << i
+	}
+	return v
+}
+
+func (d *lzmaDecoder) length(l *lengthEncoder, posState uint32) uint32 {
+	switch {
+	case d.bit(&l.choice) == 0:
+		return lzmaMinMatch + d.tree(l.low[posState][:], 3)
+	case d.bit(&l.choice2) == 0:
+		return lzmaMinMatch + 8 + d.tree(l.mid[posState][:], 3)
+	default:
+		return lzmaMinMatch + 16 + d.tree(l.high[:], 8)
+	}
+}
+
+func readEntries(t *testing.T, b []byte) map[string]string {
+	t.Helper()
+
+	got := map[string]string{}
+	tr := tar.NewReader(bytes.NewReader(b))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return got
+		}
+		if err != nil {
+			t.Fatalf("reading tar: %s", err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("reading %s: %s", hdr.Name, err)
+		}
+		got[hdr.Name] = string(content)
+	}
+}
+
+func equalEntries(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, ok := b[k]; !ok || v != w {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CopyTree writes the contents of the directory to the archive writer, laid out
+// like the ones created by `git archive`, without following any symlinks.
+// Symlinks that point outside of the directory are left out. All entries get
+// the modification time, unless it's zero, in which case the time of each file
+// is used.
+func CopyTree(w Writer, root string, modTime time.Time) error {
+	return filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == root {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr := &tar.Header{
+			Name:    filepath.ToSlash(rel),
+			Mode:    int64(fi.Mode().Perm()),
+			ModTime: fi.ModTime(),
+			Uname:   "root",
+			Gname:   "root",
+		}
+		if !modTime.IsZero() {
+			hdr.ModTime = modTime
+		}
+		switch {
+		case d.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case d.Type()&fs.ModeSymlink != 0:
+			hdr.Typeflag = tar.TypeSymlink
+			if hdr.Linkname, err = os.Readlink(p); err != nil {
+				return err
+			}
+			if Escapes(rel, hdr.Linkname) {
+				return nil
+			}
+		case d.Type().IsRegular():
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = fi.Size()
+		default:
+			return nil
+		}
+
+		if err := w.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil
+		}
+
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(w, f); err != nil {
+			return fmt.Errorf("writing %s: %w", hdr.Name, err)
+		}
+		return nil
+	})
+}
+
+// Escapes checks if the target of the symlink, at the relative path, points
+// outside of the tree.
+func Escapes(rel, target string) bool {
+	if filepath.IsAbs(target) {
+		return true
+	}
+	p := filepath.Join(filepath.Dir(rel), target)
+	return p == ".." || strings.HasPrefix(p, ".."+string(filepath.Separator))
+}
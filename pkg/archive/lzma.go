@@ -0,0 +1,448 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"math/bits"
+)
+
+// The LZMA parameters used by the encoder. They are the defaults of the xz
+// tool, i.e. lc=3, lp=0 and pb=2, which encode to the properties byte 0x5d.
+const (
+	lzmaLC    = 3
+	lzmaPB    = 2
+	lzmaProps = (lzmaPB*5)*9 + lzmaLC
+
+	lzmaStates    = 12
+	lzmaPosStates = 1 << lzmaPB
+	lzmaMinMatch  = 2
+	lzmaMaxMatch  = 273
+
+	lzmaDictSize = 1 << 20
+	lzmaDictProp = 16 // (2 | 16&1) << (16/2 + 11) = 1 MiB.
+
+	lzmaHashBits  = 16
+	lzmaChainLen  = 48
+	lzmaNiceMatch = 128
+
+	lzmaProbBits = 11
+	lzmaProbInit = 1 << lzmaProbBits >> 1
+)
+
+type prob uint16
+
+// rangeEncoder is the binary arithmetic coder that LZMA is built on.
+type rangeEncoder struct {
+	out       []byte
+	low       uint64
+	rng       uint32
+	cache     byte
+	cacheSize int
+}
+
+func (e *rangeEncoder) reset() {
+	*e = rangeEncoder{out: e.out[:0], rng: 0xffffffff, cacheSize: 1}
+}
+
+func (e *rangeEncoder) bit(p *prob, b uint32) {
+	bound := (e.rng >> lzmaProbBits) * uint32(*p)
+	if b == 0 {
+		e.rng = bound
+		*p += (1<<lzmaProbBits - *p) >> 5
+	} else {
+		e.low += uint64(bound)
+		e.rng -= bound
+		*p -= *p >> 5
+	}
+	e.normalize()
+}
+
+func (e *rangeEncoder) direct(v uint32, n int) {
+	for i := n - 1; i >= 0; i-- {
+		e.rng >>= 1
+		if v>>i&1 == 1 {
+			e.low += uint64(e.rng)
+		}
+		e.normalize()
+	}
+}
+
+func (e *rangeEncoder) normalize() {
+	for e.rng < 1<<24 {
+		e.rng <<= 8
+		e.shiftLow()
+	}
+}
+
+func (e *rangeEncoder) shiftLow() {
+	if uint32(e.low) < 0xff000000 || e.low>>32 != 0 {
+		carry := byte(e.low >> 32)
+		b := e.cache
+		for ; e.cacheSize > 0; e.cacheSize-- {
+			e.out = append(e.out, b+carry)
+			b = 0xff
+		}
+		e.cache = byte(e.low >> 24)
+	}
+	e.cacheSize++
+	e.low = uint64(uint32(e.low) << 8)
+}
+
+func (e *rangeEncoder) flush() []byte {
+	for i := 0; i < 5; i++ {
+		e.shiftLow()
+	}
+	return e.out
+}
+
+// tree encodes the n lowest bits of v, most significant bit first.
+func (e *rangeEncoder) tree(probs []prob, v uint32, n int) {
+	m := uint32(1)
+	for i := n - 1; i >= 0; i-- {
+		b := v >> i & 1
+		e.bit(&probs[m], b)
+		m = m<<1 | b
+	}
+}
+
+// reverse encodes the n lowest bits of v, least significant bit first.
+func (e *rangeEncoder) reverse(probs []prob, v uint32, n int) {
+	m := uint32(1)
+	for i := 0; i < n; i++ {
+		b := v & 1
+		v >>= 1
+		e.bit(&probs[m], b)
+		m = m<<1 | b
+	}
+}
+
+type lengthEncoder struct {
+	choice  prob
+	choice2 prob
+	low     [lzmaPosStates][1 << 3]prob
+	mid     [lzmaPosStates][1 << 3]prob
+	high    [1 << 8]prob
+}
+
+func (l *lengthEncoder) encode(e *rangeEncoder, n, posState uint32) {
+	n -= lzmaMinMatch
+	switch {
+	case n < 8:
+		e.bit(&l.choice, 0)
+		e.tree(l.low[posState][:], n, 3)
+	case n < 16:
+		e.bit(&l.choice, 1)
+		e.bit(&l.choice2, 0)
+		e.tree(l.mid[posState][:], n-8, 3)
+	default:
+		e.bit(&l.choice, 1)
+		e.bit(&l.choice2, 1)
+		e.tree(l.high[:], n-16, 8)
+	}
+}
+
+// lzmaModel holds the adaptive probabilities, and the state, of the encoder.
+// It is reset at the start of every LZMA2 chunk.
+type lzmaModel struct {
+	isMatch    [lzmaStates][lzmaPosStates]prob
+	isRep      [lzmaStates]prob
+	isRepG0    [lzmaStates]prob
+	isRepG1    [lzmaStates]prob
+	isRepG2    [lzmaStates]prob
+	isRep0Long [lzmaStates][lzmaPosStates]prob
+	posSlot    [4][1 << 6]prob
+	posSpecial [115]prob // Offset by one, as the first tree starts at -1.
+	align      [1 << 4]prob
+	length     lengthEncoder
+	repLength  lengthEncoder
+	literal    [0x300 << lzmaLC]prob
+
+	state uint32
+	reps  [4]uint32
+}
+
+func (m *lzmaModel) reset() {
+	*m = lzmaModel{}
+	fill := func(p []prob) {
+		for i := range p {
+			p[i] = lzmaProbInit
+		}
+	}
+	for i := range m.isMatch {
+		fill(m.isMatch[i][:])
+		fill(m.isRep0Long[i][:])
+	}
+	fill(m.isRep[:])
+	fill(m.isRepG0[:])
+	fill(m.isRepG1[:])
+	fill(m.isRepG2[:])
+	for i := range m.posSlot {
+		fill(m.posSlot[i][:])
+	}
+	fill(m.posSpecial[:])
+	fill(m.align[:])
+	for _, l := range []*lengthEncoder{&m.length, &m.repLength} {
+		l.choice, l.choice2 = lzmaProbInit, lzmaProbInit
+		for i := range l.low {
+			fill(l.low[i][:])
+			fill(l.mid[i][:])
+		}
+		fill(l.high[:])
+	}
+	fill(m.literal[:])
+}
+
+// lzmaEncoder compresses data into LZMA2 chunks, using a hash chain match
+// finder and greedy parsing. It is nowhere near as thorough as the reference
+// implementation, but good enough for archives of source code.
+type lzmaEncoder struct {
+	rc    rangeEncoder
+	model lzmaModel
+
+	// The window holds the data seen so far, where window[0] is at the
+	// absolute position base. Data before pos has been encoded.
+	window []byte
+	base   int64
+	pos    int64
+
+	head []int64
+	prev []int64
+}
+
+func newLZMAEncoder() *lzmaEncoder {
+	e := &lzmaEncoder{
+		head: make([]int64, 1<<lzmaHashBits),
+		prev: make([]int64, lzmaDictSize),
+	}
+	for i := range e.head {
+		e.head[i] = -1
+	}
+	return e
+}
+
+// write appends data to the window, to be encoded by later calls to chunk.
+func (e *lzmaEncoder) write(b []byte) {
+	// Drop the data that is no longer reachable by any match.
+	if keep := e.pos - lzmaDictSize - e.base; keep > 0 && len(e.window)+len(b) > cap(e.window) {
+		e.window = append(e.window[:0], e.window[keep:]...)
+		e.base += keep
+	}
+	e.window = append(e.window, b...)
+}
+
+// pending returns the number of bytes written but not yet encoded.
+func (e *lzmaEncoder) pending() int {
+	return int(e.base + int64(len(e.window)) - e.pos)
+}
+
+// chunk encodes the next n bytes of pending data, returning the compressed
+// data. The model is reset before encoding, but the dictionary isn't, so
+// matches can reach back into earlier chunks.
+func (e *lzmaEncoder) chunk(n int) []byte {
+	e.rc.reset()
+	e.model.reset()
+	m := &e.model
+
+	end := e.pos + int64(n)
+	for e.pos < end {
+		posState := uint32(e.pos) & (lzmaPosStates - 1)
+		limit := int(min(end-e.pos, lzmaMaxMatch))
+
+		repLen, repIdx := 0, 0
+		for i, r := range m.reps {
+			if l := e.matchLen(e.pos-int64(r)-1, limit); l > repLen {
+				repLen, repIdx = l, i
+			}
+		}
+		matchLen, dist := 0, uint32(0)
+		if repLen < lzmaNiceMatch {
+			matchLen, dist = e.findMatch(limit)
+		}
+
+		switch {
+		case repLen >= lzmaMinMatch && repLen+1 >= matchLen:
+			e.encodeRep(repIdx, uint32(repLen), posState)
+			e.skip(repLen)
+		case matchLen >= 3:
+			e.encodeMatch(dist, uint32(matchLen), posState)
+			e.skip(matchLen)
+		default:
+			e.encodeLiteral(posState)
+			e.skip(1)
+		}
+	}
+	return e.rc.flush()
+}
+
+func (e *lzmaEncoder) at(pos int64) byte {
+	return e.window[pos-e.base]
+}
+
+// matchLen returns the length of the match between the data at from and the
+// current position, up to limit bytes.
+func (e *lzmaEncoder) matchLen(from int64, limit int) int {
+	if from < e.base || from < e.pos-lzmaDictSize {
+		return 0
+	}
+	a := e.window[from-e.base:]
+	b := e.window[e.pos-e.base : e.pos-e.base+int64(limit)]
+	n := 0
+	for n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+func (e *lzmaEncoder) hash(pos int64) (uint32, bool) {
+	i := pos - e.base
+	if i+3 > int64(len(e.window)) {
+		return 0, false
+	}
+	w := e.window[i:]
+	h := (uint32(w[0]) | uint32(w[1])<<8 | uint32(w[2])<<16) * 2654435761
+	return h >> (32 - lzmaHashBits), true
+}
+
+// findMatch walks the hash chain of the current position for the longest
+// match, returning its length and distance.
+func (e *lzmaEncoder) findMatch(limit int) (int, uint32) {
+	h, ok := e.hash(e.pos)
+	if !ok {
+		return 0, 0
+	}
+	best, dist := 0, uint32(0)
+	cand := e.head[h]
+	for i := 0; i < lzmaChainLen && cand >= 0; i++ {
+		if e.pos-cand > lzmaDictSize || cand < e.base {
+			break
+		}
+		if l := e.matchLen(cand, limit); l > best {
+			best, dist = l, uint32(e.pos-cand-1)
+			if l >= lzmaNiceMatch || l == limit {
+				break
+			}
+		}
+		next := e.prev[cand%lzmaDictSize]
+		if next >= cand {
+			break
+		}
+		cand = next
+	}
+	return best, dist
+}
+
+// skip advances the current position by n bytes, adding each position to the
+// hash chains.
+func (e *lzmaEncoder) skip(n int) {
+	for ; n > 0; n-- {
+		if h, ok := e.hash(e.pos); ok {
+			e.prev[e.pos%lzmaDictSize] = e.head[h]
+			e.head[h] = e.pos
+		}
+		e.pos++
+	}
+}
+
+func (e *lzmaEncoder) encodeLiteral(posState uint32) {
+	m := &e.model
+	e.rc.bit(&m.isMatch[m.state][posState], 0)
+
+	var prevByte byte
+	if e.pos > 0 {
+		prevByte = e.at(e.pos - 1)
+	}
+	probs := m.literal[0x300*uint32(prevByte>>(8-lzmaLC)):]
+	sym := uint32(e.at(e.pos)) | 0x100
+
+	if m.state < 7 {
+		e.rc.tree(probs, sym, 8)
+	} else {
+		// After a match, the literal is coded relative to the byte at the
+		// last distance, which the decoder is likely to predict.
+		matchByte := uint32(e.at(e.pos - int64(m.reps[0]) - 1))
+		offs := uint32(0x100)
+		for sym < 0x10000 {
+			matchByte <<= 1
+			e.rc.bit(&probs[offs+(matchByte&offs)+(sym>>8)], sym>>7&1)
+			sym <<= 1
+			offs &= ^(matchByte ^ sym)
+		}
+	}
+
+	switch {
+	case m.state < 4:
+		m.state = 0
+	case m.state < 10:
+		m.state -= 3
+	default:
+		m.state -= 6
+	}
+}
+
+func (e *lzmaEncoder) encodeMatch(dist, n, posState uint32) {
+	m := &e.model
+	e.rc.bit(&m.isMatch[m.state][posState], 1)
+	e.rc.bit(&m.isRep[m.state], 0)
+	m.length.encode(&e.rc, n, posState)
+
+	slot := posSlot(dist)
+	e.rc.tree(m.posSlot[min(n-lzmaMinMatch, 3)][:], slot, 6)
+	if slot >= 4 {
+		footer := int(slot>>1) - 1
+		base := (2 | slot&1) << footer
+		reduced := dist - base
+		if slot < 14 {
+			e.rc.reverse(m.posSpecial[base-slot:], reduced, footer)
+		} else {
+			e.rc.direct(reduced>>4, footer-4)
+			e.rc.reverse(m.align[:], reduced&0xf, 4)
+		}
+	}
+
+	m.reps = [4]uint32{dist, m.reps[0], m.reps[1], m.reps[2]}
+	if m.state < 7 {
+		m.state = 7
+	} else {
+		m.state = 10
+	}
+}
+
+func (e *lzmaEncoder) encodeRep(idx int, n, posState uint32) {
+	m := &e.model
+	e.rc.bit(&m.isMatch[m.state][posState], 1)
+	e.rc.bit(&m.isRep[m.state], 1)
+	if idx == 0 {
+		e.rc.bit(&m.isRepG0[m.state], 0)
+		e.rc.bit(&m.isRep0Long[m.state][posState], 1)
+	} else {
+		e.rc.bit(&m.isRepG0[m.state], 1)
+		if idx == 1 {
+			e.rc.bit(&m.isRepG1[m.state], 0)
+		} else {
+			e.rc.bit(&m.isRepG1[m.state], 1)
+			e.rc.bit(&m.isRepG2[m.state], uint32(idx-2))
+		}
+		dist := m.reps[idx]
+		copy(m.reps[1:idx+1], m.reps[:idx])
+		m.reps[0] = dist
+	}
+	m.repLength.encode(&e.rc, n, posState)
+
+	if m.state < 7 {
+		m.state = 8
+	} else {
+		m.state = 11
+	}
+}
+
+// posSlot returns the slot of a (zero based) match distance, i.e. its two
+// highest bits and their position.
+func posSlot(dist uint32) uint32 {
+	if dist < 4 {
+		return dist
+	}
+	n := uint32(bits.Len32(dist)) - 1
+	return n<<1 | dist>>(n-1)&1
+}
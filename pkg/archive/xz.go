@@ -0,0 +1,193 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+const (
+	// xzChunkSize is the amount of data encoded into each LZMA2 chunk. It
+	// is small enough for the compressed data to always fit a chunk, even
+	// when the input can't be compressed.
+	xzChunkSize = 1 << 15
+)
+
+var (
+	xzMagic       = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+	xzFooterMagic = []byte{'Y', 'Z'}
+	xzStreamFlags = []byte{0x00, 0x01} // CRC32 check
+)
+
+func newTarXz(w io.Writer) Writer {
+	xw := &xzWriter{
+		w:     w,
+		enc:   newLZMAEncoder(),
+		check: crc32.NewIEEE(),
+	}
+	return &compressedTar{
+		Writer: tar.NewWriter(xw),
+		c:      xw,
+	}
+}
+
+// xzWriter produces an .xz stream holding a single block of LZMA2 chunks. The
+// standard library lacks an LZMA encoder, so it brings its own. Chunks that
+// don't compress are stored as is, which LZMA2 allows for.
+type xzWriter struct {
+	w       io.Writer
+	enc     *lzmaEncoder
+	check   hash.Hash32
+	started bool
+	chunks  int
+	props   bool  // Whether the LZMA properties have been written.
+	written int64 // Compressed size of the block data.
+	size    int64 // Uncompressed size of the block data.
+	err     error
+}
+
+func (x *xzWriter) Write(b []byte) (int, error) {
+	if x.err != nil {
+		return 0, x.err
+	}
+	x.enc.write(b)
+	for x.enc.pending() >= xzChunkSize {
+		if err := x.flush(xzChunkSize); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+func (x *xzWriter) Close() error {
+	if x.err != nil {
+		return x.err
+	}
+	if err := x.flush(x.enc.pending()); err != nil {
+		return err
+	}
+	if err := x.header(); err != nil {
+		return err
+	}
+
+	// End of LZMA2 data, followed by the block padding and check.
+	x.write([]byte{0x00})
+	x.written++
+	x.write(make([]byte, pad4(x.written)))
+	x.write(binary.LittleEndian.AppendUint32(nil, x.check.Sum32()))
+
+	// The index holds a single record, for our single block.
+	unpadded := int64(xzBlockHeaderSize) + x.written + 4
+	index := []byte{0x00}
+	index = binary.AppendUvarint(index, 1)
+	index = binary.AppendUvarint(index, uint64(unpadded))
+	index = binary.AppendUvarint(index, uint64(x.size))
+	index = append(index, make([]byte, pad4(int64(len(index))))...)
+	index = binary.LittleEndian.AppendUint32(index, crc32.ChecksumIEEE(index))
+	x.write(index)
+
+	footer := binary.LittleEndian.AppendUint32(nil, uint32(len(index)/4-1))
+	footer = append(footer, xzStreamFlags...)
+	footer = append(binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(footer)), footer...)
+	footer = append(footer, xzFooterMagic...)
+	x.write(footer)
+
+	return x.err
+}
+
+// xzBlockHeaderSize is the size of the block header written by header(), i.e.
+// the size byte, flags, a single LZMA2 filter with properties, padding and CRC.
+const xzBlockHeaderSize = 12
+
+// header writes the stream and block headers, unless already written.
+func (x *xzWriter) header() error {
+	if x.started {
+		return x.err
+	}
+	x.started = true
+
+	stream := append([]byte{}, xzMagic...)
+	stream = append(stream, xzStreamFlags...)
+	stream = binary.LittleEndian.AppendUint32(stream, crc32.ChecksumIEEE(xzStreamFlags))
+	x.write(stream)
+
+	block := []byte{
+		xzBlockHeaderSize/4 - 1,
+		0x00,       // One filter, no optional sizes.
+		0x21, 0x01, // LZMA2 filter, with one byte of properties.
+		lzmaDictProp,     // Dictionary size.
+		0x00, 0x00, 0x00, // Padding.
+	}
+	block = binary.LittleEndian.AppendUint32(block, crc32.ChecksumIEEE(block))
+	x.write(block)
+	return x.err
+}
+
+// flush encodes the next n bytes of pending data as an LZMA2 chunk, or stores
+// them uncompressed if that turns out smaller.
+func (x *xzWriter) flush(n int) error {
+	if n == 0 {
+		return x.err
+	}
+	if err := x.header(); err != nil {
+		return err
+	}
+
+	data := x.enc.window[x.enc.pos-x.enc.base:][:n]
+	x.check.Write(data)
+	x.size += int64(n)
+
+	// The compressed data always fits a chunk, as xzChunkSize is far below
+	// the 64 KiB limit, but may still be larger than the input.
+	packed := x.enc.chunk(n)
+	if len(packed) < n {
+		// Every chunk resets the state, the first one also the dictionary,
+		// and the properties are sent along until they have been once.
+		ctrl := byte(0xa0)
+		switch {
+		case x.chunks == 0:
+			ctrl = 0xe0
+		case !x.props:
+			ctrl = 0xc0
+		}
+		hdr := []byte{
+			ctrl | byte((n-1)>>16),
+			byte((n - 1) >> 8), byte(n - 1),
+			byte((len(packed) - 1) >> 8), byte(len(packed) - 1),
+		}
+		if !x.props {
+			hdr = append(hdr, lzmaProps)
+			x.props = true
+		}
+		x.write(hdr)
+		x.write(packed)
+		x.written += int64(len(hdr) + len(packed))
+	} else {
+		// The first chunk must reset the dictionary.
+		ctrl := byte(0x02)
+		if x.chunks == 0 {
+			ctrl = 0x01
+		}
+		x.write([]byte{ctrl, byte((n - 1) >> 8), byte(n - 1)})
+		x.write(data)
+		x.written += int64(3 + n)
+	}
+	x.chunks++
+	return x.err
+}
+
+func (x *xzWriter) write(b []byte) {
+	if x.err == nil {
+		_, x.err = x.w.Write(b)
+	}
+}
+
+func pad4(n int64) int {
+	return int((4 - n%4) % 4)
+}
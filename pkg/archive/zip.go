@@ -0,0 +1,74 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"strings"
+)
+
+func newZip(w io.Writer) Writer {
+	return &zipWriter{
+		zw: zip.NewWriter(w),
+	}
+}
+
+// zipWriter translates tar entries into zip entries. Only directories, regular
+// files and symlinks are written; other entry types have no zip equivalent and
+// are skipped.
+type zipWriter struct {
+	zw  *zip.Writer
+	cur io.Writer
+}
+
+func (z *zipWriter) WriteHeader(hdr *tar.Header) error {
+	z.cur = nil
+
+	fh, err := zip.FileInfoHeader(hdr.FileInfo())
+	if err != nil {
+		return fmt.Errorf("zip header: %w", err)
+	}
+	fh.Name = strings.TrimPrefix(hdr.Name, "./")
+	fh.Modified = hdr.ModTime
+
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if !strings.HasSuffix(fh.Name, "/") {
+			fh.Name += "/"
+		}
+		fh.Method = zip.Store
+		_, err = z.zw.CreateHeader(fh)
+		return err
+	case tar.TypeSymlink:
+		fh.Method = zip.Store
+		w, err := z.zw.CreateHeader(fh)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, hdr.Linkname)
+		return err
+	case tar.TypeReg:
+		fh.Method = zip.Deflate
+		z.cur, err = z.zw.CreateHeader(fh)
+		return err
+	default:
+		return nil
+	}
+}
+
+func (z *zipWriter) Write(b []byte) (int, error) {
+	if z.cur == nil {
+		// Discard the content of any skipped entries.
+		return len(b), nil
+	}
+	return z.cur.Write(b)
+}
+
+func (z *zipWriter) Close() error {
+	return z.zw.Close()
+}
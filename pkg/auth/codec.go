@@ -0,0 +1,106 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+type Cipher interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+	NonceSize() int
+}
+
+// NewCodec creates a codec that encrypts tokens with AES-GCM using the secret,
+// so that they can be passed around in URLs for a limited time.
+func NewCodec(secret []byte, expiration time.Duration) (*Codec, error) {
+	c, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Codec{
+		cipher:     gcm,
+		expiration: expiration,
+		now:        time.Now,
+	}, nil
+}
+
+type Codec struct {
+	cipher     Cipher
+	expiration time.Duration
+	now        func() time.Time
+}
+
+func (c *Codec) Encode(token string) (string, error) {
+	b, err := json.Marshal(&encodedToken{
+		Token:     token,
+		EncodedAt: c.now().Unix(),
+	})
+	if err != nil {
+		return "", fmt.Errorf("marshalling token into JSON: %w", err)
+	}
+
+	nonce := make([]byte, c.cipher.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generating token nonce: %w", err)
+	}
+
+	encoded := c.cipher.Seal(nonce, nonce, b, nil)
+	return hex.EncodeToString(encoded), nil
+}
+
+func (c *Codec) Decode(encoded string) (string, error) {
+	ciphertext, err := hex.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decoding token string: %w", err)
+	}
+
+	nonceSize := c.cipher.NonceSize()
+	if len(ciphertext) < nonceSize {
+		return "", fmt.Errorf("token is too short: %w", ErrInvalidToken)
+	}
+
+	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
+	b, err := c.cipher.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("decoding token: %w", err)
+	}
+
+	var token encodedToken
+	if err := json.Unmarshal(b, &token); err != nil {
+		return "", fmt.Errorf("unmarshal token: %w", err)
+	}
+
+	now := c.now().UTC()
+	validUntil := time.Unix(token.EncodedAt, 0).Add(c.expiration).UTC()
+	if !now.Before(validUntil) {
+		return "", fmt.Errorf("%w: valid until %s", ErrTokenExpired, validUntil)
+	}
+
+	return token.Token, nil
+}
+
+type encodedToken struct {
+	Token     string `json:"token"`
+	EncodedAt int64  `json:"encoded_at"`
+}
@@ -0,0 +1,157 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package backend holds what the module backends for git hosting services have
+// in common, i.e. how the repositories are allowed, laid out and requested.
+package backend
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/hedlund/orbit/pkg/layout"
+	"github.com/hedlund/orbit/services/modules"
+)
+
+// Templates describe how the tags of modules are named, and where the modules
+// are located in the repository, the same way as for GitHub. They can be
+// overridden per repository, keyed by `owner/repo`.
+type Templates struct {
+	TagTemplate   string            `envconfig:"TAG_TEMPLATE" default:"{module}/{version}"`
+	TagTemplates  map[string]string `envconfig:"TAG_TEMPLATES"`
+	PathTemplate  string            `envconfig:"PATH_TEMPLATE" default:"{module}"`
+	PathTemplates map[string]string `envconfig:"PATH_TEMPLATES"`
+	PathSeparator string            `envconfig:"PATH_SEPARATOR"`
+}
+
+// Validate checks that the tag templates contain the version.
+func (t *Templates) Validate() error {
+	if t.TagTemplate != "" {
+		if err := layout.ValidTagTemplate(t.TagTemplate); err != nil {
+			return err
+		}
+	}
+	for _, tt := range t.TagTemplates {
+		if err := layout.ValidTagTemplate(tt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TagScheme returns the tag naming scheme of the module, using the template
+// configured for the repository, or the default one.
+func (t *Templates) TagScheme(owner, repo, module string) layout.TagScheme {
+	template := t.TagTemplate
+	if tt, ok := t.TagTemplates[owner+"/"+repo]; ok {
+		template = tt
+	}
+	return layout.NewTagScheme(template, module)
+}
+
+// ModulePath returns the directory of the module inside the repository, using
+// the path template configured for the repository, or the default one.
+func (t *Templates) ModulePath(owner, repo, module string) (string, error) {
+	template := t.PathTemplate
+	if tt, ok := t.PathTemplates[owner+"/"+repo]; ok {
+		template = tt
+	}
+
+	p, err := layout.ModulePath(template, t.PathSeparator, module)
+	if err != nil {
+		return "", &Error{
+			Code: http.StatusBadRequest,
+			Msg:  err.Error(),
+		}
+	}
+	return p, nil
+}
+
+// MapOwner returns the owner the system is mapped to, or the system itself.
+func MapOwner(mappings map[string]string, system string) string {
+	if owner, ok := mappings[system]; ok {
+		return owner
+	}
+	return system
+}
+
+// Allowed checks that the repository is among the allowed ones, keyed by
+// owner. Any repository is allowed, unless some have been configured.
+func Allowed(allowed map[string][]string, owner, repo string) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+
+	for _, r := range allowed[owner] {
+		if r == repo {
+			return nil
+		}
+	}
+
+	return &Error{
+		Code: http.StatusForbidden,
+		Msg:  "not a valid repository",
+		Err:  modules.ErrNotAllowed,
+	}
+}
+
+// ValidBaseURL checks that the base URL of an API is an HTTP(S) URL.
+func ValidBaseURL(base string) error {
+	u, err := url.Parse(base)
+	if err != nil {
+		return fmt.Errorf("invalid base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid base URL: %q", base)
+	}
+	return nil
+}
+
+// JoinURL returns the full URL of the API endpoint, relative to the base URL.
+func JoinURL(base, uri string) string {
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(uri, "/")
+}
+
+// ResponseError turns an unsuccessful response into an error, with the body
+// as the message.
+func ResponseError(res *http.Response) error {
+	return &Error{
+		Code: res.StatusCode,
+		Msg:  Slurp(res.Body),
+	}
+}
+
+// Slurp reads and closes the body, returning it as a string.
+func Slurp(r io.ReadCloser) string {
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+// Error is returned with the status code that the registry should respond
+// with.
+type Error struct {
+	Code int
+	Msg  string
+	Err  error // Optional cause, for errors.Is.
+}
+
+func (e *Error) Error() string {
+	return e.Msg
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func (e *Error) StatusCode() int {
+	return e.Code
+}
@@ -0,0 +1,61 @@
+package backend
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	tmpl := Templates{
+		TagTemplate:   "{module}/{version}",
+		TagTemplates:  map[string]string{"acme/infra": "v{version}"},
+		PathTemplate:  "{module}",
+		PathTemplates: map[string]string{"acme/infra": "modules/{module}"},
+	}
+	if err := tmpl.Validate(); err != nil {
+		t.Fatalf("validate: %s", err)
+	}
+
+	tests := map[string]struct {
+		owner, repo string
+		tag, path   string
+	}{
+		"default":  {"acme", "other", "vpc/1.0.0", "vpc"},
+		"override": {"acme", "infra", "v1.0.0", "modules/vpc"},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			if tag := tmpl.TagScheme(tt.owner, tt.repo, "vpc").Tag("1.0.0"); tag != tt.tag {
+				t.Errorf("unexpected tag, exp: %q, got: %q", tt.tag, tag)
+			}
+			p, err := tmpl.ModulePath(tt.owner, tt.repo, "vpc")
+			if err != nil {
+				t.Fatalf("module path: %s", err)
+			}
+			if p != tt.path {
+				t.Errorf("unexpected path, exp: %q, got: %q", tt.path, p)
+			}
+		})
+	}
+
+	if err := (&Templates{TagTemplate: "{module}"}).Validate(); err == nil {
+		t.Error("expected a tag template without the version to be invalid")
+	}
+}
+
+func TestAllowed(t *testing.T) {
+	if err := Allowed(nil, "acme", "infra"); err != nil {
+		t.Errorf("expected any repository to be allowed, got: %s", err)
+	}
+
+	allowed := map[string][]string{"acme": {"infra"}}
+	if err := Allowed(allowed, "acme", "infra"); err != nil {
+		t.Errorf("expected acme/infra to be allowed, got: %s", err)
+	}
+	for _, repo := range [][2]string{{"acme", "other"}, {"other", "infra"}} {
+		err := Allowed(allowed, repo[0], repo[1])
+		if e, ok := err.(*Error); !ok || e.StatusCode() != http.StatusForbidden {
+			t.Errorf("expected %s/%s to be forbidden, got: %v", repo[0], repo[1], err)
+		}
+	}
+}
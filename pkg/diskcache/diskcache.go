@@ -0,0 +1,441 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package diskcache stores files on disk, for caching the module archives. The
+// files are written atomically and verified by checksum the first time they are
+// read after a restart, and the least recently used are evicted when the
+// limits are exceeded.
+package diskcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sumExt    = ".sum"
+	tmpPrefix = ".orbit-tmp-"
+)
+
+var (
+	ErrInvalidName = errors.New("invalid file name")
+	ErrCorrupt     = errors.New("corrupt file")
+)
+
+type Config struct {
+	// Path is the directory where the files are stored, which is created if
+	// it doesn't exist. It should not be shared, since all of it is indexed
+	// on startup.
+	Path string `envconfig:"PATH" default:"/tmp/orbit"`
+
+	// MaxBytes is the total size of the files that are kept, and MaxAge is
+	// how long they are kept after being written. Zero means no limit.
+	MaxBytes int64         `envconfig:"MAX_BYTES"`
+	MaxAge   time.Duration `envconfig:"MAX_AGE"`
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+// New creates a storage in the path, indexing the files that are already
+// there, so that the limits apply to them as well.
+func New(cfg Config, log Logger) (*Storage, error) {
+	if err := os.MkdirAll(cfg.Path, 0o755); err != nil {
+		return nil, fmt.Errorf("creating cache dir: %w", err)
+	}
+
+	s := &Storage{
+		cfg:     cfg,
+		log:     log,
+		now:     time.Now,
+		entries: make(map[string]*entry),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict()
+	return s, nil
+}
+
+type Storage struct {
+	cfg Config
+	log Logger
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*entry
+	size    int64
+}
+
+// entry is a stored file, along with the metadata kept in the checksum file
+// next to it.
+type entry struct {
+	Checksum string    `json:"sha256"`
+	Size     int64     `json:"size"`
+	Created  time.Time `json:"created"`
+
+	used     time.Time
+	verified bool
+}
+
+// Open opens the file for reading. The checksum of files left behind by
+// earlier runs is verified when they are first opened, while the size is
+// checked every time. Files that are missing, expired or corrupt are reported
+// as not existing.
+func (s *Storage) Open(name string) (io.ReadCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	e, ok := s.entries[name]
+	if ok && s.expired(e) {
+		s.remove(name)
+		ok = false
+	}
+	verified := ok && e.verified
+	s.mu.Unlock()
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: path, Err: fs.ErrNotExist}
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := verify(f, e, verified); err != nil {
+		f.Close()
+		s.mu.Lock()
+		// Unless it has been replaced in the meantime.
+		if s.entries[name] == e {
+			s.remove(name)
+		}
+		s.mu.Unlock()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	// The modification time tracks when the file was last used, so that it
+	// survives restarts.
+	now := s.now()
+	s.mu.Lock()
+	e.used = now
+	e.verified = true
+	s.mu.Unlock()
+	if err := os.Chtimes(path, now, now); err != nil {
+		s.log.Error("failed to touch cached file", "err", err)
+	}
+	return f, nil
+}
+
+// Create creates a writer for the file, which is written to a temporary file
+// that only replaces the file once it's closed. Aborting the writer discards
+// everything written.
+func (s *Storage) Create(name string) (io.WriteCloser, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("creating dir: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), tmpPrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	return &writer{
+		storage: s,
+		name:    name,
+		path:    path,
+		file:    f,
+		hash:    sha256.New(),
+	}, nil
+}
+
+// Sub returns a storage of the files in the subdirectory, which share the
+// limits of the storage.
+func (s *Storage) Sub(dir string) *Sub {
+	return &Sub{s, dir}
+}
+
+// Size returns the total size of the stored files.
+func (s *Storage) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.size
+}
+
+// commit adds the written file, and evicts files if needed to stay within the
+// limits.
+func (s *Storage) commit(name string, e *entry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.entries[name]; ok {
+		s.size -= old.Size
+	}
+	s.entries[name] = e
+	s.size += e.Size
+	s.evict()
+}
+
+// evict removes the expired files, followed by the least recently used ones
+// until the total size is within the limit.
+func (s *Storage) evict() {
+	names := make([]string, 0, len(s.entries))
+	for name, e := range s.entries {
+		if s.expired(e) {
+			s.remove(name)
+			continue
+		}
+		names = append(names, name)
+	}
+
+	if s.cfg.MaxBytes <= 0 || s.size <= s.cfg.MaxBytes {
+		return
+	}
+	sort.Slice(names, func(i, j int) bool {
+		return s.entries[names[i]].used.Before(s.entries[names[j]].used)
+	})
+	for _, name := range names {
+		if s.size <= s.cfg.MaxBytes {
+			break
+		}
+		s.remove(name)
+	}
+}
+
+func (s *Storage) expired(e *entry) bool {
+	return s.cfg.MaxAge > 0 && s.now().Sub(e.Created) > s.cfg.MaxAge
+}
+
+// remove deletes the file along with its checksum. Files that are open for
+// reading can still be read until they are closed.
+func (s *Storage) remove(name string) {
+	if e, ok := s.entries[name]; ok {
+		s.size -= e.Size
+		delete(s.entries, name)
+	}
+	path := filepath.Join(s.cfg.Path, filepath.FromSlash(name))
+	for _, p := range []string{path, path + sumExt} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.log.Error("failed to remove cached file", "err", err)
+		}
+	}
+}
+
+// load indexes the files of earlier runs, and removes the temporary files
+// left behind by writes that never finished. Only files with a checksum are
+// considered to be part of the storage, and anything else is left alone.
+func (s *Storage) load() error {
+	return filepath.WalkDir(s.cfg.Path, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Skip what can't be read, as the directory may be shared.
+			if d != nil && d.IsDir() && path != s.cfg.Path {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), tmpPrefix) {
+			os.Remove(path)
+			return nil
+		}
+		if !strings.HasSuffix(path, sumExt) {
+			return nil
+		}
+
+		e, err := readEntry(path)
+		if err != nil {
+			s.log.Error("ignoring invalid checksum file", "path", path, "err", err)
+			return nil
+		}
+		fi, err := os.Stat(strings.TrimSuffix(path, sumExt))
+		if err != nil {
+			// The checksum is written before the file, so the write may have
+			// been interrupted in between.
+			os.Remove(path)
+			return nil
+		}
+		rel, err := filepath.Rel(s.cfg.Path, strings.TrimSuffix(path, sumExt))
+		if err != nil {
+			return err
+		}
+		e.used = fi.ModTime()
+		s.entries[filepath.ToSlash(rel)] = e
+		s.size += e.Size
+		return nil
+	})
+}
+
+// path returns the path of the file, as long as the name is local to the
+// storage.
+func (s *Storage) path(name string) (string, error) {
+	if !filepath.IsLocal(name) || strings.HasSuffix(name, sumExt) || strings.HasPrefix(filepath.Base(name), tmpPrefix) {
+		return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return filepath.Join(s.cfg.Path, filepath.FromSlash(name)), nil
+}
+
+type writer struct {
+	storage *Storage
+	name    string
+	path    string
+	file    *os.File
+	hash    hash.Hash
+	size    int64
+	done    bool
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	n, err := w.file.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	return n, err
+}
+
+// Close commits the file, by writing its checksum and renaming the temporary
+// file into place.
+func (w *writer) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+
+	e := &entry{
+		Checksum: hex.EncodeToString(w.hash.Sum(nil)),
+		Size:     w.size,
+		Created:  w.storage.now(),
+	}
+	e.used = e.Created
+	// The checksum was computed while writing, so there's no need to read
+	// the file back.
+	e.verified = true
+	if err := writeEntry(w.path+sumExt, e); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.path); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+
+	w.storage.commit(w.name, e)
+	return nil
+}
+
+// Abort discards the file, leaving any earlier version in place.
+func (w *writer) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
+
+// Sub is a storage of the files in a subdirectory of another storage.
+type Sub struct {
+	storage *Storage
+	dir     string
+}
+
+func (s *Sub) Open(name string) (io.ReadCloser, error) {
+	return s.storage.Open(s.dir + "/" + name)
+}
+
+func (s *Sub) Create(name string) (io.WriteCloser, error) {
+	return s.storage.Create(s.dir + "/" + name)
+}
+
+// verify checks that the file matches its entry, by its size only if it has
+// been verified before, or by its checksum otherwise.
+func verify(f *os.File, e *entry, verified bool) error {
+	if verified {
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if fi.Size() != e.Size {
+			return ErrCorrupt
+		}
+		return nil
+	}
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if n != e.Size || hex.EncodeToString(h.Sum(nil)) != e.Checksum {
+		return ErrCorrupt
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	return err
+}
+
+func readEntry(path string) (*entry, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var e entry
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// writeEntry writes the checksum file atomically, in the same way as the file
+// itself.
+func writeEntry(path string, e *entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), tmpPrefix+"*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package diskcache
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorage(t *testing.T) {
+	dir := t.TempDir()
+	s, err := New(Config{Path: filepath.Join(dir, "cache")}, slog.Default())
+	if err != nil {
+		t.Fatalf("new storage: %s", err)
+	}
+
+	write(t, s, "upstream/vpc.tar.gz", "vpc")
+	if got := read(t, s, "upstream/vpc.tar.gz"); got != "vpc" {
+		t.Errorf("unexpected content: %q", got)
+	}
+
+	// Aborted writes leave the earlier file in place.
+	w, err := s.Create("upstream/vpc.tar.gz")
+	if err != nil {
+		t.Fatalf("create: %s", err)
+	}
+	io.WriteString(w, "partial")
+	if err := w.(interface{ Abort() error }).Abort(); err != nil {
+		t.Fatalf("abort: %s", err)
+	}
+	if got := read(t, s, "upstream/vpc.tar.gz"); got != "vpc" {
+		t.Errorf("unexpected content after abort: %q", got)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "cache", "upstream", tmpPrefix+"*")); len(matches) > 0 {
+		t.Errorf("unexpected temporary files: %v", matches)
+	}
+
+	// Files that have been truncated are removed, while other corruption is
+	// caught by the checksum once the files are loaded again.
+	write(t, s, "upstream/sg.tar.gz", "sg")
+	path := filepath.Join(dir, "cache", "upstream", "sg.tar.gz")
+	if err := os.WriteFile(path, []byte("s"), 0o644); err != nil {
+		t.Fatalf("truncating file: %s", err)
+	}
+	if _, err := s.Open("upstream/sg.tar.gz"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected a corrupt file, got: %v", err)
+	}
+	if _, err := s.Open("upstream/sg.tar.gz"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the file to be removed, got: %v", err)
+	}
+
+	path = filepath.Join(dir, "cache", "upstream", "vpc.tar.gz")
+	if err := os.WriteFile(path, []byte("vpx"), 0o644); err != nil {
+		t.Fatalf("corrupting file: %s", err)
+	}
+	s, err = New(Config{Path: filepath.Join(dir, "cache")}, slog.Default())
+	if err != nil {
+		t.Fatalf("new storage: %s", err)
+	}
+	if _, err := s.Open("upstream/vpc.tar.gz"); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected a corrupt file, got: %v", err)
+	}
+	if _, err := s.Open("upstream/vpc.tar.gz"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the file to be removed, got: %v", err)
+	}
+
+	if _, err := s.Create("../escape"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected an invalid name, got: %v", err)
+	}
+}
+
+func TestEviction(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	s, err := New(Config{Path: dir, MaxBytes: 10, MaxAge: time.Hour}, slog.Default())
+	if err != nil {
+		t.Fatalf("new storage: %s", err)
+	}
+	s.now = func() time.Time { return now }
+
+	write(t, s, "a", "aaaa")
+	now = now.Add(time.Minute)
+	write(t, s, "b", "bbbb")
+	now = now.Add(time.Minute)
+	read(t, s, "a")
+	now = now.Add(time.Minute)
+	write(t, s, "c", "cccc")
+
+	// The least recently used file is evicted to make room.
+	if _, err := s.Open("b"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected b to be evicted, got: %v", err)
+	}
+	if exp := int64(8); s.Size() != exp {
+		t.Errorf("unexpected size, exp: %d, got: %d", exp, s.Size())
+	}
+
+	// Files expire some time after they were written, regardless of use.
+	now = now.Add(58 * time.Minute)
+	if _, err := s.Open("a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected a to be expired, got: %v", err)
+	}
+	if got := read(t, s, "c"); got != "cccc" {
+		t.Errorf("unexpected content: %q", got)
+	}
+
+	// The files are indexed again on restart, while leftover temporary files
+	// are removed, and anything else left alone.
+	os.WriteFile(filepath.Join(dir, tmpPrefix+"1"), []byte("partial"), 0o644)
+	os.WriteFile(filepath.Join(dir, "unrelated"), []byte("other"), 0o644)
+	s, err = New(Config{Path: dir, MaxBytes: 10}, slog.Default())
+	if err != nil {
+		t.Fatalf("new storage: %s", err)
+	}
+	if got := read(t, s, "c"); got != "cccc" {
+		t.Errorf("unexpected content after restart: %q", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, tmpPrefix+"1")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the temporary file to be removed, got: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "unrelated")); err != nil {
+		t.Errorf("expected the unrelated file to be kept, got: %v", err)
+	}
+}
+
+func write(t *testing.T, s *Storage, name, content string) {
+	t.Helper()
+
+	w, err := s.Create(name)
+	if err != nil {
+		t.Fatalf("create %s: %s", name, err)
+	}
+	if _, err := io.WriteString(w, content); err != nil {
+		t.Fatalf("write %s: %s", name, err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("close %s: %s", name, err)
+	}
+}
+
+func read(t *testing.T, s *Storage, name string) string {
+	t.Helper()
+
+	r, err := s.Open(name)
+	if err != nil {
+		t.Fatalf("open %s: %s", name, err)
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read %s: %s", name, err)
+	}
+	return string(b)
+}
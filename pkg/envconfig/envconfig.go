@@ -222,7 +222,9 @@ func processMap(field reflect.Value, value string) error {
 	if strings.TrimSpace(value) != "" {
 		pairs := strings.Split(value, ";")
 		for _, pair := range pairs {
-			kv := strings.Split(pair, ":")
+			// Only split on the first colon, so that values may contain
+			// colons themselves, e.g. URLs.
+			kv := strings.SplitN(pair, ":", 2)
 			if len(kv) != 2 {
 				return fmt.Errorf("%w: %q", ErrInvalidMapItem, pair)
 			}
@@ -0,0 +1,412 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package git serves modules straight from git repositories, either on disk or
+// mirrored from a remote, using the git command line.
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/archive"
+	"github.com/hedlund/orbit/pkg/backend"
+	"github.com/hedlund/orbit/services/modules"
+)
+
+const (
+	ownerVar = "{owner}"
+	repoVar  = "{repo}"
+)
+
+type Config struct {
+	// Remote is the location of the repositories, with the owner and repo
+	// filled in, e.g. `https://git.example.com/{owner}/{repo}.git` or a path
+	// to bare repositories on disk, like `/srv/git/{owner}/{repo}.git`.
+	// Repositories on disk are used as is, while anything else is mirrored,
+	// which is why the Repositories have to be listed for remotes.
+	Remote string `envconfig:"REMOTE"`
+
+	// MirrorDir is where the mirrors of remote repositories are kept, and
+	// FetchInterval how often they are updated.
+	MirrorDir     string        `envconfig:"MIRROR_DIR" default:"/tmp/orbit-git"`
+	FetchInterval time.Duration `envconfig:"FETCH_INTERVAL" default:"5m"`
+
+	// Token is sent as a bearer token when mirroring over HTTP. Since the
+	// mirrors are shared, the tokens of callers are never used.
+	Token string `envconfig:"TOKEN"`
+
+	// Binary is the git executable.
+	Binary string `envconfig:"BINARY" default:"git"`
+
+	Repositories map[string][]string `envconfig:"REPOSITORIES"`
+	OrgMappings  map[string]string   `envconfig:"ORG_MAPPINGS"`
+
+	// Templates are keyed by `owner/repo` when overridden per repository.
+	backend.Templates
+}
+
+// Validate checks that the remote and the configured templates are usable.
+func (c *Config) Validate() error {
+	if c.Remote == "" {
+		return errors.New("missing remote")
+	}
+	// Otherwise any owner and repo would be cloned to disk, just by asking.
+	if !local(c.Remote) && len(c.Repositories) == 0 {
+		return errors.New("missing repositories, which are required for remotes")
+	}
+	return c.Templates.Validate()
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+func New(cfg Config, log Logger) *Service {
+	if cfg.Binary == "" {
+		cfg.Binary = "git"
+	}
+	return &Service{
+		cfg:     cfg,
+		log:     log,
+		mirrors: make(map[string]*sync.RWMutex),
+		cloning: make(map[string]chan struct{}),
+	}
+}
+
+type Service struct {
+	cfg Config
+	log Logger
+
+	// The mirrors are read locked while in use, and locked while fetched.
+	mu      sync.Mutex
+	mirrors map[string]*sync.RWMutex
+	cloning map[string]chan struct{}
+}
+
+func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
+	owner := s.mapOrg(system)
+	dir, release, err := s.repository(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	out, err := s.git(ctx, dir, "for-each-ref", "--format=%(refname)", "refs/tags/")
+	if err != nil {
+		return nil, err
+	}
+
+	scheme := s.cfg.TagScheme(owner, repo, module)
+	versions := []string{}
+	for _, ref := range strings.Split(string(out), "\n") {
+		tag, ok := strings.CutPrefix(ref, "refs/tags/")
+		if !ok {
+			continue
+		}
+		if version, ok := scheme.Version(tag); ok {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
+	owner := s.mapOrg(system)
+	dir, release, err := s.repository(ctx, owner, repo)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	path, err := s.cfg.ModulePath(owner, repo, module)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the commit first, so that a missing tag is reported before
+	// anything has been written.
+	sha, _, err := s.commit(ctx, dir, s.cfg.TagScheme(owner, repo, module).Tag(version))
+	if err != nil {
+		return err
+	}
+	args := []string{"archive", "--format=tar", "--prefix=" + repo + "/", sha}
+	if path != "" {
+		if _, err := s.git(ctx, dir, "cat-file", "-e", sha+":"+path); err != nil {
+			return &backend.Error{
+				Code: http.StatusNotFound,
+				Msg:  fmt.Sprintf("module directory not found: %s", path),
+			}
+		}
+		args = append(args, "--", path)
+	}
+
+	cmd := s.command(ctx, dir, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("git archive: %w", err)
+	}
+
+	aw, err := archive.NewWriter(archive.Default, w)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	if err := archive.CopyDir(aw, tar.NewReader(stdout), path); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git archive: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return aw.Close()
+}
+
+func (s *Service) DescribeVersion(ctx context.Context, system, repo, module, version string) (*modules.VersionDetails, error) {
+	owner := s.mapOrg(system)
+	dir, release, err := s.repository(ctx, owner, repo)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	sha, date, err := s.commit(ctx, dir, s.cfg.TagScheme(owner, repo, module).Tag(version))
+	if err != nil {
+		return nil, err
+	}
+	return &modules.VersionDetails{
+		Commit:      sha,
+		PublishedAt: date,
+	}, nil
+}
+
+// commit resolves the tag to the commit it points to, along with the commit
+// date.
+func (s *Service) commit(ctx context.Context, dir, tag string) (string, time.Time, error) {
+	out, err := s.git(ctx, dir, "show", "--no-patch", "--format=%H %cI", "refs/tags/"+tag+"^{commit}", "--")
+	if err != nil {
+		return "", time.Time{}, &backend.Error{
+			Code: http.StatusNotFound,
+			Msg:  fmt.Sprintf("tag not found: %s", tag),
+		}
+	}
+
+	sha, date, _ := strings.Cut(strings.TrimSpace(string(out)), " ")
+	t, err := time.Parse(time.RFC3339, date)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("parsing commit date: %w", err)
+	}
+	return sha, t, nil
+}
+
+// repository returns the directory of the repository, mirroring it first if
+// it's remote and hasn't been mirrored before. Mirrors are kept from being
+// fetched until the returned release function is called.
+func (s *Service) repository(ctx context.Context, owner, repo string) (string, func(), error) {
+	if err := s.validRepo(owner, repo); err != nil {
+		return "", nil, err
+	}
+	for _, name := range []string{owner, repo} {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			return "", nil, &backend.Error{
+				Code: http.StatusBadRequest,
+				Msg:  "invalid repository",
+			}
+		}
+	}
+
+	remote := strings.NewReplacer(ownerVar, owner, repoVar, repo).Replace(s.cfg.Remote)
+	if local(remote) {
+		if _, err := os.Stat(remote); err != nil {
+			return "", nil, &backend.Error{
+				Code: http.StatusNotFound,
+				Msg:  "repository not found",
+			}
+		}
+		return remote, func() {}, nil
+	}
+
+	dir := filepath.Join(s.cfg.MirrorDir, owner, repo+".git")
+	unlock, err := s.lock(ctx, dir)
+	if err != nil {
+		return "", nil, err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(dir); err == nil {
+		return dir, s.mirror(dir), nil
+	}
+
+	s.log.Info("mirroring repository", "remote", remote, "dir", dir)
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return "", nil, fmt.Errorf("creating mirror dir: %w", err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+	if _, err := s.git(ctx, "", "clone", "--mirror", "--quiet", "--", remote, tmp); err != nil {
+		os.RemoveAll(tmp)
+		// The output of git may contain the remote, so it's only logged.
+		s.log.Error("mirroring repository", "remote", remote, "err", err)
+		return "", nil, &backend.Error{
+			Code: http.StatusNotFound,
+			Msg:  "repository not found",
+		}
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return "", nil, fmt.Errorf("moving mirror into place: %w", err)
+	}
+	return dir, s.mirror(dir), nil
+}
+
+// lock makes sure that the repository is only mirrored once at a time, by
+// waiting for any clone in progress to finish first.
+func (s *Service) lock(ctx context.Context, dir string) (func(), error) {
+	for {
+		s.mu.Lock()
+		ch, busy := s.cloning[dir]
+		if !busy {
+			ch = make(chan struct{})
+			s.cloning[dir] = ch
+			s.mu.Unlock()
+			return func() {
+				s.mu.Lock()
+				delete(s.cloning, dir)
+				s.mu.Unlock()
+				close(ch)
+			}, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// mirror keeps track of the mirror for the fetches, once it's in place, and
+// read locks it until the returned function is called.
+func (s *Service) mirror(dir string) func() {
+	s.mu.Lock()
+	lock, ok := s.mirrors[dir]
+	if !ok {
+		lock = &sync.RWMutex{}
+		s.mirrors[dir] = lock
+	}
+	s.mu.Unlock()
+
+	lock.RLock()
+	return lock.RUnlock
+}
+
+// Run keeps the mirrors up to date, by fetching them at the configured
+// interval until the context is cancelled.
+func (s *Service) Run(ctx context.Context) {
+	if s.cfg.FetchInterval <= 0 {
+		return
+	}
+
+	t := time.NewTicker(s.cfg.FetchInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			s.Fetch(ctx)
+		}
+	}
+}
+
+// Fetch updates all the mirrors, logging any failures.
+func (s *Service) Fetch(ctx context.Context) {
+	s.mu.Lock()
+	mirrors := make(map[string]*sync.RWMutex, len(s.mirrors))
+	for dir, lock := range s.mirrors {
+		mirrors[dir] = lock
+	}
+	s.mu.Unlock()
+
+	for dir, lock := range mirrors {
+		lock.Lock()
+		if _, err := os.Stat(dir); err == nil {
+			if _, err := s.git(ctx, dir, "fetch", "--prune", "--quiet"); err != nil {
+				s.log.Error("fetching mirror", "dir", dir, "err", err)
+			}
+		}
+		lock.Unlock()
+	}
+}
+
+func (s *Service) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := s.command(ctx, dir, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (s *Service) command(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.CommandContext(ctx, s.cfg.Binary, args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	if s.cfg.Token != "" {
+		// Passed through the environment rather than the arguments, so that
+		// the token doesn't show up in the process list.
+		cmd.Env = append(cmd.Env,
+			"GIT_CONFIG_COUNT=1",
+			"GIT_CONFIG_KEY_0=http.extraHeader",
+			"GIT_CONFIG_VALUE_0=Authorization: Bearer "+s.cfg.Token,
+		)
+	}
+	return cmd
+}
+
+func (s *Service) mapOrg(system string) string {
+	return backend.MapOwner(s.cfg.OrgMappings, system)
+}
+
+func (s *Service) validRepo(owner, repo string) error {
+	return backend.Allowed(s.cfg.Repositories, owner, repo)
+}
+
+// local checks if the remote is a path on disk, rather than a URL or an scp
+// like address such as `git@example.com:owner/repo.git`.
+func local(remote string) bool {
+	if strings.Contains(remote, "://") {
+		return false
+	}
+	colon := strings.Index(remote, ":")
+	return colon < 0 || strings.Contains(remote[:colon], "/")
+}
@@ -0,0 +1,273 @@
+package git
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/backend"
+	"github.com/hedlund/orbit/services/modules"
+)
+
+func TestLocalRepository(t *testing.T) {
+	root := t.TempDir()
+	work := newRepo(t, filepath.Join(root, "acme", "infra.git"))
+
+	s := New(Config{
+		Remote:    filepath.Join(root, "{owner}", "{repo}.git"),
+		Templates: backend.Templates{PathTemplate: "modules/{module}"},
+	}, slog.Default())
+
+	versions, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+	if got, exp := listArchive(t, &buf), []string{"main.tf: # vpc"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected archive, exp: %q, got: %q", exp, got)
+	}
+
+	details, err := s.DescribeVersion(context.Background(), "acme", "infra", "vpc", "1.0.0")
+	if err != nil {
+		t.Fatalf("describe version: %s", err)
+	}
+	if sha := run(t, work, "rev-parse", "HEAD"); details.Commit != sha {
+		t.Errorf("unexpected commit, exp: %s, got: %s", sha, details.Commit)
+	}
+
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "9.9.9", io.Discard); err == nil {
+		t.Errorf("expected an error for a missing tag")
+	}
+	if _, err := s.ListVersions(context.Background(), "acme", "other", "vpc"); err == nil {
+		t.Errorf("expected an error for a missing repository")
+	}
+}
+
+func TestMirror(t *testing.T) {
+	root := t.TempDir()
+	work := newRepo(t, filepath.Join(root, "acme", "infra.git"))
+
+	s := New(Config{
+		Remote:       "file://" + filepath.Join(root, "{owner}", "{repo}.git"),
+		MirrorDir:    filepath.Join(root, "mirrors"),
+		Repositories: map[string][]string{"acme": {"infra"}},
+		Templates:    backend.Templates{PathTemplate: "modules/{module}"},
+	}, slog.Default())
+
+	versions, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+
+	// New tags show up once the mirror has been fetched, which waits for
+	// the mirror to no longer be in use.
+	run(t, work, "tag", "vpc/1.1.0")
+	run(t, work, "push", "--quiet", "origin", "vpc/1.1.0")
+
+	_, release, err := s.repository(context.Background(), "acme", "infra")
+	if err != nil {
+		t.Fatalf("repository: %s", err)
+	}
+	fetched := make(chan struct{})
+	go func() {
+		s.Fetch(context.Background())
+		close(fetched)
+	}()
+	select {
+	case <-fetched:
+		t.Fatalf("expected the fetch to wait for the mirror to be released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	release()
+	<-fetched
+
+	versions, err = s.ListVersions(context.Background(), "acme", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0", "1.1.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+}
+
+func TestMirrorFailure(t *testing.T) {
+	root := t.TempDir()
+	newRepo(t, filepath.Join(root, "acme", "infra.git"))
+
+	remote := "file://" + filepath.Join(root, "{owner}", "{repo}.git")
+	s := New(Config{
+		Remote:       remote,
+		MirrorDir:    filepath.Join(root, "mirrors"),
+		Repositories: map[string][]string{"acme": {"infra", "missing"}},
+	}, slog.Default())
+
+	_, err := s.ListVersions(context.Background(), "acme", "missing", "vpc")
+	if e, ok := err.(*backend.Error); !ok || e.StatusCode() != http.StatusNotFound {
+		t.Fatalf("expected a not found error, got: %v", err)
+	}
+	if strings.Contains(err.Error(), root) {
+		t.Errorf("expected the remote not to be disclosed, got: %s", err)
+	}
+	if len(s.mirrors) != 0 {
+		t.Errorf("expected no mirrors to be kept, got: %v", s.mirrors)
+	}
+
+	if _, err := s.ListVersions(context.Background(), "acme", "infra", "vpc"); err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if len(s.mirrors) != 1 {
+		t.Errorf("expected the mirror to be kept, got: %v", s.mirrors)
+	}
+
+	// Only listed repositories are mirrored.
+	if _, err := s.ListVersions(context.Background(), "acme", "other", "vpc"); err == nil {
+		t.Errorf("expected an unlisted repository to be refused")
+	}
+	if len(s.mirrors) != 1 {
+		t.Errorf("expected no other mirrors, got: %v", s.mirrors)
+	}
+
+	cfg := Config{Remote: remote}
+	if err := cfg.Validate(); err == nil {
+		t.Errorf("expected a remote without repositories to be invalid")
+	}
+	cfg.Repositories = map[string][]string{"acme": {"infra"}}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("validate: %s", err)
+	}
+	cfg = Config{Remote: filepath.Join(root, "{owner}", "{repo}.git")}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("expected repositories on disk not to require a list: %s", err)
+	}
+}
+
+func TestFallbackAllowlist(t *testing.T) {
+	s := New(Config{
+		Remote:       filepath.Join(t.TempDir(), "{owner}", "{repo}.git"),
+		Repositories: map[string][]string{"acme": {"infra"}},
+	}, slog.Default())
+	f, err := modules.NewFallback(s, upstream{"2.0.0"}, "community")
+	if err != nil {
+		t.Fatalf("new fallback: %s", err)
+	}
+
+	// Repositories that aren't allowed are looked up upstream, as long as
+	// their namespace is forwarded.
+	versions, err := f.ListVersions(context.Background(), "acme", "community", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"2.0.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+
+	_, err = f.ListVersions(context.Background(), "acme", "other", "vpc")
+	if e, ok := err.(*backend.Error); !ok || e.StatusCode() != http.StatusForbidden {
+		t.Errorf("expected the repository to be refused, got: %v", err)
+	}
+}
+
+type upstream []string
+
+func (u upstream) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	return u, nil
+}
+
+func (u upstream) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	return nil
+}
+
+// newRepo creates a bare repository with a tagged module, and returns the
+// working copy it was pushed from.
+func newRepo(t *testing.T, bare string) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+
+	work := t.TempDir()
+	run(t, "", "init", "--quiet", "--bare", bare)
+	run(t, work, "init", "--quiet")
+	for name, content := range map[string]string{
+		"README.md":           "# infra",
+		"modules/vpc/main.tf": "# vpc",
+		"modules/sg/main.tf":  "# sg",
+	} {
+		p := filepath.Join(work, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(p), 0o755)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatalf("writing %s: %s", name, err)
+		}
+	}
+	run(t, work, "add", ".")
+	run(t, work, "commit", "--quiet", "-m", "initial")
+	run(t, work, "tag", "-a", "-m", "vpc", "vpc/1.0.0")
+	run(t, work, "tag", "sg/2.0.0")
+	run(t, work, "remote", "add", "origin", bare)
+	run(t, work, "push", "--quiet", "--tags", "origin", "HEAD:refs/heads/main")
+	return work
+}
+
+func run(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+
+	if dir != "" {
+		args = append([]string{"-C", dir}, args...)
+	}
+	cmd := exec.Command("git", args...)
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com",
+		"GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %s: %s", args, err, out)
+	}
+	return string(bytes.TrimSpace(out))
+}
+
+func listArchive(t *testing.T, r io.Reader) []string {
+	t.Helper()
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("read gzip: %s", err)
+	}
+	tr := tar.NewReader(zr)
+
+	var entries []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("read tar: %s", err)
+		}
+		b, _ := io.ReadAll(tr)
+		entries = append(entries, hdr.Name+": "+string(b))
+	}
+}
@@ -0,0 +1,247 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package gitea serves modules from Gitea, or any of its forks such as
+// Forgejo, which share the same API.
+package gitea
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/archive"
+	"github.com/hedlund/orbit/pkg/auth"
+	"github.com/hedlund/orbit/pkg/backend"
+	"github.com/hedlund/orbit/services/modules"
+)
+
+const (
+	tagsPerPage = 50
+)
+
+type Config struct {
+	// BaseURL of the API, usually `https://<hostname>/api/v1/`.
+	BaseURL string `envconfig:"BASE_URL"`
+
+	Repositories map[string][]string `envconfig:"REPOSITORIES"`
+	OrgMappings  map[string]string   `envconfig:"ORG_MAPPINGS"`
+	Token        string              `envconfig:"TOKEN"`
+
+	// Templates are keyed by `owner/repo` when overridden per repository.
+	backend.Templates
+}
+
+// Validate checks that the base URL and the configured templates are usable.
+func (c *Config) Validate() error {
+	if c.BaseURL == "" {
+		return errors.New("missing base URL")
+	}
+	if err := backend.ValidBaseURL(c.BaseURL); err != nil {
+		return err
+	}
+	return c.Templates.Validate()
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+func New(cfg Config, c HTTPClient, log Logger) *Service {
+	return &Service{
+		cfg:    cfg,
+		client: c,
+		log:    log,
+	}
+}
+
+type Service struct {
+	cfg    Config
+	client HTTPClient
+	log    Logger
+}
+
+// https://try.gitea.io/api/swagger#/repository/repoListTags
+func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
+	owner := s.mapOrg(system)
+	if err := s.validRepo(owner, repo); err != nil {
+		return nil, err
+	}
+
+	var (
+		page     = 1
+		scheme   = s.cfg.TagScheme(owner, repo, module)
+		versions = []string{}
+	)
+	for {
+		uri := fmt.Sprintf("repos/%s/%s/tags?limit=%d&page=%d", owner, repo, tagsPerPage, page)
+		res, err := s.makeRequest(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		var tags []struct {
+			Name string `json:"name"`
+		}
+		err = json.NewDecoder(res).Decode(&tags)
+		res.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+
+		for _, tag := range tags {
+			if version, ok := scheme.Version(tag.Name); ok {
+				versions = append(versions, version)
+			}
+		}
+
+		if len(tags) < tagsPerPage {
+			break
+		}
+		page++
+	}
+	return versions, nil
+}
+
+// https://try.gitea.io/api/swagger#/repository/repoGetArchive
+func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
+	owner := s.mapOrg(system)
+	if err := s.validRepo(owner, repo); err != nil {
+		return err
+	}
+
+	dir, err := s.cfg.ModulePath(owner, repo, module)
+	if err != nil {
+		return err
+	}
+
+	tag := s.cfg.TagScheme(owner, repo, module).Tag(version)
+	uri := fmt.Sprintf("repos/%s/%s/archive/%s.tar.gz", owner, repo, escapeRef(tag))
+	body, err := s.makeRequest(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("read gzip: %w", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	aw, err := archive.NewWriter(archive.Default, w)
+	if err != nil {
+		return err
+	}
+
+	if err := archive.CopyDir(aw, tr, dir); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// https://try.gitea.io/api/swagger#/repository/repoGetTag
+func (s *Service) DescribeVersion(ctx context.Context, system, repo, module, version string) (*modules.VersionDetails, error) {
+	owner := s.mapOrg(system)
+	if err := s.validRepo(owner, repo); err != nil {
+		return nil, err
+	}
+
+	tag := s.cfg.TagScheme(owner, repo, module).Tag(version)
+	uri := fmt.Sprintf("repos/%s/%s/tags/%s", owner, repo, escapeRef(tag))
+	res, err := s.makeRequest(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var t struct {
+		Commit struct {
+			SHA     string    `json:"sha"`
+			Created time.Time `json:"created"`
+		} `json:"commit"`
+	}
+	if err := json.NewDecoder(res).Decode(&t); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return &modules.VersionDetails{
+		Commit:      t.Commit.SHA,
+		PublishedAt: t.Commit.Created,
+	}, nil
+}
+
+// CheckAccess checks that the caller can read the repository.
+func (s *Service) CheckAccess(ctx context.Context, system, repo string) error {
+	owner := s.mapOrg(system)
+	if err := s.validRepo(owner, repo); err != nil {
+		return err
+	}
+
+	res, err := s.makeRequest(ctx, fmt.Sprintf("repos/%s/%s", owner, repo))
+	if err != nil {
+		return err
+	}
+	return res.Close()
+}
+
+func (s *Service) makeRequest(ctx context.Context, uri string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(uri), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	req.Header.Add("Accept", "application/json")
+	if token := auth.GetToken(ctx, s.cfg.Token); token != "" {
+		req.Header.Add("Authorization", "token "+token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, backend.ResponseError(res)
+	}
+
+	return res.Body, nil
+}
+
+// url returns the full URL of the API endpoint, relative to the base URL.
+func (s *Service) url(uri string) string {
+	return backend.JoinURL(s.cfg.BaseURL, uri)
+}
+
+func (s *Service) mapOrg(system string) string {
+	return backend.MapOwner(s.cfg.OrgMappings, system)
+}
+
+func (s *Service) validRepo(owner, repo string) error {
+	return backend.Allowed(s.cfg.Repositories, owner, repo)
+}
+
+// escapeRef escapes each segment of a git ref for use in a URL path, keeping
+// the slashes intact.
+func escapeRef(ref string) string {
+	segments := strings.Split(ref, "/")
+	for n, s := range segments {
+		segments[n] = url.PathEscape(s)
+	}
+	return strings.Join(segments, "/")
+}
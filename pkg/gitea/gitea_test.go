@@ -0,0 +1,103 @@
+package gitea
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hedlund/orbit/pkg/backend"
+
+	"github.com/hedlund/orbit/pkg/auth"
+)
+
+func TestListVersions(t *testing.T) {
+	srv := fakeGitea(t)
+	s := New(Config{
+		BaseURL:     srv.URL + "/api/v1/",
+		OrgMappings: map[string]string{"acme": "platform"},
+	}, srv.Client(), slog.Default())
+
+	// The token of the caller is passed through.
+	ctx := auth.WithToken(context.Background(), "caller")
+	versions, err := s.ListVersions(ctx, "acme", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+
+	if _, err := s.ListVersions(context.Background(), "acme", "infra", "vpc"); err == nil {
+		t.Errorf("expected an error without a token")
+	}
+}
+
+func TestProxyDownload(t *testing.T) {
+	srv := fakeGitea(t)
+	s := New(Config{
+		BaseURL:     srv.URL + "/api/v1",
+		Token:       "caller",
+		OrgMappings: map[string]string{"acme": "platform"},
+		Templates:   backend.Templates{PathTemplate: "modules/{module}"},
+	}, srv.Client(), slog.Default())
+
+	var buf bytes.Buffer
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("read gzip: %s", err)
+	}
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("read tar: %s", err)
+	}
+	b, _ := io.ReadAll(tr)
+	if hdr.Name != "main.tf" || string(b) != "# vpc" {
+		t.Errorf("unexpected entry %s: %q", hdr.Name, b)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected a single entry: %v", err)
+	}
+}
+
+// fakeGitea serves the tags and archives of the `platform/infra` repository,
+// as long as the request carries the right token.
+func fakeGitea(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/repos/platform/infra/tags", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[{"name":"vpc/1.0.0"},{"name":"sg/2.0.0"}]`))
+	})
+	mux.HandleFunc("GET /api/v1/repos/platform/infra/archive/vpc/1.0.0.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		zw := gzip.NewWriter(w)
+		tw := tar.NewWriter(zw)
+		tw.WriteHeader(&tar.Header{Name: "infra/", Typeflag: tar.TypeDir, Mode: 0o755})
+		tw.WriteHeader(&tar.Header{Name: "infra/README.md", Mode: 0o644})
+		tw.WriteHeader(&tar.Header{Name: "infra/modules/vpc/main.tf", Mode: 0o644, Size: 5})
+		tw.Write([]byte("# vpc"))
+		tw.Close()
+		zw.Close()
+	})
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token caller" {
+			http.NotFound(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
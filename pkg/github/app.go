@@ -0,0 +1,262 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// jwtLifetime is kept below the maximum of 10 minutes allowed by GitHub,
+	// and the JWT is backdated to allow for clock drift.
+	jwtLifetime = 9 * time.Minute
+	jwtBackdate = 60 * time.Second
+
+	// tokenMargin is how long before the expiry an installation token is
+	// considered stale, and a new one minted.
+	tokenMargin = 5 * time.Minute
+)
+
+var (
+	errInvalidPrivateKey = errors.New("invalid private key")
+)
+
+type AppConfig struct {
+	ID             int64            `envconfig:"APP_ID"`
+	PrivateKey     string           `envconfig:"APP_PRIVATE_KEY"`
+	PrivateKeyFile string           `envconfig:"APP_PRIVATE_KEY_FILE"`
+	Installations  map[string]int64 `envconfig:"APP_INSTALLATIONS"`
+}
+
+func (c *AppConfig) enabled() bool {
+	return c.ID != 0
+}
+
+// newApp creates a token source that authenticates as a GitHub App, and mints
+// installation tokens for the owners as they are needed.
+func newApp(cfg AppConfig, s *Service) (*app, error) {
+	b := []byte(cfg.PrivateKey)
+	if cfg.PrivateKeyFile != "" {
+		var err error
+		if b, err = os.ReadFile(cfg.PrivateKeyFile); err != nil {
+			return nil, fmt.Errorf("reading private key: %w", err)
+		}
+	}
+
+	key, err := parsePrivateKey(b)
+	if err != nil {
+		return nil, err
+	}
+
+	installations := make(map[string]int64, len(cfg.Installations))
+	for owner, id := range cfg.Installations {
+		installations[owner] = id
+	}
+
+	return &app{
+		id:            cfg.ID,
+		key:           key,
+		s:             s,
+		installations: installations,
+		tokens:        make(map[int64]installationToken),
+		minting:       make(map[int64]chan struct{}),
+		now:           time.Now,
+	}, nil
+}
+
+type app struct {
+	id            int64
+	key           *rsa.PrivateKey
+	s             *Service
+	mu            sync.Mutex
+	installations map[string]int64
+	tokens        map[int64]installationToken
+	minting       map[int64]chan struct{}
+	now           func() time.Time
+}
+
+type installationToken struct {
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// token returns an installation token for the owner, minting a new one if
+// there's no cached token, or it's about to expire. The lock is only held while
+// accessing the maps, and concurrent requests for the same installation wait
+// for a single token to be minted.
+func (a *app) token(ctx context.Context, owner, repo string) (string, error) {
+	id, err := a.installation(ctx, owner, repo)
+	if err != nil {
+		return "", err
+	}
+
+	for {
+		a.mu.Lock()
+		if t, ok := a.tokens[id]; ok && a.now().Add(tokenMargin).Before(t.ExpiresAt) {
+			a.mu.Unlock()
+			return t.Token, nil
+		}
+		ch, busy := a.minting[id]
+		if !busy {
+			ch = make(chan struct{})
+			a.minting[id] = ch
+			a.mu.Unlock()
+
+			t, err := a.mint(ctx, id)
+			a.mu.Lock()
+			if err == nil {
+				a.tokens[id] = t
+			}
+			delete(a.minting, id)
+			a.mu.Unlock()
+			close(ch)
+
+			if err != nil {
+				return "", err
+			}
+			return t.Token, nil
+		}
+		a.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+}
+
+// https://docs.github.com/en/rest/apps/apps?apiVersion=2022-11-28#create-an-installation-access-token-for-an-app
+func (a *app) mint(ctx context.Context, id int64) (installationToken, error) {
+	var t installationToken
+	uri := fmt.Sprintf("app/installations/%d/access_tokens", id)
+	if err := a.request(ctx, http.MethodPost, uri, &t); err != nil {
+		return t, fmt.Errorf("minting installation token: %w", err)
+	}
+	return t, nil
+}
+
+// installation looks up the installation of the app for the owner, unless it
+// has been configured, or already looked up.
+//
+// https://docs.github.com/en/rest/apps/apps?apiVersion=2022-11-28#get-a-repository-installation-for-the-authenticated-app
+func (a *app) installation(ctx context.Context, owner, repo string) (int64, error) {
+	a.mu.Lock()
+	id, ok := a.installations[owner]
+	a.mu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	var inst struct {
+		ID int64 `json:"id"`
+	}
+	uri := fmt.Sprintf("repos/%s/%s/installation", owner, repo)
+	if err := a.request(ctx, http.MethodGet, uri, &inst); err != nil {
+		return 0, fmt.Errorf("finding installation: %w", err)
+	}
+
+	a.mu.Lock()
+	a.installations[owner] = inst.ID
+	a.mu.Unlock()
+	return inst.ID, nil
+}
+
+// request makes a request authenticated as the app itself, as opposed to an
+// installation, and decodes the JSON response.
+func (a *app) request(ctx context.Context, method, uri string, v any) error {
+	jwt, err := a.jwt()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, a.s.url(uri), nil)
+	if err != nil {
+		return fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Add("Accept", contentType)
+	req.Header.Add("X-GitHub-Api-Version", apiVersion)
+	req.Header.Add("Authorization", "Bearer "+jwt)
+
+	res, err := a.s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("executing request: %w", err)
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusCreated {
+		return &httpErr{
+			code: res.StatusCode,
+			msg:  slurp(res.Body),
+		}
+	}
+	defer res.Body.Close()
+
+	if err := json.NewDecoder(res.Body).Decode(v); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
+
+// jwt creates a JSON Web Token signed with the private key of the app.
+//
+// https://docs.github.com/en/apps/creating-github-apps/authenticating-with-a-github-app/generating-a-json-web-token-jwt-for-a-github-app
+func (a *app) jwt() (string, error) {
+	now := a.now()
+	header, _ := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+	})
+	claims, _ := json.Marshal(map[string]any{
+		"iat": now.Add(-jwtBackdate).Unix(),
+		"exp": now.Add(jwtLifetime).Unix(),
+		"iss": strconv.FormatInt(a.id, 10),
+	})
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("signing jwt: %w", err)
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// parsePrivateKey parses a PEM encoded RSA key, in either PKCS #1 (which is
+// what GitHub hands out) or PKCS #8 form.
+func parsePrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(strings.TrimSpace(string(b))))
+	if block == nil {
+		return nil, fmt.Errorf("%w: no PEM data found", errInvalidPrivateKey)
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errInvalidPrivateKey, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%w: not an RSA key", errInvalidPrivateKey)
+	}
+	return rsaKey, nil
+}
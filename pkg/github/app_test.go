@@ -0,0 +1,157 @@
+package github
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAppInstallationToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	var minted atomic.Int32
+	expires := time.Now().Add(time.Hour)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repos/acme/infra/installation", func(w http.ResponseWriter, r *http.Request) {
+		verifyJWT(t, r, &key.PublicKey)
+		w.Write([]byte(`{"id":42}`))
+	})
+	mux.HandleFunc("POST /app/installations/42/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		verifyJWT(t, r, &key.PublicKey)
+		n := minted.Add(1)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"ghs_%d","expires_at":%q}`, n, expires.Format(time.RFC3339))
+	})
+	mux.HandleFunc("GET /repos/acme/infra/tags", func(w http.ResponseWriter, r *http.Request) {
+		exp := fmt.Sprintf("Bearer ghs_%d", minted.Load())
+		if got := r.Header.Get("Authorization"); got != exp {
+			t.Errorf("unexpected authorization, exp: %s, got: %s", exp, got)
+		}
+		w.Write([]byte(`[{"name":"vpc/1.0.0"}]`))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := Config{
+		BaseURL: srv.URL,
+		App: AppConfig{
+			ID:         1234,
+			PrivateKey: string(pemKey),
+		},
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("validate: %s", err)
+	}
+	s := New(cfg, srv.Client(), slog.Default())
+
+	for n := 0; n < 3; n++ {
+		if _, err := s.ListVersions(context.Background(), "acme", "infra", "vpc"); err != nil {
+			t.Fatalf("list versions: %s", err)
+		}
+	}
+	if n := minted.Load(); n != 1 {
+		t.Errorf("unexpected number of minted tokens, exp: 1, got: %d", n)
+	}
+
+	// Once the token is about to expire, a new one should be minted.
+	now := expires.Add(-time.Minute)
+	s.app.now = func() time.Time { return now }
+	expires = expires.Add(time.Hour)
+	s.ListVersions(context.Background(), "acme", "infra", "vpc")
+	if n := minted.Load(); n != 2 {
+		t.Errorf("unexpected number of minted tokens, exp: 2, got: %d", n)
+	}
+}
+
+func TestAppConcurrentMints(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	pemKey := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	})
+
+	var minted atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /app/installations/{id}/access_tokens", func(w http.ResponseWriter, r *http.Request) {
+		minted.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"ghs_%s","expires_at":%q}`, r.PathValue("id"), time.Now().Add(time.Hour).Format(time.RFC3339))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := Config{
+		BaseURL: srv.URL,
+		App: AppConfig{
+			ID:            1234,
+			PrivateKey:    string(pemKey),
+			Installations: map[string]int64{"acme": 1, "corp": 2},
+		},
+	}
+	s := New(cfg, srv.Client(), slog.Default())
+
+	var wg sync.WaitGroup
+	for n := 0; n < 10; n++ {
+		for _, owner := range []string{"acme", "corp"} {
+			wg.Add(1)
+			go func(owner string) {
+				defer wg.Done()
+				if _, err := s.app.token(context.Background(), owner, "infra"); err != nil {
+					t.Errorf("token: %s", err)
+				}
+			}(owner)
+		}
+	}
+	wg.Wait()
+
+	// One token is minted per installation, no matter the number of callers.
+	if n := minted.Load(); n != 2 {
+		t.Errorf("unexpected number of minted tokens, exp: 2, got: %d", n)
+	}
+}
+
+func verifyJWT(t *testing.T, r *http.Request, pub *rsa.PublicKey) {
+	t.Helper()
+
+	jwt := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	parts := strings.Split(jwt, ".")
+	if len(parts) != 3 {
+		t.Errorf("malformed jwt: %s", jwt)
+		return
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Errorf("decoding signature: %s", err)
+		return
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		t.Errorf("invalid jwt signature: %s", err)
+	}
+}
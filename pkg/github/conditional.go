@@ -0,0 +1,103 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"sync"
+	"time"
+)
+
+func newConditionalCache(size int) *conditionalCache {
+	return &conditionalCache{
+		size:    size,
+		entries: make(map[string]*conditionalEntry),
+	}
+}
+
+// conditionalCache keeps the responses of API requests along with their ETag,
+// so that the same request can be made conditionally. A 304 Not Modified
+// response does not count towards the rate limit, and the stored response is
+// used instead. When full, the least recently used response is evicted.
+type conditionalCache struct {
+	size    int
+	mu      sync.Mutex
+	entries map[string]*conditionalEntry
+	tick    uint64
+}
+
+type conditionalEntry struct {
+	etag   string
+	body   []byte
+	used   uint64
+	stored time.Time
+}
+
+// conditionalKey returns the key of the response to the request, made with
+// the token of the fingerprint.
+func conditionalKey(fp, uri string) string {
+	return fp + " " + uri
+}
+
+func (c *conditionalCache) get(key string) (etag string, body []byte, ok bool) {
+	if c.size <= 0 {
+		return "", nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return "", nil, false
+	}
+	c.tick++
+	e.used = c.tick
+	return e.etag, e.body, true
+}
+
+// recent returns the stored response, without its ETag, as long as it was
+// stored within the max age. It is meant for responses that can be trusted for
+// a while, without even asking conditionally.
+func (c *conditionalCache) recent(key string, maxAge time.Duration) ([]byte, bool) {
+	if c.size <= 0 || maxAge <= 0 {
+		return nil, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok || time.Since(e.stored) > maxAge {
+		return nil, false
+	}
+	c.tick++
+	e.used = c.tick
+	return e.body, true
+}
+
+func (c *conditionalCache) set(key, etag string, body []byte) {
+	if c.size <= 0 || etag == "" {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.entries[key]; !ok && len(c.entries) >= c.size {
+		var (
+			oldest string
+			used   uint64
+		)
+		for k, e := range c.entries {
+			if oldest == "" || e.used < used {
+				oldest, used = k, e.used
+			}
+		}
+		delete(c.entries, oldest)
+	}
+
+	c.tick++
+	c.entries[key] = &conditionalEntry{etag, body, c.tick, time.Now()}
+}
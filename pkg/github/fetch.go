@@ -0,0 +1,401 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/archive"
+)
+
+const (
+	FetchAuto    = "auto"
+	FetchTarball = "tarball"
+	FetchSparse  = "sparse"
+
+	rawContentType = "application/vnd.github.raw+json"
+)
+
+type FetchConfig struct {
+	// Strategy is how the contents of modules are downloaded: `tarball`
+	// downloads the archive of the whole repository, while `sparse` downloads
+	// the files of the module one by one, through the git database API. With
+	// `auto`, large repositories are fetched sparsely, unless the module has
+	// too many files.
+	Strategy string `envconfig:"FETCH_STRATEGY" default:"auto"`
+
+	// MinRepoSize is the size, in kilobytes as reported by GitHub, from which
+	// repositories are considered for sparse fetches.
+	MinRepoSize int `envconfig:"FETCH_MIN_REPO_SIZE" default:"20480"`
+
+	// MaxFiles is the number of files in a module above which the tarball is
+	// downloaded anyway, since each file is a request of its own.
+	MaxFiles int `envconfig:"FETCH_MAX_FILES" default:"100"`
+
+	// Concurrency is the number of files downloaded at the same time when
+	// fetching sparsely.
+	Concurrency int `envconfig:"FETCH_CONCURRENCY" default:"8"`
+
+	// SizeTTL is how long the size of a repository, as kept along with the
+	// conditional responses, is trusted before it is looked up again. It
+	// rarely changes enough to matter.
+	SizeTTL time.Duration `envconfig:"FETCH_SIZE_TTL" default:"1h"`
+}
+
+func (c *FetchConfig) validate() error {
+	switch c.Strategy {
+	case "", FetchAuto, FetchTarball, FetchSparse:
+		return nil
+	default:
+		return fmt.Errorf("invalid fetch strategy: %q", c.Strategy)
+	}
+}
+
+type commit struct {
+	SHA    string `json:"sha"`
+	Commit struct {
+		Committer struct {
+			Date time.Time `json:"date"`
+		} `json:"committer"`
+		Tree struct {
+			SHA string `json:"sha"`
+		} `json:"tree"`
+	} `json:"commit"`
+}
+
+type gitTree struct {
+	SHA       string     `json:"sha"`
+	Tree      []gitEntry `json:"tree"`
+	Truncated bool       `json:"truncated"`
+}
+
+type gitEntry struct {
+	Path string `json:"path"`
+	Mode string `json:"mode"`
+	Type string `json:"type"`
+	SHA  string `json:"sha"`
+	Size int64  `json:"size"`
+}
+
+// sparseModule is the contents of a module, resolved from the git trees.
+type sparseModule struct {
+	modTime time.Time
+	entries []gitEntry
+}
+
+// https://docs.github.com/en/rest/commits/commits?apiVersion=2022-11-28#get-a-commit
+func (s *Service) commit(ctx context.Context, owner, repo, tag string) (*commit, error) {
+	uri := fmt.Sprintf("repos/%s/%s/commits/tags/%s", owner, repo, escapeRef(tag))
+	var c commit
+	if err := s.getJSON(ctx, uri, &c); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// fetchTarball copies the module directory out of the tarball of the whole
+// repository, or the extracted tarball of the commit when cached.
+//
+// https://docs.github.com/en/rest/repos/contents?apiVersion=2022-11-28#download-a-repository-archive-tar
+func (s *Service) fetchTarball(ctx context.Context, owner, repo, dir, tag string, w io.Writer) error {
+	if s.repos != nil {
+		return s.fetchCached(ctx, owner, repo, dir, tag, w)
+	}
+
+	uri := fmt.Sprintf("repos/%s/%s/tarball/refs/tags/%s", owner, repo, escapeRef(tag))
+	body, err := s.makeRequest(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("read gzip: %w", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	aw, err := archive.NewWriter(archive.Default, w)
+	if err != nil {
+		return err
+	}
+
+	if err := archive.CopyDir(aw, tr, dir); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// sparse resolves the files of the module, if it should be fetched sparsely
+// according to the strategy. Otherwise it returns nil, and the tarball should
+// be used.
+func (s *Service) sparse(ctx context.Context, owner, repo, dir, tag string) (*sparseModule, error) {
+	switch s.cfg.Fetch.Strategy {
+	case FetchSparse:
+		return s.resolveSparse(ctx, owner, repo, dir, tag, 0)
+	case FetchAuto:
+	default:
+		return nil, nil
+	}
+
+	// Any errors are left for the tarball download to report, since it's the
+	// safe choice.
+	size, err := s.repoSize(ctx, owner, repo)
+	if err != nil {
+		s.log.Info("sizing repository", "owner", owner, "repo", repo, "err", err)
+		return nil, nil
+	}
+	if size < s.cfg.Fetch.MinRepoSize {
+		return nil, nil
+	}
+
+	m, err := s.resolveSparse(ctx, owner, repo, dir, tag, s.cfg.Fetch.MaxFiles)
+	if err != nil {
+		s.log.Info("resolving module tree", "owner", owner, "repo", repo, "dir", dir, "err", err)
+		return nil, nil
+	}
+	return m, nil
+}
+
+// repoSize returns the size of the repository, in kilobytes. The response is
+// kept along with the conditional ones, and reused without asking again for as
+// long as the SizeTTL.
+//
+// https://docs.github.com/en/rest/repos/repos?apiVersion=2022-11-28#get-a-repository
+func (s *Service) repoSize(ctx context.Context, owner, repo string) (int, error) {
+	uri := fmt.Sprintf("repos/%s/%s", owner, repo)
+	var r struct {
+		Size int `json:"size"`
+	}
+
+	token, err := s.token(ctx, uri)
+	if err != nil {
+		return 0, err
+	}
+	if b, ok := s.conditional.recent(conditionalKey(fingerprint(token), uri), s.cfg.Fetch.SizeTTL); ok {
+		if err := json.Unmarshal(b, &r); err == nil {
+			return r.Size, nil
+		}
+	}
+
+	if err := s.getJSON(ctx, uri, &r); err != nil {
+		return 0, err
+	}
+	return r.Size, nil
+}
+
+// resolveSparse walks the trees of the tagged commit down to the module
+// directory, and lists its contents. It returns nil if the module has more
+// than max files, or the listing is truncated by GitHub.
+//
+// https://docs.github.com/en/rest/git/trees?apiVersion=2022-11-28#get-a-tree
+func (s *Service) resolveSparse(ctx context.Context, owner, repo, dir, tag string, max int) (*sparseModule, error) {
+	c, err := s.commit(ctx, owner, repo, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	sha := c.Commit.Tree.SHA
+	if dir != "" {
+		for _, name := range strings.Split(dir, "/") {
+			var t gitTree
+			if err := s.getJSON(ctx, fmt.Sprintf("repos/%s/%s/git/trees/%s", owner, repo, sha), &t); err != nil {
+				return nil, err
+			}
+			sha = ""
+			for _, e := range t.Tree {
+				if e.Path == name && e.Type == "tree" {
+					sha = e.SHA
+					break
+				}
+			}
+			if sha == "" {
+				return nil, &httpErr{
+					code: http.StatusNotFound,
+					msg:  fmt.Sprintf("module directory not found: %s", dir),
+				}
+			}
+		}
+	}
+
+	var t gitTree
+	if err := s.getJSON(ctx, fmt.Sprintf("repos/%s/%s/git/trees/%s?recursive=1", owner, repo, sha), &t); err != nil {
+		return nil, err
+	}
+	if t.Truncated {
+		return nil, nil
+	}
+	if max > 0 {
+		var files int
+		for _, e := range t.Tree {
+			if e.Type == "blob" {
+				files++
+			}
+		}
+		if files > max {
+			return nil, nil
+		}
+	}
+
+	return &sparseModule{
+		modTime: c.Commit.Committer.Date,
+		entries: t.Tree,
+	}, nil
+}
+
+// fetchSparse downloads the blobs of the module, and writes them to an archive
+// laid out like the ones created by `git archive`. The blobs are downloaded
+// concurrently, ahead of being written in order. Symlinks pointing outside of
+// the module are left out, just like when the module is copied from a tree.
+//
+// https://docs.github.com/en/rest/git/blobs?apiVersion=2022-11-28#get-a-blob
+func (s *Service) fetchSparse(ctx context.Context, owner, repo string, m *sparseModule, w io.Writer) error {
+	aw, err := archive.NewWriter(archive.Default, w)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	blob := s.prefetch(ctx, owner, repo, m.entries)
+
+	for n, e := range m.entries {
+		hdr := &tar.Header{
+			Name:    e.Path,
+			ModTime: m.modTime,
+			Uname:   "root",
+			Gname:   "root",
+		}
+
+		var b []byte
+		if e.Type == "blob" {
+			if b, err = blob(n); err != nil {
+				return err
+			}
+		}
+
+		switch {
+		case e.Type == "tree", e.Type == "commit":
+			// Submodules are left as empty directories.
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0o775
+		case e.Type == "blob" && e.Mode == "120000":
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Mode = 0o777
+			hdr.Linkname = string(b)
+			if archive.Escapes(filepath.FromSlash(e.Path), filepath.FromSlash(hdr.Linkname)) {
+				continue
+			}
+		case e.Type == "blob":
+			hdr.Typeflag = tar.TypeReg
+			hdr.Mode = 0o664
+			if e.Mode == "100755" {
+				hdr.Mode = 0o775
+			}
+			hdr.Size = int64(len(b))
+		default:
+			continue
+		}
+
+		if err := aw.WriteHeader(hdr); err != nil {
+			return fmt.Errorf("writing header: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, err := aw.Write(b); err != nil {
+			return fmt.Errorf("writing %s: %w", e.Path, err)
+		}
+	}
+	return aw.Close()
+}
+
+type blobResult struct {
+	b   []byte
+	err error
+}
+
+// prefetch starts downloading the blobs of the entries, and returns a function
+// that waits for the contents of the nth entry, which must be a blob. No more
+// than the configured number of blobs are downloaded, or held, at a time, so
+// the downloads only run that far ahead of the reader.
+func (s *Service) prefetch(ctx context.Context, owner, repo string, entries []gitEntry) func(n int) ([]byte, error) {
+	blobs := make([]chan blobResult, len(entries))
+	for n, e := range entries {
+		if e.Type == "blob" {
+			blobs[n] = make(chan blobResult, 1)
+		}
+	}
+
+	slots := make(chan struct{}, max(s.cfg.Fetch.Concurrency, 1))
+	go func() {
+		for n, e := range entries {
+			if blobs[n] == nil {
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			go func(e gitEntry, c chan<- blobResult) {
+				b, err := s.readBlob(ctx, owner, repo, e)
+				c <- blobResult{b, err}
+			}(e, blobs[n])
+		}
+	}()
+
+	return func(n int) ([]byte, error) {
+		select {
+		case r := <-blobs[n]:
+			<-slots
+			return r.b, r.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (s *Service) readBlob(ctx context.Context, owner, repo string, e gitEntry) ([]byte, error) {
+	body, err := s.blob(ctx, owner, repo, e.SHA)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", e.Path, err)
+	}
+	return b, nil
+}
+
+func (s *Service) blob(ctx context.Context, owner, repo, sha string) (io.ReadCloser, error) {
+	return s.makeRequestAccept(ctx, fmt.Sprintf("repos/%s/%s/git/blobs/%s", owner, repo, sha), rawContentType)
+}
+
+func (s *Service) getJSON(ctx context.Context, uri string, v any) error {
+	res, err := s.makeRequest(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	if err := json.NewDecoder(res).Decode(v); err != nil {
+		return fmt.Errorf("decoding response: %w", err)
+	}
+	return nil
+}
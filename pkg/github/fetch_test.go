@@ -0,0 +1,141 @@
+package github
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSparseFetch(t *testing.T) {
+	var tarballs, sizes int
+	blobs := map[string]string{
+		"b1": "variable \"cidr\" {}\n",
+		"b2": "#!/bin/sh\n",
+		"b3": "main.tf",
+		"b4": "../../secrets.tf",
+	}
+	// The first blob is held back until the second is requested, which only
+	// happens if they are downloaded concurrently.
+	second := make(chan struct{})
+	var once sync.Once
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repos/acme/infra", func(w http.ResponseWriter, r *http.Request) {
+		sizes++
+		w.Header().Set("ETag", `"size"`)
+		w.Write([]byte(`{"size":500000}`))
+	})
+	mux.HandleFunc("GET /repos/acme/infra/commits/tags/vpc/1.0.0", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sha":"c1","commit":{"committer":{"date":"2023-05-01T12:00:00Z"},"tree":{"sha":"root"}}}`))
+	})
+	mux.HandleFunc("GET /repos/acme/infra/git/trees/{sha}", func(w http.ResponseWriter, r *http.Request) {
+		switch sha := r.PathValue("sha"); {
+		case sha == "root":
+			w.Write([]byte(`{"tree":[{"path":"README.md","type":"blob","sha":"x"},{"path":"modules","type":"tree","sha":"t1"}]}`))
+		case sha == "t1":
+			w.Write([]byte(`{"tree":[{"path":"vpc","type":"tree","sha":"t2"}]}`))
+		case sha == "t2" && r.URL.Query().Get("recursive") == "1":
+			w.Write([]byte(`{"tree":[
+				{"path":"main.tf","mode":"100644","type":"blob","sha":"b1","size":19},
+				{"path":"scripts","mode":"040000","type":"tree","sha":"t3"},
+				{"path":"scripts/init.sh","mode":"100755","type":"blob","sha":"b2","size":10},
+				{"path":"link.tf","mode":"120000","type":"blob","sha":"b3","size":7},
+				{"path":"escape.tf","mode":"120000","type":"blob","sha":"b4","size":16}
+			]}`))
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	mux.HandleFunc("GET /repos/acme/infra/git/blobs/{sha}", func(w http.ResponseWriter, r *http.Request) {
+		switch r.PathValue("sha") {
+		case "b1":
+			select {
+			case <-second:
+			case <-time.After(5 * time.Second):
+				t.Error("expected the blobs to be downloaded concurrently")
+			}
+		case "b2":
+			once.Do(func() { close(second) })
+		}
+		w.Write([]byte(blobs[r.PathValue("sha")]))
+	})
+	mux.HandleFunc("GET /repos/acme/infra/tarball/", func(w http.ResponseWriter, r *http.Request) {
+		tarballs++
+		http.NotFound(w, r)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := Config{
+		BaseURL:      srv.URL,
+		PathTemplate: "modules/{module}",
+		Fetch:        FetchConfig{Strategy: FetchAuto, MinRepoSize: 1000, MaxFiles: 10, Concurrency: 2, SizeTTL: time.Hour},
+		RateLimit:    RateLimitConfig{ConditionalCacheSize: 10},
+	}
+	s := New(cfg, srv.Client(), slog.Default())
+
+	var buf bytes.Buffer
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+	if tarballs != 0 {
+		t.Errorf("unexpected tarball download")
+	}
+
+	// The symlink pointing outside of the module is left out.
+	exp := []string{
+		"main.tf 664 " + blobs["b1"],
+		"scripts/ 775 ",
+		"scripts/init.sh 775 " + blobs["b2"],
+		"link.tf 777 -> main.tf",
+	}
+	if got := listArchive(t, &buf); !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected archive, exp: %q, got: %q", exp, got)
+	}
+
+	// The module is too large to be fetched sparsely.
+	s.cfg.Fetch.MaxFiles = 1
+	s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", io.Discard)
+	if tarballs != 1 {
+		t.Errorf("expected a tarball download")
+	}
+	if sizes != 1 {
+		t.Errorf("expected the repository size to be looked up once, got: %d", sizes)
+	}
+}
+
+func listArchive(t *testing.T, r io.Reader) []string {
+	t.Helper()
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("read gzip: %s", err)
+	}
+	tr := tar.NewReader(zr)
+
+	var entries []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatalf("read tar: %s", err)
+		}
+		b, _ := io.ReadAll(tr)
+		if hdr.Typeflag == tar.TypeSymlink {
+			b = []byte("-> " + hdr.Linkname)
+		}
+		entries = append(entries, fmt.Sprintf("%s %o %s", hdr.Name, hdr.Mode, b))
+	}
+}
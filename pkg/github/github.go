@@ -5,58 +5,245 @@
 package github
 
 import (
-	"archive/tar"
-	"compress/gzip"
+	"bytes"
 	"context"
 	"encoding/json"
+	"expvar"
 	"fmt"
 	"io"
 	"net/http"
-	"regexp"
+	"net/url"
 	"strings"
+	"sync/atomic"
 
 	"github.com/hedlund/orbit/pkg/auth"
+	"github.com/hedlund/orbit/pkg/layout"
+	"github.com/hedlund/orbit/services/modules"
 )
 
 const (
-	apiVersion  = "2022-11-28"
-	contentType = "application/vnd.github+json"
-	tagsPerPage = 100
+	apiVersion     = "2022-11-28"
+	contentType    = "application/vnd.github+json"
+	defaultBaseURL = "https://api.github.com/"
+	tagsPerPage    = 100
+)
+
+// The support of the matching refs API, as learnt from the responses.
+const (
+	refsUnknown int32 = iota
+	refsSupported
+	refsUnsupported
 )
 
 type Config struct {
+	// Name tells the hosts apart in the metrics, when several of them are
+	// configured. It isn't read from the environment, and defaults to the
+	// host of the BaseURL.
+	Name string
+
+	// BaseURL of the REST API, which for GitHub Enterprise Server is usually
+	// `https://<hostname>/api/v3/`.
+	BaseURL string `envconfig:"BASE_URL" default:"https://api.github.com/"`
+
+	// Owners served by this host, when running several hosts side by side.
+	// The owners are matched against the system of the module, before any
+	// org mapping is applied.
+	Owners []string `envconfig:"OWNERS"`
+
 	Repositories map[string][]string `envconfig:"REPOSITORIES"`
 	OrgMappings  map[string]string   `envconfig:"ORG_MAPPINGS"`
 	Token        string              `envconfig:"TOKEN"`
+
+	// App authenticates as a GitHub App, using installation tokens instead of
+	// the static token, for requests that don't carry a token of their own.
+	App AppConfig
+
+	// TagTemplate describes how module tags are named, with the `{module}`
+	// and `{version}` placeholders. It can be overridden per repository, keyed
+	// by `owner/repo`, in the TagTemplates.
+	TagTemplate  string            `envconfig:"TAG_TEMPLATE" default:"{module}/{version}"`
+	TagTemplates map[string]string `envconfig:"TAG_TEMPLATES"`
+
+	// PathTemplate describes where modules are located in the repository,
+	// e.g. `modules/{module}`. It can be overridden per repository, keyed by
+	// `owner/repo`, in the PathTemplates. When a PathSeparator is set, it is
+	// replaced by slashes in module names, to allow for nested directories.
+	PathTemplate  string            `envconfig:"PATH_TEMPLATE" default:"{module}"`
+	PathTemplates map[string]string `envconfig:"PATH_TEMPLATES"`
+	PathSeparator string            `envconfig:"PATH_SEPARATOR"`
+
+	Fetch        FetchConfig
+	TarballCache TarballCacheConfig
+	RateLimit    RateLimitConfig
+	Retry        RetryConfig
+}
+
+// Validate checks that the base URL and the configured templates are usable.
+func (c *Config) Validate() error {
+	if c.BaseURL != "" {
+		u, err := url.Parse(c.BaseURL)
+		if err != nil {
+			return fmt.Errorf("invalid base URL: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid base URL: %q", c.BaseURL)
+		}
+	}
+	if c.TagTemplate != "" {
+		if err := layout.ValidTagTemplate(c.TagTemplate); err != nil {
+			return err
+		}
+	}
+	for _, t := range c.TagTemplates {
+		if err := layout.ValidTagTemplate(t); err != nil {
+			return err
+		}
+	}
+	if err := c.Fetch.validate(); err != nil {
+		return err
+	}
+	if c.App.enabled() && c.App.PrivateKeyFile == "" {
+		if _, err := parsePrivateKey([]byte(c.App.PrivateKey)); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
-func New(cfg Config, c HTTPClient) *Service {
-	return &Service{
-		cfg:    cfg,
-		client: c,
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+func New(cfg Config, c HTTPClient, log Logger) *Service {
+	if cfg.Retry.enabled() {
+		c = NewRetryClient(c, cfg.Retry, log)
+	}
+	s := &Service{
+		cfg:         cfg,
+		client:      c,
+		log:         log,
+		limits:      newRateLimiter(cfg.RateLimit, log),
+		conditional: newConditionalCache(cfg.RateLimit.ConditionalCacheSize),
+	}
+	name := cfg.Name
+	if name == "" {
+		name = hostOf(s.url(""))
+	}
+	metrics.Set("quota:"+name, expvar.Func(s.limits.snapshot))
+
+	if cfg.TarballCache.Dir != "" {
+		s.repos = newRepoCache(cfg.TarballCache, log)
+	}
+
+	if cfg.App.enabled() {
+		// Any error is reported on each request, since there's no way for
+		// the service to work without the app.
+		s.app, s.appErr = newApp(cfg.App, s)
 	}
+	return s
 }
 
 type Service struct {
-	cfg    Config
-	client HTTPClient
+	cfg         Config
+	client      HTTPClient
+	log         Logger
+	app         *app
+	appErr      error
+	limits      *rateLimiter
+	conditional *conditionalCache
+	repos       *repoCache
+
+	// matchingRefs records whether the host supports the matching refs API.
+	// It has to be learnt, since a 404 may just as well mean that the
+	// repository is missing.
+	matchingRefs atomic.Int32
 }
 
-// https://docs.github.com/en/rest/repos/repos?apiVersion=2022-11-28#list-repository-tags
 func (s *Service) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
 	owner := s.mapOrg(system)
 	if err := s.validRepo(owner, repo); err != nil {
 		return nil, err
 	}
 
+	scheme := s.tagScheme(owner, repo, module)
+	tags, err := s.listTags(ctx, owner, repo, scheme.Prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []string{}
+	for _, tag := range tags {
+		if version, ok := scheme.Version(tag); ok {
+			versions = append(versions, version)
+		}
+	}
+	return versions, nil
+}
+
+// listTags lists the tags starting with the prefix, preferably through the
+// matching refs API. Until the host is known to support it, a 404 is retried
+// by listing every tag, in case the API isn't available, like on older GitHub
+// Enterprise Servers. Should that succeed, the API isn't tried again.
+func (s *Service) listTags(ctx context.Context, owner, repo, prefix string) ([]string, error) {
+	if s.matchingRefs.Load() == refsUnsupported {
+		return s.allTags(ctx, owner, repo)
+	}
+
+	tags, err := s.matchingTags(ctx, owner, repo, prefix)
+	switch {
+	case err == nil:
+		s.matchingRefs.Store(refsSupported)
+	case isNotFound(err) && s.matchingRefs.Load() == refsUnknown:
+		tags, err = s.allTags(ctx, owner, repo)
+		if err == nil {
+			s.matchingRefs.Store(refsUnsupported)
+		}
+	}
+	return tags, err
+}
+
+// matchingTags lists the tags starting with the prefix, which saves paging
+// through every tag of repositories with many modules.
+// https://docs.github.com/en/rest/git/refs?apiVersion=2022-11-28#list-matching-references
+func (s *Service) matchingTags(ctx context.Context, owner, repo, prefix string) ([]string, error) {
+	uri := fmt.Sprintf("repos/%s/%s/git/matching-refs/tags/%s", owner, repo, escapeRef(prefix))
+	res, err := s.makeRequest(ctx, uri)
+	if e, ok := err.(*httpErr); ok && e.code == http.StatusConflict {
+		// The repository is empty.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var refs []struct {
+		Ref string `json:"ref"`
+	}
+	if err := json.NewDecoder(res).Decode(&refs); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	tags := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		if tag, ok := strings.CutPrefix(ref.Ref, "refs/tags/"); ok {
+			tags = append(tags, tag)
+		}
+	}
+	return tags, nil
+}
+
+// allTags pages through every tag of the repository.
+// https://docs.github.com/en/rest/repos/repos?apiVersion=2022-11-28#list-repository-tags
+func (s *Service) allTags(ctx context.Context, owner, repo string) ([]string, error) {
 	var (
-		page     = 1
-		prefix   = module + "/"
-		versions = []string{}
+		page = 1
+		all  []string
 	)
 	for {
 		uri := fmt.Sprintf("repos/%s/%s/tags?per_page=%d&page=%d", owner, repo, tagsPerPage, page)
@@ -75,9 +262,7 @@ func (s *Service) ListVersions(ctx context.Context, system, repo, module string)
 		}
 
 		for _, tag := range tags {
-			if strings.HasPrefix(tag.Name, prefix) {
-				versions = append(versions, strings.TrimPrefix(tag.Name, prefix))
-			}
+			all = append(all, tag.Name)
 		}
 
 		if len(tags) < tagsPerPage {
@@ -85,7 +270,7 @@ func (s *Service) ListVersions(ctx context.Context, system, repo, module string)
 		}
 		page++
 	}
-	return versions, nil
+	return all, nil
 }
 
 func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
@@ -94,60 +279,167 @@ func (s *Service) ProxyDownload(ctx context.Context, system, repo, module, versi
 		return err
 	}
 
-	uri := fmt.Sprintf("repos/%s/%s/tarball/refs/tags/%s/%s", owner, repo, module, version)
-	body, err := s.makeRequest(ctx, uri)
+	dir, err := s.modulePath(owner, repo, module)
 	if err != nil {
 		return err
 	}
-	defer body.Close()
 
-	zr, err := gzip.NewReader(body)
+	tag := s.tagScheme(owner, repo, module).Tag(version)
+	m, err := s.sparse(ctx, owner, repo, dir, tag)
 	if err != nil {
-		return fmt.Errorf("read gzip: %w", err)
+		return err
 	}
-	defer zr.Close()
+	if m != nil {
+		metrics.Add("sparse_fetches", 1)
+		return s.fetchSparse(ctx, owner, repo, m, w)
+	}
+	return s.fetchTarball(ctx, owner, repo, dir, tag, w)
+}
 
-	zw := gzip.NewWriter(w)
-	defer zw.Close()
+// https://docs.github.com/en/rest/commits/commits?apiVersion=2022-11-28#get-a-commit
+func (s *Service) DescribeVersion(ctx context.Context, system, repo, module, version string) (*modules.VersionDetails, error) {
+	owner := s.mapOrg(system)
+	if err := s.validRepo(owner, repo); err != nil {
+		return nil, err
+	}
 
-	tr := tar.NewReader(zr)
-	tw := tar.NewWriter(zw)
-	defer tw.Close()
+	tag := s.tagScheme(owner, repo, module).Tag(version)
+	c, err := s.commit(ctx, owner, repo, tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &modules.VersionDetails{
+		Commit:      c.SHA,
+		PublishedAt: c.Commit.Committer.Date,
+	}, nil
+}
+
+// CheckAccess checks that the caller can read the repository, which GitHub
+// reports as not found otherwise.
+// https://docs.github.com/en/rest/repos/repos?apiVersion=2022-11-28#get-a-repository
+func (s *Service) CheckAccess(ctx context.Context, system, repo string) error {
+	owner := s.mapOrg(system)
+	if err := s.validRepo(owner, repo); err != nil {
+		return err
+	}
 
-	prefix := fmt.Sprintf("^%s-%s-[^/]+/%s/(.+)", owner, repo, module)
-	if err := copy(prefix, tw, tr); err != nil {
+	res, err := s.makeRequest(ctx, fmt.Sprintf("repos/%s/%s", owner, repo))
+	if err != nil {
 		return err
 	}
-	return nil
+	return res.Close()
 }
 
 func (s *Service) makeRequest(ctx context.Context, uri string) (io.ReadCloser, error) {
-	url := fmt.Sprintf("https://api.github.com/%s", uri)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	return s.makeRequestAccept(ctx, uri, contentType)
+}
+
+func (s *Service) makeRequestAccept(ctx context.Context, uri, accept string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(uri), nil)
 	if err != nil {
 		return nil, fmt.Errorf("new request: %w", err)
 	}
 
-	req.Header.Add("Accept", contentType)
+	req.Header.Add("Accept", accept)
 	req.Header.Add("X-GitHub-Api-Version", apiVersion)
 
-	if token := auth.GetToken(ctx, s.cfg.Token); token != "" {
+	token, err := s.token(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
 		req.Header.Add("Authorization", "Bearer "+token)
 	}
 
+	fp := fingerprint(token)
+	if err := s.limits.wait(ctx, fp); err != nil {
+		return nil, err
+	}
+
+	// Only API responses are made conditional, not downloads. The responses
+	// are kept per token, since they may differ depending on access.
+	var (
+		key         = conditionalKey(fp, uri)
+		cacheable   = accept == contentType
+		conditional bool
+		cached      []byte
+	)
+	if cacheable {
+		if tag, b, ok := s.conditional.get(key); ok {
+			req.Header.Set("If-None-Match", tag)
+			conditional, cached = true, b
+		}
+	}
+
+	metrics.Add("requests", 1)
 	res, err := s.client.Do(req)
+	if e, ok := err.(*httpErr); ok {
+		// The circuit is open.
+		return nil, e
+	}
 	if err != nil {
 		return nil, fmt.Errorf("executing request: %w", err)
 	}
-
-	if res.StatusCode != http.StatusOK {
+	s.limits.update(fp, res)
+
+	switch {
+	case res.StatusCode == http.StatusNotModified && conditional:
+		res.Body.Close()
+		metrics.Add("not_modified", 1)
+		s.conditional.set(key, req.Header.Get("If-None-Match"), cached)
+		return io.NopCloser(bytes.NewReader(cached)), nil
+	case res.StatusCode == http.StatusOK:
+		if tag := res.Header.Get("ETag"); cacheable && tag != "" {
+			b, err := io.ReadAll(res.Body)
+			res.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("reading response: %w", err)
+			}
+			s.conditional.set(key, tag, b)
+			return io.NopCloser(bytes.NewReader(b)), nil
+		}
+		return res.Body, nil
+	case s.limits.limited(fp, res):
+		return nil, &httpErr{
+			code: http.StatusTooManyRequests,
+			msg:  slurp(res.Body),
+		}
+	default:
 		return nil, &httpErr{
 			code: res.StatusCode,
 			msg:  slurp(res.Body),
 		}
 	}
+}
+
+// token returns the token to authenticate the request with. The token of the
+// caller always takes precedence, followed by an installation token if running
+// as a GitHub App, and lastly the static token.
+func (s *Service) token(ctx context.Context, uri string) (string, error) {
+	if token := auth.GetToken(ctx, ""); token != "" {
+		return token, nil
+	}
+	if s.appErr != nil {
+		return "", s.appErr
+	}
+	if s.app != nil {
+		// All requests made on behalf of an installation are for some
+		// repository, i.e. `repos/<owner>/<repo>/...`.
+		if parts := strings.SplitN(uri, "/", 4); len(parts) >= 3 && parts[0] == "repos" {
+			return s.app.token(ctx, parts[1], parts[2])
+		}
+	}
+	return s.cfg.Token, nil
+}
 
-	return res.Body, nil
+// url returns the full URL of the API endpoint, relative to the base URL.
+func (s *Service) url(uri string) string {
+	base := s.cfg.BaseURL
+	if base == "" {
+		base = defaultBaseURL
+	}
+	return strings.TrimSuffix(base, "/") + "/" + strings.TrimPrefix(uri, "/")
 }
 
 func (s *Service) mapOrg(system string) string {
@@ -173,33 +465,18 @@ func (s *Service) validRepo(owner, repo string) error {
 	return &httpErr{
 		code: http.StatusForbidden,
 		msg:  "not a valid repository",
+		err:  modules.ErrNotAllowed,
 	}
 }
 
-func copy(prefix string, w *tar.Writer, r *tar.Reader) error {
-	re, err := regexp.Compile(prefix)
-	if err != nil {
-		return fmt.Errorf("compile prefix regexp: %w", err)
-	}
-
-	for {
-		hdr, err := r.Next()
-		if err == io.EOF {
-			return nil
-		}
-		if err != nil {
-			return fmt.Errorf("reading tar: %w", err)
-		}
-
-		match := re.FindStringSubmatch(hdr.Name)
-		if len(match) == 2 {
-			hdr.Name = match[1]
-			if err := w.WriteHeader(hdr); err != nil {
-				return fmt.Errorf("writing header: %w", err)
-			}
-			io.Copy(w, r)
-		}
+// escapeRef escapes each segment of a git ref for use in a URL path, keeping
+// the slashes intact.
+func escapeRef(ref string) string {
+	segments := strings.Split(ref, "/")
+	for n, s := range segments {
+		segments[n] = url.PathEscape(s)
 	}
+	return strings.Join(segments, "/")
 }
 
 func slurp(r io.ReadCloser) string {
@@ -215,12 +492,17 @@ func slurp(r io.ReadCloser) string {
 type httpErr struct {
 	code int
 	msg  string
+	err  error // Optional cause, for errors.Is.
 }
 
 func (e *httpErr) Error() string {
 	return e.msg
 }
 
+func (e *httpErr) Unwrap() error {
+	return e.err
+}
+
 func (e *httpErr) StatusCode() int {
 	return e.code
 }
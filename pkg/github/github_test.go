@@ -0,0 +1,264 @@
+package github
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/auth"
+)
+
+func TestHostsListVersions(t *testing.T) {
+	public := fakeGitHub(t, "", `[{"name":"vpc/1.0.0"},{"name":"other/2.0.0"}]`)
+	enterprise := fakeGitHub(t, "/api/v3", `[{"name":"vpc/3.0.0"}]`)
+
+	h := NewHosts(
+		New(Config{BaseURL: public.URL}, public.Client(), slog.Default()),
+		New(Config{BaseURL: enterprise.URL + "/api/v3/", Owners: []string{"corp"}}, enterprise.Client(), slog.Default()),
+	)
+
+	tests := []struct {
+		system string
+		exp    []string
+	}{
+		{"hedlund", []string{"1.0.0"}},
+		{"corp", []string{"3.0.0"}},
+	}
+	for _, tt := range tests {
+		versions, err := h.ListVersions(context.Background(), tt.system, "infra", "vpc")
+		if err != nil {
+			t.Fatalf("%s: list versions: %s", tt.system, err)
+		}
+		if !reflect.DeepEqual(versions, tt.exp) {
+			t.Errorf("%s: unexpected versions, exp: %v, got: %v", tt.system, tt.exp, versions)
+		}
+	}
+}
+
+// fakeGitHub starts a server that responds with the tags for any repository,
+// as long as the request is made relative to the base path. Matching refs are
+// not found, so the client has to fall back to paging through the tags.
+func fakeGitHub(t *testing.T, base, tags string) *httptest.Server {
+	t.Helper()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(base+"/repos/{owner}/{repo}/tags", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(tags))
+	})
+	s := httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestConditionalRequests(t *testing.T) {
+	var requests, notModified int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("If-None-Match") == `"abc"` {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"abc"`)
+		w.Write([]byte(`[{"ref":"refs/tags/vpc/1.0.0"}]`))
+	}))
+	defer srv.Close()
+
+	cfg := Config{BaseURL: srv.URL, RateLimit: RateLimitConfig{ConditionalCacheSize: 10}}
+	s := New(cfg, srv.Client(), slog.Default())
+	for n := 0; n < 3; n++ {
+		versions, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+		if err != nil {
+			t.Fatalf("list versions: %s", err)
+		}
+		if !reflect.DeepEqual(versions, []string{"1.0.0"}) {
+			t.Errorf("unexpected versions: %v", versions)
+		}
+	}
+	if requests != 3 || notModified != 2 {
+		t.Errorf("unexpected requests, exp: 3 (2 not modified), got: %d (%d not modified)", requests, notModified)
+	}
+}
+
+func TestRateLimitExhausted(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("X-RateLimit-Limit", "5000")
+		w.Header().Set("X-RateLimit-Remaining", "0")
+		w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10))
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	s := New(Config{BaseURL: srv.URL}, srv.Client(), slog.Default())
+	for n := 0; n < 2; n++ {
+		_, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+		if e, ok := err.(*httpErr); !ok || e.StatusCode() != http.StatusTooManyRequests {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if requests != 1 {
+		t.Errorf("unexpected number of requests, exp: 1, got: %d", requests)
+	}
+}
+
+func TestRateLimitQuotas(t *testing.T) {
+	now := time.Now()
+	r := newRateLimiter(RateLimitConfig{}, slog.Default())
+	r.now = func() time.Time { return now }
+
+	update := func(token string, reset time.Time) {
+		res := &http.Response{Header: http.Header{}}
+		res.Header.Set("X-RateLimit-Limit", "5000")
+		res.Header.Set("X-RateLimit-Remaining", "4000")
+		res.Header.Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+		r.update(fingerprint(token), res)
+	}
+
+	for n := 0; n < maxQuotas+10; n++ {
+		update(fmt.Sprintf("token-%d", n), now.Add(time.Hour+time.Duration(n)*time.Second))
+	}
+	if n := len(r.quotas); n != maxQuotas {
+		t.Errorf("unexpected number of quotas, exp: %d, got: %d", maxQuotas, n)
+	}
+	if _, ok := r.quotas[fingerprint("token-0")]; ok {
+		t.Errorf("expected the quota that resets first to be dropped")
+	}
+
+	// Once the quotas have reset, they are dropped as soon as another token
+	// comes along.
+	now = now.Add(2 * time.Hour)
+	update("fresh", now.Add(time.Hour))
+	if n := len(r.quotas); n != 1 {
+		t.Errorf("unexpected number of quotas after reset, exp: 1, got: %d", n)
+	}
+}
+
+func TestQuotaMetrics(t *testing.T) {
+	// Hosts sharing a base URL, e.g. with different tokens, are told apart
+	// by their names.
+	for _, name := range []string{"team-a", "team-b", ""} {
+		New(Config{Name: name, BaseURL: "https://quota.example.com/"}, http.DefaultClient, slog.Default())
+	}
+	for _, key := range []string{"quota:team-a", "quota:team-b", "quota:quota.example.com"} {
+		if metrics.Get(key) == nil {
+			t.Errorf("missing metric: %s", key)
+		}
+	}
+}
+
+func TestMatchingRefs(t *testing.T) {
+	var requests []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Path)
+		w.Write([]byte(`[{"ref":"refs/tags/vpc-v1.0.0"},{"ref":"refs/tags/vpc-v1.1.0"}]`))
+	}))
+	defer srv.Close()
+
+	s := New(Config{BaseURL: srv.URL, TagTemplate: "{module}-v{version}"}, srv.Client(), slog.Default())
+	versions, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0", "1.1.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+	if exp := []string{"/repos/acme/infra/git/matching-refs/tags/vpc-v"}; !reflect.DeepEqual(requests, exp) {
+		t.Errorf("unexpected requests, exp: %v, got: %v", exp, requests)
+	}
+}
+
+func TestMatchingRefsSupport(t *testing.T) {
+	tests := []struct {
+		name       string
+		supported  bool
+		expFirst   []string
+		expMissing []string
+	}{
+		{
+			name:       "supported",
+			supported:  true,
+			expFirst:   []string{"/repos/acme/infra/git/matching-refs/tags/vpc-v"},
+			expMissing: []string{"/repos/acme/missing/git/matching-refs/tags/vpc-v"},
+		},
+		{
+			name:       "unsupported",
+			expFirst:   []string{"/repos/acme/infra/git/matching-refs/tags/vpc-v", "/repos/acme/infra/tags"},
+			expMissing: []string{"/repos/acme/missing/tags"},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			var requests []string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests = append(requests, r.URL.Path)
+				switch {
+				case strings.HasPrefix(r.URL.Path, "/repos/acme/missing/"):
+					w.WriteHeader(http.StatusNotFound)
+				case strings.Contains(r.URL.Path, "/matching-refs/"):
+					if !tt.supported {
+						w.WriteHeader(http.StatusNotFound)
+						return
+					}
+					w.Write([]byte(`[{"ref":"refs/tags/vpc-v1.0.0"}]`))
+				default:
+					w.Write([]byte(`[{"name":"vpc-v1.0.0"}]`))
+				}
+			}))
+			defer srv.Close()
+
+			s := New(Config{BaseURL: srv.URL, TagTemplate: "{module}-v{version}"}, srv.Client(), slog.Default())
+			versions, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+			if err != nil {
+				t.Fatalf("list versions: %s", err)
+			}
+			if exp := []string{"1.0.0"}; !reflect.DeepEqual(versions, exp) {
+				t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+			}
+			if !reflect.DeepEqual(requests, tt.expFirst) {
+				t.Errorf("unexpected requests, exp: %v, got: %v", tt.expFirst, requests)
+			}
+
+			// Once the support is known, a missing repository only costs a
+			// single request.
+			requests = nil
+			if _, err := s.ListVersions(context.Background(), "acme", "missing", "vpc"); !isNotFound(err) {
+				t.Errorf("expected not found, got: %v", err)
+			}
+			if !reflect.DeepEqual(requests, tt.expMissing) {
+				t.Errorf("unexpected requests, exp: %v, got: %v", tt.expMissing, requests)
+			}
+		})
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repos/hedlund/infra" || r.Header.Get("Authorization") != "Bearer reader" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"private":true}`))
+	}))
+	defer srv.Close()
+
+	s := New(Config{BaseURL: srv.URL}, srv.Client(), slog.Default())
+
+	if err := s.CheckAccess(auth.WithToken(context.Background(), "reader"), "hedlund", "infra"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	err := s.CheckAccess(auth.WithToken(context.Background(), "stranger"), "hedlund", "infra")
+	if e, ok := err.(*httpErr); !ok || e.code != http.StatusNotFound {
+		t.Errorf("expected not found, got: %v", err)
+	}
+}
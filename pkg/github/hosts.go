@@ -0,0 +1,65 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"context"
+	"io"
+
+	"github.com/hedlund/orbit/services/modules"
+)
+
+// NewHosts creates a repository that dispatches to one of several GitHub
+// services, e.g. github.com and a GitHub Enterprise Server, based on the owners
+// configured for each of them. Anything not claimed by a host is served by the
+// fallback.
+func NewHosts(fallback *Service, hosts ...*Service) *Hosts {
+	h := &Hosts{
+		fallback: fallback,
+		owners:   make(map[string]*Service),
+	}
+	for _, s := range hosts {
+		for _, owner := range s.cfg.Owners {
+			h.owners[owner] = s
+		}
+	}
+	return h
+}
+
+type Hosts struct {
+	fallback *Service
+	owners   map[string]*Service
+}
+
+func (h *Hosts) ListVersions(ctx context.Context, system, repo, module string) ([]string, error) {
+	return h.service(system).ListVersions(ctx, system, repo, module)
+}
+
+func (h *Hosts) ProxyDownload(ctx context.Context, system, repo, module, version string, w io.Writer) error {
+	return h.service(system).ProxyDownload(ctx, system, repo, module, version, w)
+}
+
+func (h *Hosts) DescribeVersion(ctx context.Context, system, repo, module, version string) (*modules.VersionDetails, error) {
+	return h.service(system).DescribeVersion(ctx, system, repo, module, version)
+}
+
+func (h *Hosts) CheckAccess(ctx context.Context, system, repo string) error {
+	return h.service(system).CheckAccess(ctx, system, repo)
+}
+
+// Providers returns a provider repository that dispatches in the same way as
+// the hosts do for modules.
+func (h *Hosts) Providers() *Providers {
+	return &Providers{
+		service: h.service,
+	}
+}
+
+func (h *Hosts) service(system string) *Service {
+	if s, ok := h.owners[system]; ok {
+		return s
+	}
+	return h.fallback
+}
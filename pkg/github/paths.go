@@ -0,0 +1,29 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"net/http"
+
+	"github.com/hedlund/orbit/pkg/layout"
+)
+
+// modulePath returns the directory of the module inside the repository, using
+// the path template configured for the repository, or the default one.
+func (s *Service) modulePath(owner, repo, module string) (string, error) {
+	template := s.cfg.PathTemplate
+	if t, ok := s.cfg.PathTemplates[owner+"/"+repo]; ok {
+		template = t
+	}
+
+	p, err := layout.ModulePath(template, s.cfg.PathSeparator, module)
+	if err != nil {
+		return "", &httpErr{
+			code: http.StatusBadRequest,
+			msg:  err.Error(),
+		}
+	}
+	return p, nil
+}
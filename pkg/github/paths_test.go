@@ -0,0 +1,37 @@
+package github
+
+import (
+	"log/slog"
+	"testing"
+)
+
+func TestModulePath(t *testing.T) {
+	s := New(Config{
+		PathTemplate:  "modules/{module}",
+		PathTemplates: map[string]string{"acme/infra": "terraform/{module}"},
+		PathSeparator: ".",
+	}, nil, slog.Default())
+
+	tests := []struct {
+		repo   string
+		module string
+		exp    string
+		err    bool
+	}{
+		{"other", "vpc", "modules/vpc", false},
+		{"infra", "vpc", "terraform/vpc", false},
+		{"infra", "aws.vpc", "terraform/aws/vpc", false},
+		{"infra", "..", "", true},
+		{"infra", "aws...", "", true},
+		{"infra", ".aws", "", true},
+	}
+	for _, tt := range tests {
+		p, err := s.modulePath("acme", tt.repo, tt.module)
+		if (err != nil) != tt.err {
+			t.Errorf("%s/%s: unexpected error: %v", tt.repo, tt.module, err)
+		}
+		if p != tt.exp {
+			t.Errorf("%s/%s: unexpected path, exp: %q, got: %q", tt.repo, tt.module, tt.exp, p)
+		}
+	}
+}
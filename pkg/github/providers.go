@@ -0,0 +1,301 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	octetStream     = "application/octet-stream"
+	providerPrefix  = "terraform-provider-"
+	releasesPerPage = 100
+)
+
+// NewProviders returns a provider repository backed by GitHub releases. The
+// releases are expected to follow the layout used by the official provider
+// publishing workflow, i.e. a `terraform-provider-<type>` repository with
+// release assets named `terraform-provider-<type>_<version>_<os>_<arch>.zip`
+// alongside the `_SHA256SUMS`, `_SHA256SUMS.sig` and `_manifest.json` files.
+func NewProviders(s *Service) *Providers {
+	return &Providers{
+		service: func(string) *Service { return s },
+	}
+}
+
+type Providers struct {
+	service func(namespace string) *Service
+}
+
+// ProviderVersion is a published release of a provider, along with the
+// platforms it has been built for.
+type ProviderVersion struct {
+	Version   string
+	Platforms []ProviderPlatform
+}
+
+type ProviderPlatform struct {
+	OS   string
+	Arch string
+}
+
+// ProviderPackage describes the release assets of a provider for a specific
+// platform. The protocols are only known if the release has a manifest.
+type ProviderPackage struct {
+	Protocols           []string
+	OS                  string
+	Arch                string
+	Filename            string
+	SHASum              string
+	SHASumsFilename     string
+	SHASumsSignFilename string
+}
+
+// https://docs.github.com/en/rest/releases/releases?apiVersion=2022-11-28#list-releases
+func (p *Providers) ListVersions(ctx context.Context, namespace, name string) ([]ProviderVersion, error) {
+	s := p.service(namespace)
+	owner, repo := s.mapOrg(namespace), providerPrefix+name
+	if err := s.validRepo(owner, repo); err != nil {
+		return nil, err
+	}
+
+	var (
+		page     = 1
+		versions = []ProviderVersion{}
+	)
+	for {
+		uri := fmt.Sprintf("repos/%s/%s/releases?per_page=%d&page=%d", owner, repo, releasesPerPage, page)
+		res, err := s.makeRequest(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		var releases []release
+		err = json.NewDecoder(res).Decode(&releases)
+		res.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+
+		for _, r := range releases {
+			if r.Draft {
+				continue
+			}
+			version := strings.TrimPrefix(r.TagName, "v")
+			versions = append(versions, ProviderVersion{
+				Version:   version,
+				Platforms: r.platforms(name, version),
+			})
+		}
+
+		if len(releases) < releasesPerPage {
+			break
+		}
+		page++
+	}
+	return versions, nil
+}
+
+func (p *Providers) FindPackage(ctx context.Context, namespace, name, version, os, arch string) (*ProviderPackage, error) {
+	s := p.service(namespace)
+	owner, repo := s.mapOrg(namespace), providerPrefix+name
+	if err := s.validRepo(owner, repo); err != nil {
+		return nil, err
+	}
+
+	r, err := p.findRelease(ctx, s, owner, repo, version)
+	if err != nil {
+		return nil, err
+	}
+
+	base := fmt.Sprintf("%s%s_%s", providerPrefix, name, version)
+	pkg := &ProviderPackage{
+		OS:                  os,
+		Arch:                arch,
+		Filename:            fmt.Sprintf("%s_%s_%s.zip", base, os, arch),
+		SHASumsFilename:     base + "_SHA256SUMS",
+		SHASumsSignFilename: base + "_SHA256SUMS.sig",
+	}
+	for _, filename := range []string{pkg.Filename, pkg.SHASumsFilename, pkg.SHASumsSignFilename} {
+		if r.asset(filename) == nil {
+			return nil, &httpErr{
+				code: http.StatusNotFound,
+				msg:  fmt.Sprintf("release asset %s not found", filename),
+			}
+		}
+	}
+
+	pkg.SHASum, err = p.findSHASum(ctx, s, owner, repo, r.asset(pkg.SHASumsFilename), pkg.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	if a := r.asset(base + "_manifest.json"); a != nil {
+		pkg.Protocols, err = p.readProtocols(ctx, s, owner, repo, a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pkg, nil
+}
+
+// https://docs.github.com/en/rest/releases/assets?apiVersion=2022-11-28#get-a-release-asset
+func (p *Providers) ProxyAsset(ctx context.Context, namespace, name, version, filename string, w io.Writer) error {
+	s := p.service(namespace)
+	owner, repo := s.mapOrg(namespace), providerPrefix+name
+	if err := s.validRepo(owner, repo); err != nil {
+		return err
+	}
+
+	r, err := p.findRelease(ctx, s, owner, repo, version)
+	if err != nil {
+		return err
+	}
+
+	a := r.asset(filename)
+	if a == nil {
+		return &httpErr{
+			code: http.StatusNotFound,
+			msg:  fmt.Sprintf("release asset %s not found", filename),
+		}
+	}
+
+	body, err := p.downloadAsset(ctx, s, owner, repo, a)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("copying asset: %w", err)
+	}
+	return nil
+}
+
+// findRelease looks up the release for the version, with or without the common
+// "v" prefix on the tag.
+//
+// https://docs.github.com/en/rest/releases/releases?apiVersion=2022-11-28#get-a-release-by-tag-name
+func (p *Providers) findRelease(ctx context.Context, s *Service, owner, repo, version string) (*release, error) {
+	var err error
+	for _, tag := range []string{"v" + version, version} {
+		var res io.ReadCloser
+		res, err = s.makeRequest(ctx, fmt.Sprintf("repos/%s/%s/releases/tags/%s", owner, repo, escapeRef(tag)))
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var r release
+		err = json.NewDecoder(res).Decode(&r)
+		res.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+		return &r, nil
+	}
+	return nil, err
+}
+
+func (p *Providers) findSHASum(ctx context.Context, s *Service, owner, repo string, a *asset, filename string) (string, error) {
+	body, err := p.downloadAsset(ctx, s, owner, repo, a)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	scanner := bufio.NewScanner(body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == filename {
+			return fields[0], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("reading checksums: %w", err)
+	}
+	return "", &httpErr{
+		code: http.StatusNotFound,
+		msg:  fmt.Sprintf("checksum for %s not found", filename),
+	}
+}
+
+func (p *Providers) readProtocols(ctx context.Context, s *Service, owner, repo string, a *asset) ([]string, error) {
+	body, err := p.downloadAsset(ctx, s, owner, repo, a)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var manifest struct {
+		Metadata struct {
+			ProtocolVersions []string `json:"protocol_versions"`
+		} `json:"metadata"`
+	}
+	if err := json.NewDecoder(body).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("decoding manifest: %w", err)
+	}
+	return manifest.Metadata.ProtocolVersions, nil
+}
+
+func (p *Providers) downloadAsset(ctx context.Context, s *Service, owner, repo string, a *asset) (io.ReadCloser, error) {
+	uri := fmt.Sprintf("repos/%s/%s/releases/assets/%d", owner, repo, a.ID)
+	return s.makeRequestAccept(ctx, uri, octetStream)
+}
+
+type release struct {
+	TagName string  `json:"tag_name"`
+	Draft   bool    `json:"draft"`
+	Assets  []asset `json:"assets"`
+}
+
+func (r *release) asset(name string) *asset {
+	for n := range r.Assets {
+		if r.Assets[n].Name == name {
+			return &r.Assets[n]
+		}
+	}
+	return nil
+}
+
+// platforms extracts the supported OS and architecture combinations from the
+// names of the zip archives attached to the release.
+func (r *release) platforms(name, version string) []ProviderPlatform {
+	var (
+		prefix    = fmt.Sprintf("%s%s_%s_", providerPrefix, name, version)
+		platforms = []ProviderPlatform{}
+	)
+	for _, a := range r.Assets {
+		if !strings.HasPrefix(a.Name, prefix) || !strings.HasSuffix(a.Name, ".zip") {
+			continue
+		}
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(a.Name, prefix), ".zip"), "_")
+		if len(parts) == 2 {
+			platforms = append(platforms, ProviderPlatform{
+				OS:   parts[0],
+				Arch: parts[1],
+			})
+		}
+	}
+	return platforms
+}
+
+type asset struct {
+	ID   int64  `json:"id"`
+	Name string `json:"name"`
+}
+
+func isNotFound(err error) bool {
+	e, ok := err.(*httpErr)
+	return ok && e.code == http.StatusNotFound
+}
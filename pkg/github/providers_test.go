@@ -0,0 +1,111 @@
+package github
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// releaseFixture is a trimmed down release, as returned by the GitHub API for
+// a provider published with the official workflow.
+const releaseFixture = `{
+	"tag_name": "v1.2.0",
+	"draft": false,
+	"assets": [
+		{"id": 1, "name": "terraform-provider-demo_1.2.0_linux_amd64.zip"},
+		{"id": 2, "name": "terraform-provider-demo_1.2.0_darwin_arm64.zip"},
+		{"id": 3, "name": "terraform-provider-demo_1.2.0_SHA256SUMS"},
+		{"id": 4, "name": "terraform-provider-demo_1.2.0_SHA256SUMS.sig"},
+		{"id": 5, "name": "terraform-provider-demo_1.2.0_manifest.json"}
+	]
+}`
+
+func TestProviders(t *testing.T) {
+	assets := map[string]string{
+		"1": "linux-zip",
+		"3": "abc123  terraform-provider-demo_1.2.0_linux_amd64.zip\ndef456  terraform-provider-demo_1.2.0_darwin_arm64.zip\n",
+		"5": `{"version":1,"metadata":{"protocol_versions":["6.0"]}}`,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/repos/acme/terraform-provider-demo/releases", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[` + releaseFixture + `,{"tag_name":"v1.3.0-rc1","draft":true,"assets":[]}]`))
+	})
+	mux.HandleFunc("/repos/acme/terraform-provider-demo/releases/tags/{tag}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("tag") != "v1.2.0" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(releaseFixture))
+	})
+	mux.HandleFunc("/repos/acme/terraform-provider-demo/releases/assets/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Accept") != octetStream {
+			t.Errorf("unexpected accept header: %s", r.Header.Get("Accept"))
+		}
+		b, ok := assets[r.PathValue("id")]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(b))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	p := NewProviders(New(Config{BaseURL: srv.URL}, srv.Client(), slog.Default()))
+	ctx := context.Background()
+
+	versions, err := p.ListVersions(ctx, "acme", "demo")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	expVersions := []ProviderVersion{{
+		Version: "1.2.0",
+		Platforms: []ProviderPlatform{
+			{OS: "linux", Arch: "amd64"},
+			{OS: "darwin", Arch: "arm64"},
+		},
+	}}
+	if !reflect.DeepEqual(versions, expVersions) {
+		t.Errorf("unexpected versions, exp: %+v, got: %+v", expVersions, versions)
+	}
+
+	pkg, err := p.FindPackage(ctx, "acme", "demo", "1.2.0", "linux", "amd64")
+	if err != nil {
+		t.Fatalf("find package: %s", err)
+	}
+	expPackage := &ProviderPackage{
+		Protocols:           []string{"6.0"},
+		OS:                  "linux",
+		Arch:                "amd64",
+		Filename:            "terraform-provider-demo_1.2.0_linux_amd64.zip",
+		SHASum:              "abc123",
+		SHASumsFilename:     "terraform-provider-demo_1.2.0_SHA256SUMS",
+		SHASumsSignFilename: "terraform-provider-demo_1.2.0_SHA256SUMS.sig",
+	}
+	if !reflect.DeepEqual(pkg, expPackage) {
+		t.Errorf("unexpected package, exp: %+v, got: %+v", expPackage, pkg)
+	}
+
+	if _, err := p.FindPackage(ctx, "acme", "demo", "1.2.0", "windows", "amd64"); !isNotFound(err) {
+		t.Errorf("expected missing platform to not be found, got: %v", err)
+	}
+	if _, err := p.FindPackage(ctx, "acme", "demo", "9.9.9", "linux", "amd64"); !isNotFound(err) {
+		t.Errorf("expected missing release to not be found, got: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err := p.ProxyAsset(ctx, "acme", "demo", "1.2.0", "terraform-provider-demo_1.2.0_linux_amd64.zip", &buf); err != nil {
+		t.Fatalf("proxy asset: %s", err)
+	}
+	if buf.String() != "linux-zip" {
+		t.Errorf("unexpected asset, got: %q", buf.String())
+	}
+	if err := p.ProxyAsset(ctx, "acme", "demo", "1.2.0", "unknown.zip", &buf); !isNotFound(err) {
+		t.Errorf("expected unknown asset to not be found, got: %v", err)
+	}
+}
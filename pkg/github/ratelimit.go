@@ -0,0 +1,284 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// secondaryBackoff is used for secondary rate limits that don't come with
+	// a Retry-After header, as recommended by GitHub.
+	secondaryBackoff = 60 * time.Second
+
+	// maxQuotas is the number of tokens whose quotas are tracked, since each
+	// caller may bring their own token.
+	maxQuotas = 1000
+)
+
+var (
+	// metrics are published under /debug/vars on the admin listener, with the
+	// quota of each host and counters of the requests made.
+	metrics = expvar.NewMap("github")
+)
+
+type RateLimitConfig struct {
+	// MinRemaining is the quota below which requests are held back until the
+	// quota resets, as long as that is within MaxWait. Otherwise the request
+	// fails immediately.
+	MinRemaining int           `envconfig:"RATE_LIMIT_MIN_REMAINING" default:"10"`
+	MaxWait      time.Duration `envconfig:"RATE_LIMIT_MAX_WAIT" default:"10s"`
+
+	// ConditionalCacheSize is the number of responses kept around to make
+	// conditional requests, which do not count towards the quota.
+	ConditionalCacheSize int `envconfig:"CONDITIONAL_CACHE_SIZE" default:"1000"`
+}
+
+// quota is the rate limit status of a single token.
+type quota struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+	Resource  string    `json:"resource"`
+
+	// BlockedUntil is set when hitting a secondary rate limit.
+	BlockedUntil time.Time `json:"blocked_until,omitempty"`
+}
+
+func newRateLimiter(cfg RateLimitConfig, log Logger) *rateLimiter {
+	return &rateLimiter{
+		cfg:    cfg,
+		log:    log,
+		quotas: make(map[string]*quota),
+		now:    time.Now,
+		sleep:  sleep,
+	}
+}
+
+// rateLimiter tracks the quota per token, as reported by the rate limit headers
+// of the responses, and holds back requests once the quota runs low.
+type rateLimiter struct {
+	cfg    RateLimitConfig
+	log    Logger
+	mu     sync.Mutex
+	quotas map[string]*quota
+	now    func() time.Time
+	sleep  func(ctx context.Context, d time.Duration) error
+}
+
+// wait blocks until the token is allowed to make another request, or returns
+// an error if that would take too long.
+func (r *rateLimiter) wait(ctx context.Context, token string) error {
+	r.mu.Lock()
+	var until time.Time
+	if q, ok := r.quotas[token]; ok {
+		now := r.now()
+		if q.BlockedUntil.After(now) {
+			until = q.BlockedUntil
+		} else if q.Limit > 0 && q.Remaining <= r.cfg.MinRemaining && q.Reset.After(now) {
+			until = q.Reset
+		}
+	}
+	r.mu.Unlock()
+
+	if until.IsZero() {
+		return nil
+	}
+
+	d := until.Sub(r.now())
+	if d > r.cfg.MaxWait {
+		metrics.Add("rate_limited", 1)
+		return &httpErr{
+			code: http.StatusTooManyRequests,
+			msg:  fmt.Sprintf("rate limit exceeded, resets at %s", until.Format(time.RFC3339)),
+		}
+	}
+
+	r.log.Info("waiting for github rate limit", "token", token, "wait", d)
+	metrics.Add("rate_limit_waits", 1)
+	return r.sleep(ctx, d)
+}
+
+// update records the quota reported by the response.
+func (r *rateLimiter) update(token string, res *http.Response) {
+	limit, err := strconv.Atoi(res.Header.Get("X-RateLimit-Limit"))
+	if err != nil {
+		// Unauthenticated, or unlimited as on some GitHub Enterprise Servers.
+		return
+	}
+	remaining, _ := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	reset, _ := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q, ok := r.quotas[token]
+	if !ok {
+		q = r.add(token)
+	}
+	wasLow := ok && r.low(q.Remaining, q.Limit)
+	q.Limit = limit
+	q.Remaining = remaining
+	q.Reset = time.Unix(reset, 0)
+	q.Resource = res.Header.Get("X-RateLimit-Resource")
+
+	// Only log once the quota runs low, rather than on every request.
+	if !wasLow && r.low(remaining, limit) {
+		r.log.Info("github rate limit low", "token", token, "resource", q.Resource,
+			"remaining", remaining, "limit", limit, "reset", q.Reset)
+	}
+}
+
+// add starts tracking the quota of a token. The quotas that have reset, and
+// aren't blocked, are dropped to make room, since they hold nothing that the
+// next response won't tell. If there are still too many, the ones that reset
+// the soonest go first. The lock must be held.
+func (r *rateLimiter) add(token string) *quota {
+	now := r.now()
+	for t, q := range r.quotas {
+		if !q.expires().After(now) {
+			delete(r.quotas, t)
+		}
+	}
+	for len(r.quotas) >= maxQuotas {
+		var (
+			oldest string
+			first  time.Time
+		)
+		for t, q := range r.quotas {
+			if oldest == "" || q.expires().Before(first) {
+				oldest, first = t, q.expires()
+			}
+		}
+		delete(r.quotas, oldest)
+	}
+
+	q := &quota{}
+	r.quotas[token] = q
+	return q
+}
+
+// expires returns when the quota no longer holds back any requests.
+func (q *quota) expires() time.Time {
+	if q.BlockedUntil.After(q.Reset) {
+		return q.BlockedUntil
+	}
+	return q.Reset
+}
+
+// low checks if the quota is running low, i.e. below a tenth of the limit, or
+// the configured minimum.
+func (r *rateLimiter) low(remaining, limit int) bool {
+	return remaining <= r.cfg.MinRemaining || remaining < limit/10
+}
+
+// limited checks if the response is due to a rate limit, in which case the
+// token is blocked until it may make requests again. A 403 is only considered
+// a rate limit if the headers say so, since it's also used for permissions.
+func (r *rateLimiter) limited(token string, res *http.Response) bool {
+	now := r.now()
+	exhausted := res.Header.Get("X-RateLimit-Remaining") == "0"
+	delay, hasDelay := retryAfter(res.Header, now)
+
+	switch res.StatusCode {
+	case http.StatusTooManyRequests:
+	case http.StatusForbidden:
+		if !exhausted && !hasDelay {
+			return false
+		}
+	default:
+		return false
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	q, ok := r.quotas[token]
+	if !ok {
+		q = r.add(token)
+	}
+	switch {
+	case hasDelay:
+		q.BlockedUntil = now.Add(delay)
+	case !exhausted:
+		q.BlockedUntil = now.Add(secondaryBackoff)
+	}
+	// Otherwise the primary quota has been exhausted, and the update of the
+	// quota has already recorded when it resets.
+
+	metrics.Add("rate_limited", 1)
+	r.log.Info("github rate limit exceeded", "token", token, "status", res.StatusCode,
+		"blocked_until", q.BlockedUntil, "reset", q.Reset)
+	return true
+}
+
+// snapshot returns a copy of the quotas, for the metrics.
+func (r *rateLimiter) snapshot() any {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	quotas := make(map[string]quota, len(r.quotas))
+	for token, q := range r.quotas {
+		quotas[token] = *q
+	}
+	return quotas
+}
+
+// retryAfter parses the Retry-After header, in either of its forms.
+func retryAfter(h http.Header, now time.Time) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+	if v == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(v); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(v); err == nil {
+		if d := t.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// fingerprint identifies a token in logs and metrics, without revealing it.
+func fingerprint(token string) string {
+	if token == "" {
+		return "anonymous"
+	}
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// hostOf returns the host of the base URL, used to tell the hosts apart on
+// disk, and in the metrics of hosts without a name.
+func hostOf(base string) string {
+	if u, err := url.Parse(base); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return base
+}
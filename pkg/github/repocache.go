@@ -0,0 +1,359 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/archive"
+)
+
+type TarballCacheConfig struct {
+	// Dir is where the tarballs of repositories are extracted, once per
+	// commit, so that all modules tagged on the same commit are served from a
+	// single download. The cache is disabled unless set.
+	Dir string `envconfig:"TARBALL_CACHE_DIR"`
+
+	// MaxCommits is the number of extracted commits to keep, removing the
+	// least recently used ones first.
+	MaxCommits int `envconfig:"TARBALL_CACHE_MAX_COMMITS" default:"20"`
+}
+
+func newRepoCache(cfg TarballCacheConfig, log Logger) *repoCache {
+	return &repoCache{
+		cfg:  cfg,
+		log:  log,
+		busy: make(map[string]chan struct{}),
+		used: make(map[string]int),
+		now:  time.Now,
+	}
+}
+
+// repoCache keeps the contents of repositories on disk, extracted from their
+// tarballs and addressed by commit, since a commit never changes.
+type repoCache struct {
+	cfg  TarballCacheConfig
+	log  Logger
+	mu   sync.Mutex
+	busy map[string]chan struct{}
+	used map[string]int // Readers of each commit, which mustn't be evicted.
+	now  func() time.Time
+}
+
+// path returns the directory of the commit.
+func (c *repoCache) path(host, owner, repo, sha string) string {
+	return filepath.Join(c.cfg.Dir, host, owner, repo, sha)
+}
+
+// fill makes sure that the directory exists, using the fill function to
+// populate it otherwise. The directory is populated in a temporary location,
+// and moved into place once complete. It is kept from being evicted until the
+// returned release function is called, once done reading it.
+func (c *repoCache) fill(ctx context.Context, dir string, fill func(tmp string) error) (func(), error) {
+	unlock, err := c.lock(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if _, err := os.Stat(dir); err == nil {
+		// Keep track of when the commit was last used, for the eviction.
+		now := c.now()
+		os.Chtimes(dir, now, now)
+		metrics.Add("tarball_cache_hits", 1)
+		return c.acquire(dir), nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dir), 0o755); err != nil {
+		return nil, fmt.Errorf("creating cache dir: %w", err)
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(dir), ".tmp-")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+	if err := fill(tmp); err != nil {
+		os.RemoveAll(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		os.RemoveAll(tmp)
+		return nil, fmt.Errorf("moving into cache: %w", err)
+	}
+	metrics.Add("tarball_cache_misses", 1)
+
+	release := c.acquire(dir)
+	c.evict()
+	return release, nil
+}
+
+// acquire marks the directory as being read. It must only be called while
+// holding the lock of the directory, so that it can't be evicted in between.
+func (c *repoCache) acquire(dir string) func() {
+	c.mu.Lock()
+	c.used[dir]++
+	c.mu.Unlock()
+
+	return func() {
+		c.mu.Lock()
+		if c.used[dir]--; c.used[dir] == 0 {
+			delete(c.used, dir)
+		}
+		c.mu.Unlock()
+	}
+}
+
+// lock makes sure that only a single request populates a directory at a time,
+// while the others wait for it to finish.
+func (c *repoCache) lock(ctx context.Context, key string) (func(), error) {
+	for {
+		unlock, ch := c.tryLock(key)
+		if unlock != nil {
+			return unlock, nil
+		}
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryLock takes the lock of the key, unless it's busy, in which case it returns
+// a channel that is closed once the lock is released.
+func (c *repoCache) tryLock(key string) (func(), <-chan struct{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if ch, busy := c.busy[key]; busy {
+		return nil, ch
+	}
+	ch := make(chan struct{})
+	c.busy[key] = ch
+	return func() {
+		c.mu.Lock()
+		delete(c.busy, key)
+		c.mu.Unlock()
+		close(ch)
+	}, nil
+}
+
+// evict removes the least recently used commits, once there are too many.
+// Commits that are being filled, or read, are skipped, and left for a later
+// eviction.
+func (c *repoCache) evict() {
+	if c.cfg.MaxCommits <= 0 {
+		return
+	}
+
+	// The commits are kept in <host>/<owner>/<repo>/<sha>.
+	dirs, err := filepath.Glob(filepath.Join(c.cfg.Dir, "*", "*", "*", "*"))
+	if err != nil {
+		return
+	}
+
+	type commit struct {
+		dir  string
+		used time.Time
+	}
+	var commits []commit
+	for _, dir := range dirs {
+		if strings.HasPrefix(filepath.Base(dir), ".tmp-") {
+			continue
+		}
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() {
+			continue
+		}
+		commits = append(commits, commit{dir, fi.ModTime()})
+	}
+	if len(commits) <= c.cfg.MaxCommits {
+		return
+	}
+
+	sort.Slice(commits, func(i, j int) bool {
+		return commits[i].used.After(commits[j].used)
+	})
+	for _, old := range commits[c.cfg.MaxCommits:] {
+		unlock, _ := c.tryLock(old.dir)
+		if unlock == nil {
+			continue
+		}
+		c.mu.Lock()
+		used := c.used[old.dir] > 0
+		c.mu.Unlock()
+		if !used {
+			if err := os.RemoveAll(old.dir); err != nil {
+				c.log.Error("evicting commit", "dir", old.dir, "err", err)
+			}
+		}
+		unlock()
+	}
+}
+
+// fetchCached resolves the tag to a commit, and serves the module from the
+// extracted tarball of that commit, downloading it if needed.
+func (s *Service) fetchCached(ctx context.Context, owner, repo, dir, tag string, w io.Writer) error {
+	c, err := s.commit(ctx, owner, repo, tag)
+	if err != nil {
+		return err
+	}
+
+	root := s.repos.path(hostOf(s.url("")), owner, repo, c.SHA)
+	release, err := s.repos.fill(ctx, root, func(tmp string) error {
+		uri := fmt.Sprintf("repos/%s/%s/tarball/%s", owner, repo, c.SHA)
+		body, err := s.makeRequest(ctx, uri)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return fmt.Errorf("read gzip: %w", err)
+		}
+		defer zr.Close()
+
+		return extract(tar.NewReader(zr), tmp)
+	})
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// The repository may have symlinks in the path of the module, which are
+	// fine as long as they stay within the repository.
+	src, err := resolveWithin(root, filepath.FromSlash(dir))
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(src); err != nil || !fi.IsDir() {
+		return &httpErr{
+			code: http.StatusNotFound,
+			msg:  fmt.Sprintf("module directory not found: %s", dir),
+		}
+	}
+
+	aw, err := archive.NewWriter(archive.Default, w)
+	if err != nil {
+		return err
+	}
+
+	if err := archive.CopyTree(aw, src, c.Commit.Committer.Date); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// resolveWithin resolves any symlinks of the path, relative to the root, and
+// makes sure that it doesn't end up outside of the root.
+func resolveWithin(root, name string) (string, error) {
+	notFound := &httpErr{
+		code: http.StatusNotFound,
+		msg:  fmt.Sprintf("module directory not found: %s", filepath.ToSlash(name)),
+	}
+
+	base, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("resolving cache dir: %w", err)
+	}
+	p, err := filepath.EvalSymlinks(filepath.Join(base, name))
+	if err != nil {
+		return "", notFound
+	}
+	rel, err := filepath.Rel(base, p)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", notFound
+	}
+	return p, nil
+}
+
+// extract writes the entries of a repository tarball to the directory, with
+// the top-level directory stripped. Entries are not allowed to escape the
+// directory, neither by name nor through symlinks.
+func extract(r *tar.Reader, dir string) error {
+	links := map[string]bool{}
+	for {
+		hdr, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("reading tar: %w", err)
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+
+		_, name, ok := strings.Cut(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if !ok {
+			continue
+		}
+		name = strings.TrimSuffix(name, "/")
+		if name == "" {
+			continue
+		}
+		if !fs.ValidPath(name) {
+			return fmt.Errorf("invalid path in tar: %s", hdr.Name)
+		}
+		for p := path.Dir(name); p != "."; p = path.Dir(p) {
+			if links[p] {
+				return fmt.Errorf("path through symlink in tar: %s", hdr.Name)
+			}
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := writeFile(target, r, hdr.FileInfo().Mode().Perm()); err != nil {
+				return fmt.Errorf("writing %s: %w", name, err)
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+			links[name] = true
+		}
+	}
+}
+
+func writeFile(name string, r io.Reader, perm fs.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	// Make sure the mode isn't affected by the umask.
+	return os.Chmod(name, perm)
+}
@@ -0,0 +1,200 @@
+package github
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTarballCache(t *testing.T) {
+	var tarballs int
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repos/acme/infra/commits/tags/{tag...}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sha":"abc","commit":{"committer":{"date":"2023-05-01T12:00:00Z"}}}`))
+	})
+	mux.HandleFunc("GET /repos/acme/infra/tarball/abc", func(w http.ResponseWriter, r *http.Request) {
+		tarballs++
+		w.Write(makeTarball(t, []tar.Header{
+			{Name: "pax_global_header", Typeflag: tar.TypeXGlobalHeader},
+			{Name: "acme-infra-abc/", Typeflag: tar.TypeDir, Mode: 0o775},
+			{Name: "acme-infra-abc/modules/vpc/", Typeflag: tar.TypeDir, Mode: 0o775},
+			{Name: "acme-infra-abc/modules/vpc/main.tf", Typeflag: tar.TypeReg, Mode: 0o664},
+			{Name: "acme-infra-abc/modules/sg/", Typeflag: tar.TypeDir, Mode: 0o775},
+			{Name: "acme-infra-abc/modules/sg/main.tf", Typeflag: tar.TypeReg, Mode: 0o664},
+			{Name: "acme-infra-abc/modules/sg/vpc.tf", Typeflag: tar.TypeSymlink, Linkname: "../vpc/main.tf"},
+		}))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := Config{
+		BaseURL:      srv.URL,
+		PathTemplate: "modules/{module}",
+		TarballCache: TarballCacheConfig{Dir: t.TempDir(), MaxCommits: 5},
+	}
+	s := New(cfg, srv.Client(), slog.Default())
+
+	tests := []struct {
+		module string
+		exp    []string
+	}{
+		{"vpc", []string{"main.tf 664 modules/vpc/main.tf"}},
+		// The symlink points outside of the module, so it's left out.
+		{"sg", []string{"main.tf 664 modules/sg/main.tf"}},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		if err := s.ProxyDownload(context.Background(), "acme", "infra", tt.module, "1.0.0", &buf); err != nil {
+			t.Fatalf("%s: proxy download: %s", tt.module, err)
+		}
+		if got := listArchive(t, &buf); !reflect.DeepEqual(got, tt.exp) {
+			t.Errorf("%s: unexpected archive, exp: %q, got: %q", tt.module, tt.exp, got)
+		}
+	}
+	if tarballs != 1 {
+		t.Errorf("unexpected number of tarball downloads, exp: 1, got: %d", tarballs)
+	}
+}
+
+func TestTarballCacheEviction(t *testing.T) {
+	c := newRepoCache(TarballCacheConfig{Dir: t.TempDir(), MaxCommits: 1}, slog.Default())
+	fill := func(sha string, age time.Duration) (string, func()) {
+		t.Helper()
+		dir := c.path("github.com", "acme", "infra", sha)
+		release, err := c.fill(context.Background(), dir, func(tmp string) error {
+			return os.WriteFile(filepath.Join(tmp, "main.tf"), nil, 0o644)
+		})
+		if err != nil {
+			t.Fatalf("fill %s: %s", sha, err)
+		}
+		used := time.Now().Add(-age)
+		os.Chtimes(dir, used, used)
+		return dir, release
+	}
+	exists := func(dir string) bool {
+		_, err := os.Stat(dir)
+		return err == nil
+	}
+
+	// The oldest commit is still being read, so it's kept for now.
+	a, releaseA := fill("a", 2*time.Hour)
+	b, releaseB := fill("b", time.Hour)
+	releaseB()
+	if !exists(a) || !exists(b) {
+		t.Fatalf("expected both commits to be kept")
+	}
+
+	releaseA()
+	latest, releaseC := fill("c", 0)
+	releaseC()
+	if exists(a) || exists(b) || !exists(latest) {
+		t.Errorf("expected only the latest commit to be kept")
+	}
+}
+
+func TestExtractThroughSymlink(t *testing.T) {
+	b := makeTarball(t, []tar.Header{
+		{Name: "repo/link", Typeflag: tar.TypeSymlink, Linkname: "/tmp"},
+		{Name: "repo/link/evil", Typeflag: tar.TypeReg, Mode: 0o664},
+	})
+	zr, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("read gzip: %s", err)
+	}
+	if err := extract(tar.NewReader(zr), t.TempDir()); err == nil {
+		t.Errorf("expected extraction through a symlink to fail")
+	}
+}
+
+func TestTarballCacheSymlinkedDir(t *testing.T) {
+	// A directory outside of the repository, that must not be served.
+	outside := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(outside, "vpc"), 0o755); err != nil {
+		t.Fatalf("mkdir: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(outside, "vpc", "secret"), []byte("secret"), 0o644); err != nil {
+		t.Fatalf("write file: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /repos/acme/{repo}/commits/tags/{tag...}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"sha":"abc","commit":{"committer":{"date":"2023-05-01T12:00:00Z"}}}`))
+	})
+	mux.HandleFunc("GET /repos/acme/evil/tarball/abc", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(makeTarball(t, []tar.Header{
+			{Name: "acme-evil-abc/", Typeflag: tar.TypeDir, Mode: 0o775},
+			{Name: "acme-evil-abc/modules", Typeflag: tar.TypeSymlink, Linkname: outside},
+		}))
+	})
+	mux.HandleFunc("GET /repos/acme/infra/tarball/abc", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(makeTarball(t, []tar.Header{
+			{Name: "acme-infra-abc/", Typeflag: tar.TypeDir, Mode: 0o775},
+			{Name: "acme-infra-abc/src/vpc/", Typeflag: tar.TypeDir, Mode: 0o775},
+			{Name: "acme-infra-abc/src/vpc/main.tf", Typeflag: tar.TypeReg, Mode: 0o664},
+			{Name: "acme-infra-abc/modules", Typeflag: tar.TypeSymlink, Linkname: "src"},
+		}))
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	cfg := Config{
+		BaseURL:      srv.URL,
+		PathTemplate: "modules/{module}",
+		TarballCache: TarballCacheConfig{Dir: t.TempDir(), MaxCommits: 5},
+	}
+	s := New(cfg, srv.Client(), slog.Default())
+
+	var buf bytes.Buffer
+	err := s.ProxyDownload(context.Background(), "acme", "evil", "vpc", "1.0.0", &buf)
+	if e, ok := err.(*httpErr); !ok || e.StatusCode() != http.StatusNotFound {
+		t.Errorf("expected a module outside of the repository to not be found, got: %v", err)
+	}
+	if buf.Len() > 0 {
+		t.Errorf("expected nothing to be written, got %d bytes", buf.Len())
+	}
+
+	// Symlinks within the repository are still followed.
+	buf.Reset()
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+	if got, exp := listArchive(t, &buf), []string{"main.tf 664 src/vpc/main.tf"}; !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected archive, exp: %q, got: %q", exp, got)
+	}
+}
+
+// makeTarball creates a gzipped tarball of the entries, with the name of each
+// regular file, less the top-level directory, as its contents.
+func makeTarball(t *testing.T, entries []tar.Header) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range entries {
+		var body []byte
+		if hdr.Typeflag == tar.TypeReg {
+			_, name, _ := bytes.Cut([]byte(hdr.Name), []byte("/"))
+			body = name
+			hdr.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatalf("write header: %s", err)
+		}
+		tw.Write(body)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("close tar: %s", err)
+	}
+	zw.Close()
+	return buf.Bytes()
+}
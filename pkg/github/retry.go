@@ -0,0 +1,190 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type RetryConfig struct {
+	// MaxAttempts is the total number of attempts made for idempotent
+	// requests that fail with a network error, a 5xx or a 429 response.
+	MaxAttempts int           `envconfig:"RETRY_MAX_ATTEMPTS" default:"3"`
+	BaseDelay   time.Duration `envconfig:"RETRY_BASE_DELAY" default:"250ms"`
+	MaxDelay    time.Duration `envconfig:"RETRY_MAX_DELAY" default:"5s"`
+
+	// BreakerThreshold is the number of consecutive failed requests that
+	// opens the circuit, making requests fail fast for BreakerCooldown before
+	// letting a single request through to probe the upstream.
+	BreakerThreshold int           `envconfig:"BREAKER_THRESHOLD" default:"5"`
+	BreakerCooldown  time.Duration `envconfig:"BREAKER_COOLDOWN" default:"30s"`
+}
+
+func (c *RetryConfig) enabled() bool {
+	return c.MaxAttempts > 1 || c.BreakerThreshold > 0
+}
+
+// NewRetryClient wraps the client with retries, using exponential backoff with
+// full jitter, and a circuit breaker.
+func NewRetryClient(c HTTPClient, cfg RetryConfig, log Logger) *RetryClient {
+	return &RetryClient{
+		cfg:    cfg,
+		client: c,
+		log:    log,
+		now:    time.Now,
+		rand:   rand.Int63n,
+	}
+}
+
+type RetryClient struct {
+	cfg    RetryConfig
+	client HTTPClient
+	log    Logger
+	now    func() time.Time
+	rand   func(n int64) int64
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+func (c *RetryClient) Do(req *http.Request) (*http.Response, error) {
+	if err := c.allow(); err != nil {
+		return nil, err
+	}
+
+	attempts := c.cfg.MaxAttempts
+	if !idempotent(req) || attempts < 1 {
+		attempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		res, err := c.client.Do(req)
+		if !retryable(res, err) {
+			c.record(true)
+			return res, err
+		}
+		if attempt >= attempts || req.Context().Err() != nil {
+			c.record(res != nil && res.StatusCode == http.StatusTooManyRequests)
+			return res, err
+		}
+
+		delay := c.backoff(attempt)
+		if res != nil {
+			if d, ok := retryAfter(res.Header, c.now()); ok {
+				if d > c.cfg.MaxDelay {
+					// No point in waiting that long, so let the caller
+					// deal with the response.
+					c.record(true)
+					return res, err
+				}
+				delay = d
+			}
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}
+
+		c.log.Info("retrying github request", "url", req.URL.String(), "attempt", attempt,
+			"delay", delay, "status", statusOf(res), "err", err)
+		metrics.Add("retries", 1)
+		if err := sleep(req.Context(), delay); err != nil {
+			// Otherwise a cancelled probe would keep the circuit open.
+			c.record(false)
+			return nil, err
+		}
+	}
+}
+
+// allow checks if the circuit is closed, or if it's time to probe whether the
+// upstream has recovered.
+func (c *RetryClient) allow() error {
+	if c.cfg.BreakerThreshold <= 0 {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failures < c.cfg.BreakerThreshold {
+		return nil
+	}
+	if c.now().After(c.openUntil) && !c.probing {
+		c.probing = true
+		return nil
+	}
+
+	metrics.Add("circuit_open", 1)
+	return &httpErr{
+		code: http.StatusServiceUnavailable,
+		msg:  fmt.Sprintf("circuit open until %s", c.openUntil.Format(time.RFC3339)),
+	}
+}
+
+// record the outcome of a request, opening or closing the circuit.
+func (c *RetryClient) record(ok bool) {
+	if c.cfg.BreakerThreshold <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.probing = false
+	if ok {
+		if c.failures >= c.cfg.BreakerThreshold {
+			c.log.Info("github circuit closed")
+		}
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.failures >= c.cfg.BreakerThreshold {
+		c.openUntil = c.now().Add(c.cfg.BreakerCooldown)
+		c.log.Error("github circuit open", "failures", c.failures, "until", c.openUntil)
+	}
+}
+
+// backoff returns a random delay between zero and the exponential backoff of
+// the attempt, capped by the max delay.
+func (c *RetryClient) backoff(attempt int) time.Duration {
+	d := c.cfg.BaseDelay << (attempt - 1)
+	if d > c.cfg.MaxDelay || d <= 0 {
+		d = c.cfg.MaxDelay
+	}
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(c.rand(int64(d) + 1))
+}
+
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return req.Body == nil || req.Body == http.NoBody
+	default:
+		return false
+	}
+}
+
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+func statusOf(res *http.Response) int {
+	if res == nil {
+		return 0
+	}
+	return res.StatusCode
+}
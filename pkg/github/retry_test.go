@@ -0,0 +1,138 @@
+package github
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	var requests int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch requests {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.Write([]byte(`[{"ref":"refs/tags/vpc/1.0.0"}]`))
+		}
+	}))
+	defer srv.Close()
+
+	cfg := Config{
+		BaseURL: srv.URL,
+		Retry:   RetryConfig{MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	}
+	s := New(cfg, srv.Client(), slog.Default())
+	versions, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if !reflect.DeepEqual(versions, []string{"1.0.0"}) {
+		t.Errorf("unexpected versions: %v", versions)
+	}
+	if requests != 3 {
+		t.Errorf("unexpected number of requests, exp: 3, got: %d", requests)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var (
+		requests int
+		healthy  bool
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !healthy {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer srv.Close()
+
+	cfg := Config{
+		BaseURL: srv.URL,
+		Retry:   RetryConfig{MaxAttempts: 1, BreakerThreshold: 2, BreakerCooldown: time.Minute},
+	}
+	now := time.Now()
+	s := New(cfg, srv.Client(), slog.Default())
+	s.client.(*RetryClient).now = func() time.Time { return now }
+
+	list := func() error {
+		_, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+		return err
+	}
+	for n := 0; n < 4; n++ {
+		list()
+	}
+	if requests != 2 {
+		t.Errorf("unexpected number of requests while open, exp: 2, got: %d", requests)
+	}
+	if e, ok := list().(*httpErr); !ok || e.StatusCode() != http.StatusServiceUnavailable {
+		t.Errorf("expected the circuit to be open, got: %v", e)
+	}
+
+	// Once cooled down, a probe closes the circuit again.
+	now = now.Add(2 * time.Minute)
+	healthy = true
+	if err := list(); err != nil {
+		t.Fatalf("probe: %s", err)
+	}
+	if err := list(); err != nil {
+		t.Errorf("expected the circuit to be closed: %s", err)
+	}
+	if requests != 4 {
+		t.Errorf("unexpected number of requests, exp: 4, got: %d", requests)
+	}
+}
+
+func TestCircuitBreakerCancelledProbe(t *testing.T) {
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	cfg := RetryConfig{MaxAttempts: 2, BaseDelay: time.Hour, MaxDelay: time.Hour, BreakerThreshold: 1, BreakerCooldown: time.Minute}
+	now := time.Now()
+	c := NewRetryClient(srv.Client(), cfg, slog.Default())
+	c.now = func() time.Time { return now }
+	c.rand = func(n int64) int64 { return n - 1 }
+
+	do := func(ctx context.Context, method string) error {
+		req, _ := http.NewRequestWithContext(ctx, method, srv.URL, nil)
+		res, err := c.Do(req)
+		if err == nil {
+			res.Body.Close()
+		}
+		return err
+	}
+
+	// A request that isn't retried opens the circuit.
+	do(context.Background(), http.MethodPost)
+
+	// The probe gives up while waiting to retry, which must not leave the
+	// circuit stuck waiting for it.
+	now = now.Add(2 * time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := do(ctx, http.MethodGet); err == nil {
+		t.Fatalf("expected the probe to be cancelled")
+	}
+
+	now = now.Add(2 * time.Minute)
+	do(context.Background(), http.MethodPost)
+	if n := requests.Load(); n != 3 {
+		t.Errorf("unexpected number of requests, exp: 3, got: %d", n)
+	}
+}
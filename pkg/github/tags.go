@@ -0,0 +1,19 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package github
+
+import (
+	"github.com/hedlund/orbit/pkg/layout"
+)
+
+// tagScheme returns the tag naming scheme of the module, using the template
+// configured for the repository, or the default one.
+func (s *Service) tagScheme(owner, repo, module string) layout.TagScheme {
+	template := s.cfg.TagTemplate
+	if t, ok := s.cfg.TagTemplates[owner+"/"+repo]; ok {
+		template = t
+	}
+	return layout.NewTagScheme(template, module)
+}
@@ -0,0 +1,272 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package gitlab
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/archive"
+	"github.com/hedlund/orbit/pkg/auth"
+	"github.com/hedlund/orbit/pkg/backend"
+	"github.com/hedlund/orbit/services/modules"
+)
+
+const (
+	defaultBaseURL = "https://gitlab.com/api/v4/"
+	tagsPerPage    = 100
+)
+
+type Config struct {
+	// BaseURL of the REST API, which for self-managed instances is usually
+	// `https://<hostname>/api/v4/`.
+	BaseURL string `envconfig:"BASE_URL" default:"https://gitlab.com/api/v4/"`
+
+	// Token is a personal, group or project access token, used for requests
+	// that don't carry a token of their own.
+	Token string `envconfig:"TOKEN"`
+
+	// GroupMappings maps the system of a module to a group, which may be a
+	// subgroup such as `acme/platform`. Unless mapped, the system is used as
+	// the group, with any GroupSeparator replaced by slashes, so that e.g.
+	// `acme--platform` can refer to the same subgroup.
+	GroupMappings  map[string]string `envconfig:"GROUP_MAPPINGS"`
+	GroupSeparator string            `envconfig:"GROUP_SEPARATOR"`
+
+	// Projects limits the projects that may be served, keyed by group.
+	Projects map[string][]string `envconfig:"PROJECTS"`
+
+	// Templates are keyed by `group/project` when overridden per project.
+	backend.Templates
+}
+
+// Validate checks that the base URL and the configured templates are usable.
+func (c *Config) Validate() error {
+	if c.BaseURL != "" {
+		if err := backend.ValidBaseURL(c.BaseURL); err != nil {
+			return err
+		}
+	}
+	return c.Templates.Validate()
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+func New(cfg Config, c HTTPClient, log Logger) *Service {
+	return &Service{
+		cfg:    cfg,
+		client: c,
+		log:    log,
+	}
+}
+
+type Service struct {
+	cfg    Config
+	client HTTPClient
+	log    Logger
+}
+
+// https://docs.gitlab.com/ee/api/tags.html#list-project-repository-tags
+func (s *Service) ListVersions(ctx context.Context, system, project, module string) ([]string, error) {
+	group := s.mapGroup(system)
+	if err := s.validProject(group, project); err != nil {
+		return nil, err
+	}
+
+	var (
+		page     = 1
+		scheme   = s.cfg.TagScheme(group, project, module)
+		versions = []string{}
+	)
+	for {
+		q := url.Values{}
+		q.Set("per_page", fmt.Sprint(tagsPerPage))
+		q.Set("page", fmt.Sprint(page))
+		if scheme.Prefix != "" {
+			// Only list the tags of the module, rather than every tag.
+			q.Set("search", "^"+scheme.Prefix)
+		}
+		uri := fmt.Sprintf("projects/%s/repository/tags?%s", projectID(group, project), q.Encode())
+		res, err := s.makeRequest(ctx, uri)
+		if err != nil {
+			return nil, err
+		}
+
+		var tags []struct {
+			Name string `json:"name"`
+		}
+		err = json.NewDecoder(res).Decode(&tags)
+		res.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+
+		for _, tag := range tags {
+			if version, ok := scheme.Version(tag.Name); ok {
+				versions = append(versions, version)
+			}
+		}
+
+		if len(tags) < tagsPerPage {
+			break
+		}
+		page++
+	}
+	return versions, nil
+}
+
+// https://docs.gitlab.com/ee/api/repositories.html#get-file-archive
+func (s *Service) ProxyDownload(ctx context.Context, system, project, module, version string, w io.Writer) error {
+	group := s.mapGroup(system)
+	if err := s.validProject(group, project); err != nil {
+		return err
+	}
+
+	dir, err := s.cfg.ModulePath(group, project, module)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	q.Set("sha", s.cfg.TagScheme(group, project, module).Tag(version))
+	if dir != "" {
+		// Limit the archive to the module, but it still contains the full
+		// path of the directory.
+		q.Set("path", dir)
+	}
+	uri := fmt.Sprintf("projects/%s/repository/archive.tar.gz?%s", projectID(group, project), q.Encode())
+	body, err := s.makeRequest(ctx, uri)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	zr, err := gzip.NewReader(body)
+	if err != nil {
+		return fmt.Errorf("read gzip: %w", err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	aw, err := archive.NewWriter(archive.Default, w)
+	if err != nil {
+		return err
+	}
+
+	if err := archive.CopyDir(aw, tr, dir); err != nil {
+		return err
+	}
+	return aw.Close()
+}
+
+// https://docs.gitlab.com/ee/api/tags.html#get-a-single-repository-tag
+func (s *Service) DescribeVersion(ctx context.Context, system, project, module, version string) (*modules.VersionDetails, error) {
+	group := s.mapGroup(system)
+	if err := s.validProject(group, project); err != nil {
+		return nil, err
+	}
+
+	tag := s.cfg.TagScheme(group, project, module).Tag(version)
+	uri := fmt.Sprintf("projects/%s/repository/tags/%s", projectID(group, project), url.PathEscape(tag))
+	res, err := s.makeRequest(ctx, uri)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var t struct {
+		Commit struct {
+			ID            string    `json:"id"`
+			CommittedDate time.Time `json:"committed_date"`
+		} `json:"commit"`
+	}
+	if err := json.NewDecoder(res).Decode(&t); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	return &modules.VersionDetails{
+		Commit:      t.Commit.ID,
+		PublishedAt: t.Commit.CommittedDate,
+	}, nil
+}
+
+// CheckAccess checks that the caller can read the project.
+// https://docs.gitlab.com/ee/api/projects.html#get-single-project
+func (s *Service) CheckAccess(ctx context.Context, system, project string) error {
+	group := s.mapGroup(system)
+	if err := s.validProject(group, project); err != nil {
+		return err
+	}
+
+	res, err := s.makeRequest(ctx, "projects/"+projectID(group, project))
+	if err != nil {
+		return err
+	}
+	return res.Close()
+}
+
+func (s *Service) makeRequest(ctx context.Context, uri string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.url(uri), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	// Personal, group and project access tokens are all passed the same way.
+	if token := auth.GetToken(ctx, s.cfg.Token); token != "" {
+		req.Header.Add("PRIVATE-TOKEN", token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, backend.ResponseError(res)
+	}
+
+	return res.Body, nil
+}
+
+// url returns the full URL of the API endpoint, relative to the base URL.
+func (s *Service) url(uri string) string {
+	base := s.cfg.BaseURL
+	if base == "" {
+		base = defaultBaseURL
+	}
+	return backend.JoinURL(base, uri)
+}
+
+func (s *Service) mapGroup(system string) string {
+	if _, ok := s.cfg.GroupMappings[system]; !ok && s.cfg.GroupSeparator != "" {
+		return strings.ReplaceAll(system, s.cfg.GroupSeparator, "/")
+	}
+	return backend.MapOwner(s.cfg.GroupMappings, system)
+}
+
+func (s *Service) validProject(group, project string) error {
+	return backend.Allowed(s.cfg.Projects, group, project)
+}
+
+// projectID returns the URL-encoded path of the project, which the API accepts
+// in place of its numeric ID.
+func projectID(group, project string) string {
+	return url.PathEscape(group + "/" + project)
+}
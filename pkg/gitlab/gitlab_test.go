@@ -0,0 +1,109 @@
+package gitlab
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/hedlund/orbit/pkg/backend"
+)
+
+const project = "/api/v4/projects/acme%2Fplatform%2Finfra/repository"
+
+func TestListVersions(t *testing.T) {
+	srv := fakeGitLab(t)
+	s := New(Config{
+		BaseURL:        srv.URL + "/api/v4/",
+		Token:          "glpat-secret",
+		GroupSeparator: "--",
+	}, srv.Client(), slog.Default())
+
+	versions, err := s.ListVersions(context.Background(), "acme--platform", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0", "1.1.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+
+	// Without a token, the project isn't found.
+	s.cfg.Token = ""
+	if _, err := s.ListVersions(context.Background(), "acme--platform", "infra", "vpc"); err == nil {
+		t.Errorf("expected an error without a token")
+	}
+}
+
+func TestProxyDownload(t *testing.T) {
+	srv := fakeGitLab(t)
+	s := New(Config{
+		BaseURL:       srv.URL + "/api/v4",
+		Token:         "glpat-secret",
+		GroupMappings: map[string]string{"acme": "acme/platform"},
+		Templates:     backend.Templates{PathTemplate: "modules/{module}"},
+	}, srv.Client(), slog.Default())
+
+	var buf bytes.Buffer
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.1.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("read gzip: %s", err)
+	}
+	tr := tar.NewReader(zr)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("read tar: %s", err)
+	}
+	b, _ := io.ReadAll(tr)
+	if hdr.Name != "main.tf" || string(b) != "# vpc" {
+		t.Errorf("unexpected entry %s: %q", hdr.Name, b)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("expected a single entry: %v", err)
+	}
+}
+
+// fakeGitLab serves the tags and archives of the `acme/platform/infra` project,
+// as long as the request carries the right token.
+func fakeGitLab(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("PRIVATE-TOKEN") != "glpat-secret" {
+			http.NotFound(w, r)
+			return
+		}
+
+		switch r.URL.EscapedPath() {
+		case project + "/tags":
+			if r.URL.Query().Get("search") != "^vpc/" {
+				t.Errorf("unexpected search: %s", r.URL.Query().Get("search"))
+			}
+			w.Write([]byte(`[{"name":"vpc/1.0.0"},{"name":"vpc/1.1.0"}]`))
+		case project + "/archive.tar.gz":
+			if q := r.URL.Query(); q.Get("sha") != "vpc/1.1.0" || q.Get("path") != "modules/vpc" {
+				t.Errorf("unexpected archive query: %s", r.URL.RawQuery)
+			}
+			zw := gzip.NewWriter(w)
+			tw := tar.NewWriter(zw)
+			tw.WriteHeader(&tar.Header{Name: "infra-vpc-1.1.0-modules-vpc/", Typeflag: tar.TypeDir, Mode: 0o755})
+			tw.WriteHeader(&tar.Header{Name: "infra-vpc-1.1.0-modules-vpc/modules/vpc/main.tf", Mode: 0o644, Size: 5})
+			tw.Write([]byte("# vpc"))
+			tw.Close()
+			zw.Close()
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
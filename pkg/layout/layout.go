@@ -0,0 +1,90 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package layout describes how modules are laid out in a repository, i.e. how
+// their tags are named and where in the repository they are located.
+package layout
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+const (
+	DefaultTagTemplate  = "{module}/{version}"
+	DefaultPathTemplate = "{module}"
+
+	moduleVar  = "{module}"
+	versionVar = "{version}"
+)
+
+var (
+	ErrInvalidModule = errors.New("invalid module name")
+)
+
+// TagScheme describes how the tags of a module are named, i.e. the literal
+// text surrounding the version once the module name has been filled in.
+type TagScheme struct {
+	Prefix string
+	Suffix string
+}
+
+// NewTagScheme expands the module in the template, such as `{module}-v{version}`
+// or `v{version}` for single module repositories.
+func NewTagScheme(template, module string) TagScheme {
+	if template == "" {
+		template = DefaultTagTemplate
+	}
+	expanded := strings.ReplaceAll(template, moduleVar, module)
+	prefix, suffix, _ := strings.Cut(expanded, versionVar)
+	return TagScheme{prefix, suffix}
+}
+
+// Version extracts the version from the tag, if the tag belongs to the module.
+func (t TagScheme) Version(tag string) (string, bool) {
+	if len(tag) <= len(t.Prefix)+len(t.Suffix) {
+		return "", false
+	}
+	if !strings.HasPrefix(tag, t.Prefix) || !strings.HasSuffix(tag, t.Suffix) {
+		return "", false
+	}
+	return tag[len(t.Prefix) : len(tag)-len(t.Suffix)], true
+}
+
+// Tag returns the name of the tag for the version.
+func (t TagScheme) Tag(version string) string {
+	return t.Prefix + version + t.Suffix
+}
+
+func ValidTagTemplate(template string) error {
+	if strings.Count(template, versionVar) != 1 {
+		return fmt.Errorf("tag template %q must contain %s exactly once", template, versionVar)
+	}
+	return nil
+}
+
+// ModulePath returns the directory of the module inside the repository, by
+// expanding the module in the template. If a separator is given, it is
+// replaced with slashes in the module name, so that e.g. `aws.vpc` can map to
+// the nested `aws/vpc` directory.
+func ModulePath(template, separator, module string) (string, error) {
+	name := module
+	if separator != "" {
+		name = strings.ReplaceAll(name, separator, "/")
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.Contains(segment, "\\") {
+			return "", ErrInvalidModule
+		}
+	}
+
+	if template == "" {
+		template = DefaultPathTemplate
+	}
+
+	p := path.Clean("/" + strings.ReplaceAll(template, moduleVar, name))
+	return strings.TrimPrefix(p, "/"), nil
+}
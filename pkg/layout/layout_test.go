@@ -0,0 +1,32 @@
+package layout
+
+import "testing"
+
+func TestTagScheme(t *testing.T) {
+	tests := []struct {
+		template string
+		tag      string
+		version  string
+		ok       bool
+	}{
+		{"{module}/{version}", "vpc/1.2.3", "1.2.3", true},
+		{"{module}/{version}", "vpcx/1.2.3", "", false},
+		{"{module}/{version}", "vpc/", "", false},
+		{"{module}-v{version}", "vpc-v1.2.3", "1.2.3", true},
+		{"{module}-v{version}", "vpc/v1.2.3", "", false},
+		{"{module}@{version}", "vpc@1.2.3", "1.2.3", true},
+		{"v{version}", "v1.2.3", "1.2.3", true},
+		{"v{version}", "1.2.3", "", false},
+		{"release-{version}-{module}", "release-1.0.0-vpc", "1.0.0", true},
+	}
+	for _, tt := range tests {
+		scheme := NewTagScheme(tt.template, "vpc")
+		version, ok := scheme.Version(tt.tag)
+		if version != tt.version || ok != tt.ok {
+			t.Errorf("%s: unexpected version for %s, exp: %q (%t), got: %q (%t)", tt.template, tt.tag, tt.version, tt.ok, version, ok)
+		}
+		if ok && scheme.Tag(version) != tt.tag {
+			t.Errorf("%s: unexpected tag, exp: %s, got: %s", tt.template, tt.tag, scheme.Tag(version))
+		}
+	}
+}
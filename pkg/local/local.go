@@ -0,0 +1,165 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package local serves modules from a directory tree, without any git forge,
+// e.g. for development or disconnected networks.
+package local
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/archive"
+)
+
+const (
+	archiveExt = ".tar.gz"
+)
+
+type Config struct {
+	// Root of the directory tree, where each version of a module is either a
+	// directory, `<root>/<owner>/<repo>/<module>/<version>/`, or a pre-built
+	// archive, `<root>/<owner>/<repo>/<module>/<version>.tar.gz`.
+	Root string `envconfig:"ROOT"`
+}
+
+// Validate checks that the root is an existing directory.
+func (c *Config) Validate() error {
+	if c.Root == "" {
+		return errors.New("missing root")
+	}
+	fi, err := os.Stat(c.Root)
+	if err != nil {
+		return fmt.Errorf("invalid root: %w", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("invalid root: %q is not a directory", c.Root)
+	}
+	return nil
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+func New(cfg Config, log Logger) *Service {
+	return &Service{
+		cfg: cfg,
+		log: log,
+	}
+}
+
+type Service struct {
+	cfg Config
+	log Logger
+}
+
+func (s *Service) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	dir, err := s.path(owner, repo, module)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "module not found",
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading module: %w", err)
+	}
+
+	var (
+		seen     = map[string]bool{}
+		versions = []string{}
+	)
+	for _, e := range entries {
+		version := e.Name()
+		if !e.IsDir() {
+			var ok bool
+			if version, ok = strings.CutSuffix(version, archiveExt); !ok {
+				continue
+			}
+		}
+		if version == "" || strings.HasPrefix(version, ".") || seen[version] {
+			continue
+		}
+		seen[version] = true
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+func (s *Service) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	dir, err := s.path(owner, repo, module, version)
+	if err != nil {
+		return err
+	}
+
+	// A directory takes precedence, since it's likely a module that is being
+	// worked on.
+	if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+		aw, err := archive.NewWriter(archive.Default, w)
+		if err != nil {
+			return err
+		}
+
+		if err := archive.CopyTree(aw, dir, time.Time{}); err != nil {
+			return err
+		}
+		return aw.Close()
+	}
+
+	f, err := os.Open(dir + archiveExt)
+	if errors.Is(err, os.ErrNotExist) {
+		return &httpErr{
+			code: http.StatusNotFound,
+			msg:  "version not found",
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("opening archive: %w", err)
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// path returns the path of the elements inside the root, making sure that
+// each of them is a single, valid path segment.
+func (s *Service) path(elem ...string) (string, error) {
+	for _, e := range elem {
+		if e == "" || e == "." || e == ".." || strings.ContainsAny(e, `/\`) {
+			return "", &httpErr{
+				code: http.StatusBadRequest,
+				msg:  "invalid path",
+			}
+		}
+	}
+	return filepath.Join(append([]string{s.cfg.Root}, elem...)...), nil
+}
+
+type httpErr struct {
+	code int
+	msg  string
+}
+
+func (e *httpErr) Error() string {
+	return e.msg
+}
+
+func (e *httpErr) StatusCode() int {
+	return e.code
+}
@@ -0,0 +1,81 @@
+package local
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	root := t.TempDir()
+	module := filepath.Join(root, "acme", "infra", "vpc")
+	writeFile(t, filepath.Join(module, "1.0.0", "main.tf"), "# vpc")
+	writeFile(t, filepath.Join(module, "1.0.0", "modules", "sub", "sub.tf"), "# sub")
+	writeFile(t, filepath.Join(module, "2.0.0.tar.gz"), "prebuilt")
+	writeFile(t, filepath.Join(module, "notes.txt"), "")
+
+	s := New(Config{Root: root}, slog.Default())
+
+	versions, err := s.ListVersions(context.Background(), "acme", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0", "2.0.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+	zr, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatalf("read gzip: %s", err)
+	}
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if exp := []string{"main.tf", "modules/", "modules/sub/", "modules/sub/sub.tf"}; !reflect.DeepEqual(names, exp) {
+		t.Errorf("unexpected entries, exp: %v, got: %v", exp, names)
+	}
+
+	// Pre-built archives are served as is.
+	buf.Reset()
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "2.0.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+	if buf.String() != "prebuilt" {
+		t.Errorf("unexpected archive: %q", buf.String())
+	}
+
+	if err := s.ProxyDownload(context.Background(), "acme", "infra", "vpc", "..", io.Discard); err == nil {
+		t.Errorf("expected an error for an invalid version")
+	}
+}
+
+func writeFile(t *testing.T, name, content string) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		t.Fatalf("creating dir: %s", err)
+	}
+	if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+		t.Fatalf("writing %s: %s", name, err)
+	}
+}
@@ -30,7 +30,7 @@ type Cache[K comparable, V any] struct {
 
 func (c *Cache[K, V]) Get(key K) (V, bool) {
 	c.mu.RLock()
-	defer c.mu.Unlock()
+	defer c.mu.RUnlock()
 
 	if item, ok := c.items[key]; ok {
 		now := c.now().UnixNano()
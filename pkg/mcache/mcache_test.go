@@ -0,0 +1,33 @@
+package mcache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheConcurrency(t *testing.T) {
+	c := New[string, int](time.Minute)
+
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			key := fmt.Sprint(n % 2)
+			for i := 0; i < 100; i++ {
+				c.Set(key, i)
+				if _, ok := c.Get(key); !ok {
+					t.Errorf("expected %s to be cached", key)
+					return
+				}
+			}
+		}(n)
+	}
+	wg.Wait()
+
+	if exp := 2; c.Count() != exp {
+		t.Errorf("unexpected count, exp: %d, got: %d", exp, c.Count())
+	}
+}
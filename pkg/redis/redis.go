@@ -0,0 +1,263 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package redis stores the cached versions and archives in Redis, or any
+// server speaking its protocol, so that they can be shared between replicas.
+//
+// https://redis.io/docs/reference/protocol-spec/
+package redis
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	Addr     string        `envconfig:"ADDR"`
+	Username string        `envconfig:"USERNAME"`
+	Password string        `envconfig:"PASSWORD"`
+	DB       int           `envconfig:"DB"`
+	TLS      bool          `envconfig:"TLS"`
+	PoolSize int           `envconfig:"POOL_SIZE" default:"10"`
+	Timeout  time.Duration `envconfig:"TIMEOUT" default:"2s"`
+
+	// Prefix is prepended to every key, so that the server can be shared
+	// with others.
+	Prefix string `envconfig:"PREFIX" default:"orbit:"`
+
+	// MaxFileBytes is the size of the largest archive that is stored, where
+	// zero means no limit, and FileExpiration how long they are kept.
+	MaxFileBytes   int64         `envconfig:"MAX_FILE_BYTES" default:"67108864"`
+	FileExpiration time.Duration `envconfig:"FILE_EXPIRATION" default:"24h"`
+}
+
+// Validate checks that the address is set.
+func (c *Config) Validate() error {
+	if c.Addr == "" {
+		return errors.New("missing address")
+	}
+	if _, _, err := net.SplitHostPort(c.Addr); err != nil {
+		return fmt.Errorf("invalid address: %w", err)
+	}
+	return nil
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+// New creates a client, which connects to the server as needed, keeping up to
+// the pool size of idle connections around.
+func New(cfg Config) *Client {
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 10
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 2 * time.Second
+	}
+	return &Client{
+		cfg:  cfg,
+		idle: make(chan *conn, cfg.PoolSize),
+	}
+}
+
+type Client struct {
+	cfg  Config
+	idle chan *conn
+}
+
+type conn struct {
+	net.Conn
+	r *bufio.Reader
+	w *bufio.Writer
+}
+
+// Error is an error reply from the server.
+type Error string
+
+func (e Error) Error() string {
+	return string(e)
+}
+
+// Do sends the command and returns the reply, which is either a string, an
+// int64, a slice of replies, or nil. Error replies are returned as Error.
+func (c *Client) Do(args ...string) (any, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+
+	cn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+	v, err := cn.do(args...)
+	var rerr Error
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection is in an unknown state after an I/O error.
+		cn.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return v, err
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) get() (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+		return c.dial()
+	}
+}
+
+func (c *Client) put(cn *conn) {
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+func (c *Client) dial() (*conn, error) {
+	d := &net.Dialer{Timeout: c.cfg.Timeout}
+	var (
+		nc  net.Conn
+		err error
+	)
+	if c.cfg.TLS {
+		host, _, _ := net.SplitHostPort(c.cfg.Addr)
+		nc, err = tls.DialWithDialer(d, "tcp", c.cfg.Addr, &tls.Config{ServerName: host})
+	} else {
+		nc, err = d.Dial("tcp", c.cfg.Addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("redis: %w", err)
+	}
+
+	cn := &conn{
+		Conn: nc,
+		r:    bufio.NewReader(nc),
+		w:    bufio.NewWriter(nc),
+	}
+	cn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+	if c.cfg.Password != "" {
+		args := []string{"AUTH", c.cfg.Password}
+		if c.cfg.Username != "" {
+			args = []string{"AUTH", c.cfg.Username, c.cfg.Password}
+		}
+		if _, err := cn.do(args...); err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("redis: auth: %w", err)
+		}
+	}
+	if c.cfg.DB != 0 {
+		if _, err := cn.do("SELECT", strconv.Itoa(c.cfg.DB)); err != nil {
+			cn.Close()
+			return nil, fmt.Errorf("redis: select: %w", err)
+		}
+	}
+	return cn, nil
+}
+
+func (cn *conn) do(args ...string) (any, error) {
+	if err := writeCommand(cn.w, args); err != nil {
+		return nil, err
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(cn.r)
+}
+
+// writeCommand writes the command as an array of bulk strings.
+func writeCommand(w *bufio.Writer, args []string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(a))
+		w.WriteString(a)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return string(b[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]any, n)
+		for i := range values {
+			// Errors within the array are values, as the rest of it still
+			// has to be read.
+			v, err := readReply(r)
+			var rerr Error
+			if errors.As(err, &rerr) {
+				v, err = rerr, nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			values[i] = v
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply: %q", line)
+	}
+}
+
+func readLine(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed reply: %q", line)
+	}
+	return line[:len(line)-2], nil
+}
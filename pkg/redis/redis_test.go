@@ -0,0 +1,201 @@
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStore(t *testing.T) {
+	srv := newServer(t, "secret")
+	c := New(Config{Addr: srv.addr, Password: "secret", Prefix: "orbit:"})
+	defer c.Close()
+
+	s := NewStore(c, "versions:", time.Minute, slog.Default())
+	if _, ok := s.Get("aws-infra-vpc"); ok {
+		t.Errorf("unexpected hit")
+	}
+
+	s.Set("aws-infra-vpc", []string{"1.0.0", "1.1.0"})
+	v, ok := s.Get("aws-infra-vpc")
+	if !ok || !reflect.DeepEqual(v, []string{"1.0.0", "1.1.0"}) {
+		t.Errorf("unexpected value: %v, %v", v, ok)
+	}
+	if exp, got := "60000", srv.ttl("orbit:versions:aws-infra-vpc"); got != exp {
+		t.Errorf("unexpected expiration, exp: %s, got: %s", exp, got)
+	}
+
+	s.Set("aws-infra-vpc", []string{"2.0.0"}, time.Hour)
+	if exp, got := "3600000", srv.ttl("orbit:versions:aws-infra-vpc"); got != exp {
+		t.Errorf("unexpected expiration, exp: %s, got: %s", exp, got)
+	}
+
+	// Connections are reused.
+	if srv.connections() != 1 {
+		t.Errorf("unexpected number of connections: %d", srv.connections())
+	}
+
+	// Errors are reported as misses.
+	bad := NewStore(New(Config{Addr: srv.addr, Password: "wrong"}), "", time.Minute, slog.Default())
+	if _, ok := bad.Get("aws-infra-vpc"); ok {
+		t.Errorf("unexpected hit with the wrong password")
+	}
+}
+
+func TestFiles(t *testing.T) {
+	srv := newServer(t, "")
+	c := New(Config{Addr: srv.addr, MaxFileBytes: 10, FileExpiration: time.Hour})
+	defer c.Close()
+
+	f := NewFiles(c, "files:")
+	if _, err := f.Open("vpc.tar.gz"); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+
+	w, _ := f.Create("vpc.tar.gz")
+	io.WriteString(w, "binary\r\n\x00")
+	if err := w.Close(); err != nil {
+		t.Fatalf("close: %s", err)
+	}
+	r, err := f.Open("vpc.tar.gz")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "binary\r\n\x00" {
+		t.Errorf("unexpected content: %q", b)
+	}
+
+	// Aborted and oversized files are never stored.
+	w, _ = f.Create("aborted.tar.gz")
+	io.WriteString(w, "partial")
+	w.(interface{ Abort() error }).Abort()
+	w.Close()
+
+	w, _ = f.Create("big.tar.gz")
+	if _, err := io.WriteString(w, "far too large"); err != nil {
+		t.Errorf("unexpected write error: %s", err)
+	}
+	if err := w.Close(); !errors.Is(err, errTooBig) {
+		t.Errorf("expected the file to be too big, got: %v", err)
+	}
+
+	for _, name := range []string{"aborted.tar.gz", "big.tar.gz"} {
+		if _, err := f.Open(name); err == nil {
+			t.Errorf("%s: expected the file to be missing", name)
+		}
+	}
+}
+
+// server is a stand-in for Redis, supporting the few commands in use.
+type server struct {
+	addr     string
+	password string
+
+	mu     sync.Mutex
+	values map[string]string
+	ttls   map[string]string
+	conns  int
+}
+
+func newServer(t *testing.T, password string) *server {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := &server{
+		addr:     l.Addr().String(),
+		password: password,
+		values:   make(map[string]string),
+		ttls:     make(map[string]string),
+	}
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.mu.Unlock()
+			go s.serve(nc)
+		}
+	}()
+	return s
+}
+
+func (s *server) serve(nc net.Conn) {
+	defer nc.Close()
+
+	r := bufio.NewReader(nc)
+	authed := s.password == ""
+	for {
+		v, err := readReply(r)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, a := range v.([]any) {
+			args = append(args, a.(string))
+		}
+
+		s.mu.Lock()
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = args[len(args)-1] == s.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "GET":
+			if v, ok := s.values[args[1]]; ok {
+				reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v), v)
+			} else {
+				reply = "$-1\r\n"
+			}
+		case cmd == "SET":
+			s.values[args[1]] = args[2]
+			delete(s.ttls, args[1])
+			if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+				if _, err := strconv.Atoi(args[4]); err == nil {
+					s.ttls[args[1]] = args[4]
+				}
+			}
+			reply = "+OK\r\n"
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		s.mu.Unlock()
+
+		if _, err := io.WriteString(nc, reply); err != nil {
+			return
+		}
+	}
+}
+
+func (s *server) ttl(key string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.ttls[key]
+}
+
+func (s *server) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns
+}
@@ -0,0 +1,146 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package redis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strconv"
+	"time"
+)
+
+var errTooBig = errors.New("file too large to be stored")
+
+// NewStore creates a key-value store of the versions, where the keys are
+// prefixed by the prefix, in addition to the one of the client. Values are
+// kept for the expiration, unless given when set.
+func NewStore(c *Client, prefix string, expiration time.Duration, log Logger) *Store {
+	return &Store{c, c.cfg.Prefix + prefix, expiration, log}
+}
+
+type Store struct {
+	client     *Client
+	prefix     string
+	expiration time.Duration
+	log        Logger
+}
+
+// Get returns the value of the key. Failing to reach the server is logged and
+// reported as a miss, as the value can be looked up elsewhere.
+func (s *Store) Get(key string) ([]string, bool) {
+	v, err := s.client.Do("GET", s.prefix+key)
+	if err != nil {
+		s.log.Error("failed to get cached value", "key", key, "err", err)
+		return nil, false
+	}
+	b, ok := v.(string)
+	if !ok {
+		return nil, false
+	}
+
+	var value []string
+	if err := json.Unmarshal([]byte(b), &value); err != nil {
+		s.log.Error("failed to decode cached value", "key", key, "err", err)
+		return nil, false
+	}
+	return value, true
+}
+
+func (s *Store) Set(key string, value []string, d ...time.Duration) {
+	expiry := s.expiration
+	if len(d) > 0 {
+		expiry = d[0]
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		s.log.Error("failed to encode cached value", "key", key, "err", err)
+		return
+	}
+	args := []string{"SET", s.prefix + key, string(b)}
+	if expiry > 0 {
+		args = append(args, "PX", strconv.FormatInt(expiry.Milliseconds(), 10))
+	}
+	if _, err := s.client.Do(args...); err != nil {
+		s.log.Error("failed to set cached value", "key", key, "err", err)
+	}
+}
+
+// NewFiles creates a file storage, where the files are stored as values under
+// keys prefixed by the prefix, in addition to the one of the client.
+func NewFiles(c *Client, prefix string) *Files {
+	return &Files{c, c.cfg.Prefix + prefix}
+}
+
+type Files struct {
+	client *Client
+	prefix string
+}
+
+func (f *Files) Open(filename string) (io.ReadCloser, error) {
+	v, err := f.client.Do("GET", f.prefix+filename)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := v.(string)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: filename, Err: fs.ErrNotExist}
+	}
+	return io.NopCloser(bytes.NewReader([]byte(b))), nil
+}
+
+// Create returns a writer that buffers the file, and stores it once closed,
+// so that a partial file is never stored. Files larger than the maximum size
+// are not stored at all.
+func (f *Files) Create(filename string) (io.WriteCloser, error) {
+	return &fileWriter{files: f, name: filename}, nil
+}
+
+type fileWriter struct {
+	files  *Files
+	name   string
+	buf    bytes.Buffer
+	tooBig bool
+	done   bool
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	// The download shouldn't fail just because the file won't be stored.
+	max := w.files.client.cfg.MaxFileBytes
+	if w.tooBig || (max > 0 && int64(w.buf.Len()+len(p)) > max) {
+		w.tooBig = true
+		w.buf.Reset()
+		return len(p), nil
+	}
+	return w.buf.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+	if w.tooBig {
+		return fmt.Errorf("%s: %w", w.name, errTooBig)
+	}
+
+	args := []string{"SET", w.files.prefix + w.name, w.buf.String()}
+	if d := w.files.client.cfg.FileExpiration; d > 0 {
+		args = append(args, "PX", strconv.FormatInt(d.Milliseconds(), 10))
+	}
+	_, err := w.files.client.Do(args...)
+	return err
+}
+
+// Abort discards the file.
+func (w *fileWriter) Abort() error {
+	w.done = true
+	w.buf.Reset()
+	return nil
+}
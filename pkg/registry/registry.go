@@ -0,0 +1,559 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package registry serves modules from an upstream registry, speaking the
+// module registry protocol, so that it can be proxied.
+//
+// https://developer.hashicorp.com/terraform/internals/module-registry-protocol
+package registry
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/archive"
+)
+
+// maxZipBytes limits the size of the zip archives that are downloaded, since
+// they have to be kept on disk while being read.
+const maxZipBytes = 256 << 20
+
+type Config struct {
+	// URL of the upstream registry, e.g. `https://registry.terraform.io/`,
+	// where the modules API is found through service discovery.
+	URL string `envconfig:"URL"`
+
+	// Token is sent to the upstream registry, and when downloading archives
+	// from the same host. The tokens of callers are never passed on.
+	Token string `envconfig:"TOKEN"`
+
+	// Timeout of the requests to the upstream registry, and the downloads of
+	// archives, which take a lot longer than the API calls of the backends.
+	Timeout time.Duration `envconfig:"TIMEOUT" default:"5m"`
+
+	// Modules are often served straight from git repositories, which are
+	// fetched using the git binary, allowing only the listed protocols.
+	GitBinary    string `envconfig:"GIT_BINARY" default:"git"`
+	GitProtocols string `envconfig:"GIT_PROTOCOLS" default:"https"`
+}
+
+// Validate checks that the URL of the upstream registry is usable.
+func (c *Config) Validate() error {
+	if c.URL == "" {
+		return errors.New("missing upstream URL")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid upstream URL: %q", c.URL)
+	}
+	return nil
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+func New(cfg Config, c HTTPClient, log Logger) *Service {
+	if cfg.GitBinary == "" {
+		cfg.GitBinary = "git"
+	}
+	if cfg.GitProtocols == "" {
+		cfg.GitProtocols = "https"
+	}
+	return &Service{
+		cfg:    cfg,
+		client: c,
+		log:    log,
+	}
+}
+
+type Service struct {
+	cfg    Config
+	client HTTPClient
+	log    Logger
+
+	mu      sync.Mutex
+	modules *url.URL
+}
+
+// The repositories know the system of the module as the owner, and its
+// namespace as the repo, while the registry addresses them the other way
+// around.
+func (s *Service) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	u, err := s.moduleURL(ctx, repo, module, owner, "versions")
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.get(ctx, u)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var v struct {
+		Modules []struct {
+			Versions []struct {
+				Version string `json:"version"`
+			} `json:"versions"`
+		} `json:"modules"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&v); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+
+	versions := []string{}
+	for _, m := range v.Modules {
+		for _, version := range m.Versions {
+			versions = append(versions, version.Version)
+		}
+	}
+	return versions, nil
+}
+
+func (s *Service) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	u, err := s.moduleURL(ctx, repo, module, owner, version, "download")
+	if err != nil {
+		return err
+	}
+
+	res, err := s.get(ctx, u)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	src := res.Header.Get("X-Terraform-Get")
+	if src == "" {
+		return &httpErr{
+			code: http.StatusBadGateway,
+			msg:  "upstream registry did not return a download location",
+		}
+	}
+
+	getter, src, subdir := parseSource(src)
+	if getter == "" {
+		// The location may be relative to the download URL.
+		if loc, err := u.Parse(src); err == nil && loc.IsAbs() {
+			src = loc.String()
+		}
+	}
+	s.log.Info("downloading module from upstream", "src", src, "subdir", subdir)
+
+	switch {
+	case getter == "git" || (getter == "" && strings.HasSuffix(strings.SplitN(src, "?", 2)[0], ".git")):
+		return s.fetchGit(ctx, src, subdir, w)
+	case getter == "" || getter == "http" || getter == "https":
+		return s.fetchArchive(ctx, src, subdir, w)
+	default:
+		return &httpErr{
+			code: http.StatusBadGateway,
+			msg:  fmt.Sprintf("unsupported module source: %s::%s", getter, src),
+		}
+	}
+}
+
+// fetchArchive downloads an archive over HTTP, where its type is either given
+// by the `archive` query parameter, or the extension.
+func (s *Service) fetchArchive(ctx context.Context, src, subdir string, w io.Writer) error {
+	u, err := url.Parse(src)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return &httpErr{
+			code: http.StatusBadGateway,
+			msg:  fmt.Sprintf("unsupported module source: %s", src),
+		}
+	}
+
+	q := u.Query()
+	format := q.Get("archive")
+	q.Del("archive")
+	u.RawQuery = q.Encode()
+	if format == "" {
+		for _, ext := range []string{"tar.gz", "tgz", "zip"} {
+			if strings.HasSuffix(u.Path, "."+ext) {
+				format = ext
+				break
+			}
+		}
+	}
+
+	res, err := s.get(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	aw, err := archive.NewWriter(archive.Default, w)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case "tar.gz", "tgz":
+		zr, err := gzip.NewReader(res.Body)
+		if err != nil {
+			return fmt.Errorf("read gzip: %w", err)
+		}
+		defer zr.Close()
+		err = archive.CopySubdir(aw, tar.NewReader(zr), subdir)
+		if err != nil {
+			return err
+		}
+	case "zip":
+		// Zip files are read from the end, so they have to be downloaded
+		// first, up to a limit.
+		f, err := os.CreateTemp("", "orbit-registry-*.zip")
+		if err != nil {
+			return fmt.Errorf("creating temp file: %w", err)
+		}
+		defer os.Remove(f.Name())
+		defer f.Close()
+
+		n, err := io.Copy(f, io.LimitReader(res.Body, maxZipBytes+1))
+		if err != nil {
+			return fmt.Errorf("reading zip: %w", err)
+		}
+		if n > maxZipBytes {
+			return &httpErr{
+				code: http.StatusBadGateway,
+				msg:  fmt.Sprintf("archive too large: %s", src),
+			}
+		}
+		if err := copyZip(aw, f, n, subdir); err != nil {
+			return err
+		}
+	default:
+		return &httpErr{
+			code: http.StatusBadGateway,
+			msg:  fmt.Sprintf("unsupported archive: %s", src),
+		}
+	}
+	return aw.Close()
+}
+
+// fetchGit fetches a single commit of a git repository, and archives it. The
+// ref is given by the `ref` query parameter, defaulting to the HEAD.
+func (s *Service) fetchGit(ctx context.Context, src, subdir string, w io.Writer) error {
+	ref := "HEAD"
+	if remote, query, ok := strings.Cut(src, "?"); ok {
+		q, _ := url.ParseQuery(query)
+		if r := q.Get("ref"); r != "" {
+			ref = r
+		}
+		q.Del("ref")
+		q.Del("depth")
+		src = remote
+		if len(q) > 0 {
+			src += "?" + q.Encode()
+		}
+	}
+	if strings.HasPrefix(ref, "-") {
+		return &httpErr{
+			code: http.StatusBadGateway,
+			msg:  fmt.Sprintf("invalid ref: %s", ref),
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "orbit-registry-")
+	if err != nil {
+		return fmt.Errorf("creating temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := s.git(ctx, dir, "init", "--quiet", "--bare"); err != nil {
+		return err
+	}
+	if _, err := s.git(ctx, dir, "fetch", "--quiet", "--depth=1", "--", src, ref); err != nil {
+		return &httpErr{
+			code: http.StatusBadGateway,
+			msg:  err.Error(),
+		}
+	}
+	cmd := s.command(ctx, dir, "archive", "--format=tar", "FETCH_HEAD")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("git archive: %w", err)
+	}
+
+	aw, err := archive.NewWriter(archive.Default, w)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	if err := archive.CopySubdir(aw, tar.NewReader(stdout), subdir); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		return fmt.Errorf("git archive: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return aw.Close()
+}
+
+func (s *Service) git(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := s.command(ctx, dir, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+func (s *Service) command(ctx context.Context, dir string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, s.cfg.GitBinary, append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(),
+		"GIT_TERMINAL_PROMPT=0",
+		"GIT_ALLOW_PROTOCOL="+strings.ReplaceAll(s.cfg.GitProtocols, ",", ":"),
+	)
+	return cmd
+}
+
+// moduleURL returns the URL of the modules API, with the elements appended.
+func (s *Service) moduleURL(ctx context.Context, elem ...string) (*url.URL, error) {
+	base, err := s.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for n, e := range elem {
+		if e == "" || e == "." || e == ".." {
+			return nil, &httpErr{
+				code: http.StatusBadRequest,
+				msg:  "invalid module address",
+			}
+		}
+		elem[n] = url.PathEscape(e)
+	}
+	return base.Parse(path.Join(elem...))
+}
+
+// discover looks up the modules API of the upstream registry, which is kept
+// once found.
+//
+// https://developer.hashicorp.com/terraform/internals/remote-service-discovery
+func (s *Service) discover(ctx context.Context) (*url.URL, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.modules != nil {
+		return s.modules, nil
+	}
+
+	u, err := url.Parse(s.cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	wk, err := u.Parse("/.well-known/terraform.json")
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.get(ctx, wk)
+	if err != nil {
+		return nil, fmt.Errorf("discovering services: %w", err)
+	}
+	defer res.Body.Close()
+
+	var services struct {
+		Modules string `json:"modules.v1"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&services); err != nil {
+		return nil, fmt.Errorf("decoding services: %w", err)
+	}
+	if services.Modules == "" {
+		return nil, &httpErr{
+			code: http.StatusBadGateway,
+			msg:  "upstream registry does not serve modules",
+		}
+	}
+
+	m, err := wk.Parse(strings.TrimSuffix(services.Modules, "/") + "/")
+	if err != nil {
+		return nil, fmt.Errorf("invalid modules URL: %w", err)
+	}
+	s.modules = m
+	return m, nil
+}
+
+func (s *Service) get(ctx context.Context, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+
+	if s.cfg.Token != "" && s.sameHost(u) {
+		req.Header.Add("Authorization", "Bearer "+s.cfg.Token)
+	}
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return nil, &httpErr{
+			code: res.StatusCode,
+			msg:  slurp(res.Body),
+		}
+	}
+	return res, nil
+}
+
+// sameHost checks if the URL is on the host of the upstream registry, which
+// is the only place where the token is sent.
+func (s *Service) sameHost(u *url.URL) bool {
+	base, err := url.Parse(s.cfg.URL)
+	return err == nil && base.Host == u.Host
+}
+
+// parseSource splits a module source into its forced getter, such as `git` in
+// `git::https://...`, the source itself, and the subdirectory after a double
+// slash, as in `https://example.com/module.tar.gz//modules/vpc`.
+func parseSource(src string) (getter, source, subdir string) {
+	if g, rest, ok := strings.Cut(src, "::"); ok && !strings.ContainsAny(g, "/:") {
+		getter, src = g, rest
+	}
+
+	stop := len(src)
+	if i := strings.Index(src, "?"); i >= 0 {
+		stop = i
+	}
+	offset := 0
+	if i := strings.Index(src[:stop], "://"); i >= 0 {
+		offset = i + 3
+	}
+	i := strings.Index(src[offset:stop], "//")
+	if i < 0 {
+		return getter, src, ""
+	}
+	i += offset
+
+	source, subdir = src[:i], src[i+2:]
+	if q := strings.Index(subdir, "?"); q >= 0 {
+		source += subdir[q:]
+		subdir = subdir[:q]
+	}
+	return getter, source, subdir
+}
+
+// copyZip writes the entries of the zip file that are located in the subdir to
+// the archive writer.
+func copyZip(w archive.Writer, r io.ReaderAt, size int64, subdir string) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("read zip: %w", err)
+	}
+
+	// The entries are converted to a tar stream on the fly, rather than
+	// unpacked in memory.
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(zipToTar(pw, zr))
+	}()
+	err = archive.CopySubdir(w, tar.NewReader(pr), subdir)
+	pr.CloseWithError(err)
+	return err
+}
+
+func zipToTar(w io.Writer, zr *zip.Reader) error {
+	tw := tar.NewWriter(w)
+	for _, f := range zr.File {
+		hdr, err := tar.FileInfoHeader(f.FileInfo(), "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = f.Name
+		if hdr.Typeflag == tar.TypeSymlink {
+			// The target of the link is stored as its content.
+			if hdr.Linkname, err = readLink(f); err != nil {
+				return err
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", f.Name, err)
+		}
+	}
+	return tw.Close()
+}
+
+// readLink reads the target of a symlink in a zip archive.
+func readLink(f *zip.File) (string, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	b, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return "", fmt.Errorf("reading %s: %w", f.Name, err)
+	}
+	return string(b), nil
+}
+
+func slurp(r io.ReadCloser) string {
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+type httpErr struct {
+	code int
+	msg  string
+}
+
+func (e *httpErr) Error() string {
+	return e.msg
+}
+
+func (e *httpErr) StatusCode() int {
+	return e.code
+}
@@ -0,0 +1,261 @@
+package registry
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func TestRegistry(t *testing.T) {
+	files := map[string]string{
+		"main.tf":             "# root",
+		"modules/vpc/main.tf": "# vpc",
+	}
+
+	var tokens []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/terraform.json", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"modules.v1":"/api/modules/v1/"}`))
+	})
+	mux.HandleFunc("GET /api/modules/v1/infra/vpc/aws/versions", func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.Header.Get("Authorization"))
+		w.Write([]byte(`{"modules":[{"versions":[{"version":"1.0.0"},{"version":"1.1.0"}]}]}`))
+	})
+	mux.HandleFunc("GET /api/modules/v1/infra/vpc/aws/1.0.0/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Terraform-Get", "/archives/vpc.tar.gz//modules/vpc")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /api/modules/v1/infra/vpc/aws/1.1.0/download", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Terraform-Get", "/archives/vpc?archive=zip")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.HandleFunc("GET /archives/vpc.tar.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(makeTarball(t, files))
+	})
+	mux.HandleFunc("GET /archives/vpc", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.RawQuery != "" {
+			t.Errorf("unexpected query: %s", r.URL.RawQuery)
+		}
+		w.Write(makeZip(t, files))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	s := New(Config{URL: ts.URL, Token: "secret"}, ts.Client(), slog.Default())
+
+	versions, err := s.ListVersions(context.Background(), "aws", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0", "1.1.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+	if exp := []string{"Bearer secret"}; !reflect.DeepEqual(tokens, exp) {
+		t.Errorf("unexpected tokens, exp: %v, got: %v", exp, tokens)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ProxyDownload(context.Background(), "aws", "infra", "vpc", "1.0.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+	if exp, got := []string{"main.tf"}, listArchive(t, &buf); !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected entries, exp: %v, got: %v", exp, got)
+	}
+
+	buf.Reset()
+	if err := s.ProxyDownload(context.Background(), "aws", "infra", "vpc", "1.1.0", &buf); err != nil {
+		t.Fatalf("proxy download zip: %s", err)
+	}
+	if exp, got := []string{"main.tf", "modules/vpc/main.tf"}, listArchive(t, &buf); !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected zip entries, exp: %v, got: %v", exp, got)
+	}
+
+	_, err = s.ListVersions(context.Background(), "aws", "infra", "missing")
+	if sc, ok := err.(interface{ StatusCode() int }); !ok || sc.StatusCode() != http.StatusNotFound {
+		t.Errorf("expected not found, got: %v", err)
+	}
+}
+
+func TestParseSource(t *testing.T) {
+	tests := []struct {
+		src       string
+		expGetter string
+		expSource string
+		expSubdir string
+	}{
+		{"https://example.com/vpc.tar.gz", "", "https://example.com/vpc.tar.gz", ""},
+		{"https://example.com/vpc.tar.gz//modules/vpc", "", "https://example.com/vpc.tar.gz", "modules/vpc"},
+		{"git::https://example.com/vpc.git//modules/vpc?ref=v1.0.0", "git", "https://example.com/vpc.git?ref=v1.0.0", "modules/vpc"},
+		{"git::https://example.com/vpc.git?ref=v1.0.0", "git", "https://example.com/vpc.git?ref=v1.0.0", ""},
+		{"/archives/vpc.tar.gz//sub", "", "/archives/vpc.tar.gz", "sub"},
+	}
+	for _, tt := range tests {
+		getter, source, subdir := parseSource(tt.src)
+		if getter != tt.expGetter || source != tt.expSource || subdir != tt.expSubdir {
+			t.Errorf("%s: unexpected result: %q, %q, %q", tt.src, getter, source, subdir)
+		}
+	}
+}
+
+func TestZipSymlink(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	f, _ := zw.Create("main.tf")
+	f.Write([]byte("# vpc"))
+	hdr := &zip.FileHeader{Name: "link.tf"}
+	hdr.SetMode(fs.ModeSymlink | 0o777)
+	f, _ = zw.CreateHeader(hdr)
+	f.Write([]byte("main.tf"))
+	zw.Close()
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("read zip: %s", err)
+	}
+	var out bytes.Buffer
+	if err := zipToTar(&out, zr); err != nil {
+		t.Fatalf("zip to tar: %s", err)
+	}
+
+	var got []string
+	tr := tar.NewReader(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("read tar: %s", err)
+		}
+		b, _ := io.ReadAll(tr)
+		got = append(got, fmt.Sprintf("%s %c %q -> %q", hdr.Name, hdr.Typeflag, b, hdr.Linkname))
+	}
+	exp := []string{
+		`main.tf 0 "# vpc" -> ""`,
+		`link.tf 2 "" -> "main.tf"`,
+	}
+	if !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected entries, exp: %q, got: %q", exp, got)
+	}
+}
+
+func makeTarball(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for _, name := range sortedKeys(files) {
+		content := files[name]
+		hdr := &tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("write header: %s", err)
+		}
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	zw.Close()
+	return buf.Bytes()
+}
+
+func makeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range sortedKeys(files) {
+		f, err := zw.Create(name)
+		if err != nil {
+			t.Fatalf("create %s: %s", name, err)
+		}
+		f.Write([]byte(files[name]))
+	}
+	zw.Close()
+	return buf.Bytes()
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func listArchive(t *testing.T, r io.Reader) []string {
+	t.Helper()
+
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		t.Fatalf("read gzip: %s", err)
+	}
+	var names []string
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("read tar: %s", err)
+		}
+		names = append(names, hdr.Name)
+	}
+}
+
+func TestFetchGit(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	dir := t.TempDir()
+	for name, content := range map[string]string{"main.tf": "# root", "modules/vpc/main.tf": "# vpc"} {
+		name = filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(name), 0o755)
+		if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+			t.Fatalf("writing %s: %s", name, err)
+		}
+	}
+	for _, args := range [][]string{
+		{"init", "--quiet"},
+		{"add", "."},
+		{"-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "--quiet", "-m", "initial"},
+		{"tag", "v1.0.0"},
+	} {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %s: %s: %s", args[0], err, out)
+		}
+	}
+
+	s := New(Config{GitProtocols: "file"}, http.DefaultClient, slog.Default())
+
+	var buf bytes.Buffer
+	if err := s.fetchGit(context.Background(), "file://"+dir+"?ref=v1.0.0", "modules/vpc", &buf); err != nil {
+		t.Fatalf("fetch git: %s", err)
+	}
+	if exp, got := []string{"main.tf"}, listArchive(t, &buf); !reflect.DeepEqual(got, exp) {
+		t.Errorf("unexpected entries, exp: %v, got: %v", exp, got)
+	}
+
+	// Only the allowed protocols may be used.
+	s = New(Config{GitProtocols: "https"}, http.DefaultClient, slog.Default())
+	if err := s.fetchGit(context.Background(), "file://"+dir, "", io.Discard); err == nil {
+		t.Errorf("expected an error for a disallowed protocol")
+	}
+}
@@ -0,0 +1,311 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+// Package s3 serves modules from pre-built archives in an S3 bucket, or any
+// compatible object store such as MinIO.
+package s3
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/hedlund/orbit/services/modules"
+)
+
+const (
+	archiveExt = ".tar.gz"
+)
+
+type Config struct {
+	// Bucket holds the archives of the module versions, keyed as
+	// `<prefix><namespace>/<name>/<system>/<version>.tar.gz`.
+	Bucket string `envconfig:"BUCKET"`
+	Prefix string `envconfig:"PREFIX"`
+
+	// Endpoint of the object store, which defaults to the one of AWS in the
+	// region. Stores such as MinIO usually need path style addressing, where
+	// the bucket is part of the path rather than the hostname.
+	Endpoint  string `envconfig:"ENDPOINT"`
+	Region    string `envconfig:"REGION" default:"us-east-1"`
+	PathStyle bool   `envconfig:"PATH_STYLE"`
+
+	AccessKeyID     string `envconfig:"ACCESS_KEY_ID"`
+	SecretAccessKey string `envconfig:"SECRET_ACCESS_KEY"`
+	SessionToken    string `envconfig:"SESSION_TOKEN"`
+
+	// Redirect sends the clients straight to the bucket to download the
+	// archives, using presigned URLs valid for the duration, instead of
+	// proxying them.
+	Redirect          bool          `envconfig:"REDIRECT"`
+	PresignExpiration time.Duration `envconfig:"PRESIGN_EXPIRATION" default:"5m"`
+}
+
+// Validate checks that the bucket, endpoint and credentials are usable.
+func (c *Config) Validate() error {
+	if c.Bucket == "" {
+		return errors.New("missing bucket")
+	}
+	if c.Endpoint != "" {
+		u, err := url.Parse(c.Endpoint)
+		if err != nil {
+			return fmt.Errorf("invalid endpoint: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("invalid endpoint: %q", c.Endpoint)
+		}
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return errors.New("missing credentials")
+	}
+	if c.Redirect && c.PresignExpiration <= 0 {
+		return errors.New("presign expiration must be positive")
+	}
+	return nil
+}
+
+type HTTPClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+func New(cfg Config, c HTTPClient, log Logger) *Service {
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3." + cfg.Region + ".amazonaws.com"
+	}
+	return &Service{
+		cfg:    cfg,
+		client: c,
+		log:    log,
+		now:    time.Now,
+		signer: &signer{
+			accessKeyID:     cfg.AccessKeyID,
+			secretAccessKey: cfg.SecretAccessKey,
+			sessionToken:    cfg.SessionToken,
+			region:          cfg.Region,
+		},
+	}
+}
+
+type Service struct {
+	cfg    Config
+	client HTTPClient
+	log    Logger
+	now    func() time.Time
+	signer *signer
+}
+
+func (s *Service) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	prefix, err := s.key(owner, repo, module)
+	if err != nil {
+		return nil, err
+	}
+	prefix += "/"
+
+	versions := []string{}
+	token := ""
+	for {
+		q := url.Values{}
+		q.Set("list-type", "2")
+		q.Set("prefix", prefix)
+		q.Set("delimiter", "/")
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+
+		res, err := s.do(ctx, http.MethodGet, "", q)
+		if err != nil {
+			return nil, err
+		}
+
+		var list struct {
+			IsTruncated bool `xml:"IsTruncated"`
+			Contents    []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&list)
+		res.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+
+		for _, c := range list.Contents {
+			name := strings.TrimPrefix(c.Key, prefix)
+			if v, ok := strings.CutSuffix(name, archiveExt); ok && v != "" && !strings.Contains(v, "/") {
+				versions = append(versions, v)
+			}
+		}
+		if !list.IsTruncated || list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+
+	if len(versions) == 0 {
+		return nil, &httpErr{
+			code: http.StatusNotFound,
+			msg:  "module not found",
+		}
+	}
+	return versions, nil
+}
+
+func (s *Service) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	key, err := s.key(owner, repo, module, version)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.do(ctx, http.MethodGet, key+archiveExt, nil)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if _, err := io.Copy(w, res.Body); err != nil {
+		return fmt.Errorf("reading archive: %w", err)
+	}
+	return nil
+}
+
+// DownloadLink returns a presigned URL to the archive, if redirects are
+// enabled.
+func (s *Service) DownloadLink(ctx context.Context, owner, repo, module, version string) (string, error) {
+	if !s.cfg.Redirect {
+		return "", modules.ErrLinkUnsupported
+	}
+
+	key, err := s.key(owner, repo, module, version)
+	if err != nil {
+		return "", err
+	}
+	u, err := s.url(key+archiveExt, nil)
+	if err != nil {
+		return "", err
+	}
+	return s.signer.presign(http.MethodGet, u, s.cfg.PresignExpiration, s.now()), nil
+}
+
+// DescribeVersion uses the time the archive was uploaded as the time it was
+// published, and the commit from the `commit` metadata, if set.
+func (s *Service) DescribeVersion(ctx context.Context, owner, repo, module, version string) (*modules.VersionDetails, error) {
+	key, err := s.key(owner, repo, module, version)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := s.do(ctx, http.MethodHead, key+archiveExt, nil)
+	if err != nil {
+		return nil, err
+	}
+	res.Body.Close()
+
+	details := &modules.VersionDetails{
+		Commit: res.Header.Get("X-Amz-Meta-Commit"),
+	}
+	if t, err := http.ParseTime(res.Header.Get("Last-Modified")); err == nil {
+		details.PublishedAt = t
+	}
+	return details, nil
+}
+
+// key joins the elements into an object key, in the order of the registry
+// protocol, i.e. namespace, name and system. The elements must be valid path
+// segments.
+func (s *Service) key(owner, repo, module string, version ...string) (string, error) {
+	elem := append([]string{repo, module, owner}, version...)
+	for _, e := range elem {
+		if e == "" || e == "." || e == ".." || strings.ContainsAny(e, `/\`) {
+			return "", &httpErr{
+				code: http.StatusBadRequest,
+				msg:  "invalid module address",
+			}
+		}
+	}
+	return s.cfg.Prefix + strings.Join(elem, "/"), nil
+}
+
+// url returns the URL of the object in the bucket, or the bucket itself if the
+// key is empty.
+func (s *Service) url(key string, q url.Values) (*url.URL, error) {
+	u, err := url.Parse(s.cfg.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %w", err)
+	}
+
+	p := strings.TrimSuffix(u.Path, "/") + "/"
+	if s.cfg.PathStyle {
+		p += s.cfg.Bucket + "/"
+	} else {
+		u.Host = s.cfg.Bucket + "." + u.Host
+	}
+	u.Path = p + key
+	u.RawPath = escapePath(u.Path)
+	u.RawQuery = canonicalQuery(q)
+	return u, nil
+}
+
+func (s *Service) do(ctx context.Context, method, key string, q url.Values) (*http.Response, error) {
+	u, err := s.url(key, q)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("new request: %w", err)
+	}
+	s.signer.sign(req, s.now())
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("executing request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &httpErr{
+			code: res.StatusCode,
+			msg:  slurp(res.Body),
+		}
+	}
+	return res, nil
+}
+
+func slurp(r io.ReadCloser) string {
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err.Error()
+	}
+	return string(b)
+}
+
+type httpErr struct {
+	code int
+	msg  string
+}
+
+func (e *httpErr) Error() string {
+	return e.msg
+}
+
+func (e *httpErr) StatusCode() int {
+	return e.code
+}
@@ -0,0 +1,134 @@
+package s3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedlund/orbit/services/modules"
+)
+
+func TestS3(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	objects := map[string]string{
+		"modules/infra/vpc/aws/1.0.0.tar.gz": "v1",
+		"modules/infra/vpc/aws/1.1.0.tar.gz": "v1.1",
+		"modules/infra/vpc/aws/notes.txt":    "",
+	}
+
+	cfg := Config{
+		Bucket:          "releases",
+		Prefix:          "modules/",
+		Region:          "eu-north-1",
+		PathStyle:       true,
+		AccessKeyID:     "minio",
+		SecretAccessKey: "minio123",
+	}
+
+	// The stand-in verifies the signature of every request, by signing it
+	// again from what was received.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		req := r.Clone(context.Background())
+		req.URL.Host = r.Host
+		req.Header = http.Header{}
+		(&signer{cfg.AccessKeyID, cfg.SecretAccessKey, "", cfg.Region}).sign(req, now)
+		if exp := req.Header.Get("Authorization"); auth != exp {
+			t.Errorf("invalid signature,\nexp: %s\ngot: %s", exp, auth)
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		if r.URL.Path == "/releases/" {
+			prefix := r.URL.Query().Get("prefix")
+			token := r.URL.Query().Get("continuation-token")
+			fmt.Fprint(w, `<ListBucketResult>`)
+			// Returns a single object per page, to exercise the paging.
+			for _, k := range []string{"1.0.0.tar.gz", "1.1.0.tar.gz", "notes.txt"} {
+				if _, ok := objects[prefix+k]; !ok || k <= token {
+					continue
+				}
+				fmt.Fprintf(w, `<IsTruncated>true</IsTruncated><NextContinuationToken>%s</NextContinuationToken>`, k)
+				fmt.Fprintf(w, `<Contents><Key>%s</Key></Contents>`, prefix+k)
+				break
+			}
+			fmt.Fprint(w, `</ListBucketResult>`)
+			return
+		}
+
+		content, ok := objects[strings.TrimPrefix(r.URL.Path, "/releases/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Last-Modified", now.Format(http.TimeFormat))
+		w.Header().Set("X-Amz-Meta-Commit", "abc123")
+		io.WriteString(w, content)
+	}))
+	defer ts.Close()
+
+	cfg.Endpoint = ts.URL
+	s := New(cfg, ts.Client(), slog.Default())
+	s.now = func() time.Time { return now }
+
+	versions, err := s.ListVersions(context.Background(), "aws", "infra", "vpc")
+	if err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if exp := []string{"1.0.0", "1.1.0"}; !reflect.DeepEqual(versions, exp) {
+		t.Errorf("unexpected versions, exp: %v, got: %v", exp, versions)
+	}
+
+	_, err = s.ListVersions(context.Background(), "aws", "infra", "missing")
+	if sc, ok := err.(interface{ StatusCode() int }); !ok || sc.StatusCode() != http.StatusNotFound {
+		t.Errorf("expected not found, got: %v", err)
+	}
+
+	var buf strings.Builder
+	if err := s.ProxyDownload(context.Background(), "aws", "infra", "vpc", "1.1.0", &buf); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+	if buf.String() != "v1.1" {
+		t.Errorf("unexpected archive: %q", buf.String())
+	}
+
+	details, err := s.DescribeVersion(context.Background(), "aws", "infra", "vpc", "1.0.0")
+	if err != nil {
+		t.Fatalf("describe version: %s", err)
+	}
+	if details.Commit != "abc123" || !details.PublishedAt.Equal(now) {
+		t.Errorf("unexpected details: %+v", details)
+	}
+
+	// Links are only handed out when redirects are enabled.
+	link, err := s.DownloadLink(context.Background(), "aws", "infra", "vpc", "1.0.0")
+	if !errors.Is(err, modules.ErrLinkUnsupported) || link != "" {
+		t.Errorf("unexpected link: %q, %v", link, err)
+	}
+	s.cfg.Redirect = true
+	s.cfg.PresignExpiration = time.Minute
+	link, err = s.DownloadLink(context.Background(), "aws", "infra", "vpc", "1.0.0")
+	if err != nil {
+		t.Fatalf("download link: %s", err)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("parse link: %s", err)
+	}
+	if u.Path != "/releases/modules/infra/vpc/aws/1.0.0.tar.gz" || u.Query().Get("X-Amz-Expires") != "60" || u.Query().Get("X-Amz-Signature") == "" {
+		t.Errorf("unexpected link: %s", link)
+	}
+
+	if _, err := s.ListVersions(context.Background(), "aws", "..", "vpc"); err == nil {
+		t.Errorf("expected an error for an invalid address")
+	}
+}
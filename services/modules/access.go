@@ -0,0 +1,51 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// AccessChecker is implemented by repositories that restrict who can read the
+// modules, such as private repositories on GitHub. It returns an error if the
+// caller, as identified by the token in the context, lacks read access to the
+// repository.
+type AccessChecker interface {
+	CheckAccess(ctx context.Context, owner, repo string) error
+}
+
+// checkAccess asks the repository whether the caller has access, if it
+// restricts access at all.
+func checkAccess(ctx context.Context, r Repository, owner, repo string) error {
+	if c, ok := r.(AccessChecker); ok {
+		return c.CheckAccess(ctx, owner, repo)
+	}
+	return nil
+}
+
+// denied tells whether the error is a definite answer that the caller lacks
+// access, rather than a failure to find out, which should not be remembered.
+func denied(err error) bool {
+	var sc interface{ StatusCode() int }
+	if !errors.As(err, &sc) {
+		return false
+	}
+	switch sc.StatusCode() {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound:
+		return true
+	}
+	return false
+}
+
+// accessKey identifies the access of the token to the repository, without
+// keeping the token itself around.
+func accessKey(token, owner, repo string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:]) + " " + owner + "/" + repo
+}
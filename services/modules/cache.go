@@ -6,12 +6,44 @@ package modules
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
+
+	"github.com/hedlund/orbit/pkg/auth"
+	"github.com/hedlund/orbit/pkg/mcache"
+)
+
+const (
+	// maxAccessEntries is the number of remembered access checks at which the
+	// expired ones are cleaned up.
+	maxAccessEntries = 10000
+
+	// listedSuffix is appended to the key of the versions of a module, for
+	// keeping track of when they were listed.
+	listedSuffix = "@listed"
 )
 
+type CacheConfig struct {
+	// Expiration is how long the versions of a module are cached. Once
+	// expired, they are still served for the StaleWhileRevalidate period,
+	// while being listed again in the background, and for the StaleIfError
+	// period if the repository is having an outage.
+	Expiration           time.Duration `envconfig:"EXPIRATION" default:"10s"`
+	StaleWhileRevalidate time.Duration `envconfig:"STALE_WHILE_REVALIDATE" default:"1m"`
+	StaleIfError         time.Duration `envconfig:"STALE_IF_ERROR" default:"24h"`
+
+	// AccessExpiration is how long the result of checking that a caller has
+	// access to a repository is remembered, per token. Zero checks the access
+	// on every cache hit. Callers that have been granted access are still let
+	// through for the StaleIfError period, if the access can't be checked
+	// because the repository is having an outage.
+	AccessExpiration time.Duration `envconfig:"ACCESS_EXPIRATION" default:"1m"`
+}
+
 type KeyValueStore interface {
 	Get(key string) ([]string, bool)
 	Set(key string, value []string, d ...time.Duration)
@@ -22,57 +54,353 @@ type FileStorage interface {
 	Create(filename string) (io.WriteCloser, error)
 }
 
-func NewCache(r Repository, s KeyValueStore, f FileStorage, l Logger) *Cache {
-	return &Cache{f, l, r, s}
+// Aborter is implemented by the writers of file storages that can discard a
+// file that was only partially written, such as when a download fails.
+type Aborter interface {
+	Abort() error
+}
+
+// NewCache creates a cache in front of the repository. Repositories that
+// restrict access are asked whether the caller has access before anything is
+// served from the cache, so that private modules cached on behalf of one
+// caller are not served to another. Concurrent misses for the same module
+// share a single call to the repository.
+func NewCache(cfg CacheConfig, r Repository, s KeyValueStore, f FileStorage, l Logger) *Cache {
+	return &Cache{
+		cfg:    cfg,
+		access: mcache.New[string, error](cfg.AccessExpiration),
+		grants: mcache.New[string, struct{}](cfg.StaleIfError),
+		files:  f,
+		log:    l,
+		repo:   r,
+		store:  s,
+		now:    time.Now,
+	}
 }
 
 type Cache struct {
-	files FileStorage
-	log   Logger
-	repo  Repository
-	store KeyValueStore
+	cfg      CacheConfig
+	access   *mcache.Cache[string, error]
+	grants   *mcache.Cache[string, struct{}]
+	files    FileStorage
+	log      Logger
+	repo     Repository
+	store    KeyValueStore
+	versions group[[]string]
+	now      func() time.Time
+
+	mu      sync.Mutex
+	flights map[string]*flight
 }
 
 func (c *Cache) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
 	key := fmt.Sprintf("%s-%s-%s", owner, repo, module)
-	if v, ok := c.store.Get(key); ok {
-		return v, nil
+	cached, age, ok := c.lookup(key)
+	if ok && age <= c.cfg.Expiration+c.cfg.StaleWhileRevalidate {
+		err := c.authorize(ctx, owner, repo)
+		if notFound(err) {
+			// The repository can't be found by the caller, but the module may
+			// still be served by the repository from somewhere else, so leave
+			// it up to the repository, without touching the cache.
+			return c.repo.ListVersions(ctx, owner, repo, module)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if age > c.cfg.Expiration {
+			go c.revalidate(ctx, key, owner, repo, module)
+			c.stale(ctx, key, StaleWhileRevalidate, nil)
+		}
+		return cached, nil
+	}
+
+	v, err := c.sharedListVersions(ctx, key, owner, repo, module)
+	if err != nil && ok && age <= c.cfg.Expiration+c.cfg.StaleIfError && outage(err) {
+		// The caller must still have access, or have been granted it before
+		// if that can't be checked because of the same outage.
+		if aerr := c.authorize(ctx, owner, repo); aerr != nil {
+			return nil, err
+		}
+		c.stale(ctx, key, StaleIfError, err)
+		return cached, nil
+	}
+	return v, err
+}
+
+// sharedListVersions lists the versions, sharing the call with any concurrent
+// callers.
+func (c *Cache) sharedListVersions(ctx context.Context, key, owner, repo, module string) ([]string, error) {
+	v, shared, err := c.versions.do(ctx, key, c.listVersions(ctx, key, owner, repo, module))
+	if !shared || ctx.Err() != nil {
+		return v, err
 	}
 
-	v, err := c.repo.ListVersions(ctx, owner, repo, module)
+	// The versions were listed on behalf of someone else, so make sure that
+	// the caller has access as well, and try on its own if it was denied.
+	if denied(err) {
+		return c.repo.ListVersions(ctx, owner, repo, module)
+	}
 	if err != nil {
 		return nil, err
 	}
-
-	c.store.Set(key, v)
+	if err := c.authorize(ctx, owner, repo); notFound(err) {
+		return c.repo.ListVersions(ctx, owner, repo, module)
+	} else if err != nil {
+		return nil, err
+	}
 	return v, nil
 }
 
+// listVersions returns a function that lists the versions from the repository
+// and caches them. The call may be shared with concurrent callers, or made in
+// the background, so it must not be cancelled when the caller gives up.
+func (c *Cache) listVersions(ctx context.Context, key, owner, repo, module string) func() ([]string, error) {
+	return func() ([]string, error) {
+		v, err := c.repo.ListVersions(context.WithoutCancel(ctx), owner, repo, module)
+		if err != nil {
+			return nil, err
+		}
+
+		c.granted(ctx, owner, repo)
+
+		// The versions are kept beyond their expiration, so that they can be
+		// served while stale, along with the time they were listed.
+		d := c.cfg.Expiration + max(c.cfg.StaleWhileRevalidate, c.cfg.StaleIfError)
+		c.store.Set(key, v, d)
+		c.store.Set(key+listedSuffix, []string{c.now().Format(time.RFC3339Nano)}, d)
+		return v, nil
+	}
+}
+
+// revalidate lists the versions again, unless that's already in progress.
+func (c *Cache) revalidate(ctx context.Context, key, owner, repo, module string) {
+	ctx = context.WithoutCancel(ctx)
+	if _, _, err := c.versions.do(ctx, key, c.listVersions(ctx, key, owner, repo, module)); err != nil {
+		c.log.Error("failed to revalidate versions", "key", key, "err", err)
+	}
+}
+
+// lookup returns the cached versions along with how long ago they were
+// listed.
+func (c *Cache) lookup(key string) ([]string, time.Duration, bool) {
+	v, ok := c.store.Get(key)
+	if !ok {
+		return nil, 0, false
+	}
+	listed, ok := c.store.Get(key + listedSuffix)
+	if !ok || len(listed) != 1 {
+		return nil, 0, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, listed[0])
+	if err != nil {
+		return nil, 0, false
+	}
+	return v, c.now().Sub(t), true
+}
+
+// stale reports that stale versions are served, both in the log and to the
+// handler, so that the response can be marked.
+func (c *Cache) stale(ctx context.Context, key, reason string, err error) {
+	if err != nil {
+		c.log.Error("serving stale versions", "key", key, "stale", reason, "err", err)
+	} else {
+		c.log.Info("serving stale versions", "key", key, "stale", reason)
+	}
+	markStale(ctx, reason)
+}
+
 func (c *Cache) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
 	filename := fmt.Sprintf("%s-%s-%s-%s.tar.gz", owner, repo, module, version)
 	if r, err := c.files.Open(filename); err != nil {
 		// If we just fail to open the cached file, we'll just log the error and
 		// then re-download it from the repository as usual.
 		c.log.Error("failed to open cached file", "err", err)
-	} else if _, err := io.Copy(w, r); err != nil {
-		// Since the copy operation failed, we may have partially copied the
-		// file, so there's no point in trying to read the original.
-		c.log.Error("failed to copy cached file", "err", err)
-		return err
 	} else {
+		defer r.Close()
+
+		// The cached file may have been downloaded on behalf of someone else,
+		// so make sure that the caller has access to it as well.
+		err := c.authorize(ctx, owner, repo)
+		if notFound(err) {
+			return c.repo.ProxyDownload(ctx, owner, repo, module, version, w)
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			// Since the copy operation failed, we may have partially copied
+			// the file, so there's no point in trying to read the original.
+			c.log.Error("failed to copy cached file", "err", err)
+			return err
+		}
 		// At this point we have copied the cached file, so we are done.
 		return nil
 	}
 
-	if cw, err := c.files.Create(filename); err != nil {
-		// If we fail to create a cache file, we'll just proxy download directly
-		// from the repository without caching.
+	f, leader := c.join(filename)
+	if !leader {
+		// The download is made on behalf of someone else, so make sure that
+		// the caller has access to it before following it.
+		err := c.authorize(ctx, owner, repo)
+		if notFound(err) {
+			return c.repo.ProxyDownload(ctx, owner, repo, module, version, w)
+		}
+		if err != nil {
+			return err
+		}
+		n, err := f.follow(ctx, w)
+		if n == 0 && denied(err) {
+			// The access of whoever made the download doesn't tell anything
+			// about the caller's, so try on our own. Any other failure is
+			// shared, rather than having every follower retry it.
+			return c.repo.ProxyDownload(ctx, owner, repo, module, version, w)
+		}
+		return err
+	}
+
+	cw, err := c.files.Create(filename)
+	if err != nil {
+		// If we fail to create a cache file, the download is still shared
+		// with the followers, just not cached.
 		c.log.Error("failed to create cached file", "err", err)
-	} else {
-		defer cw.Close()
-		w = io.MultiWriter(w, cw)
+		cw = nil
+	}
+
+	// The download goes to the flight, which the caller follows like everyone
+	// else, and isn't cancelled along with the caller, so that it completes for
+	// the followers.
+	go func(ctx context.Context) {
+		tw := &cacheWriter{f: f, w: cw}
+		err := c.repo.ProxyDownload(ctx, owner, repo, module, version, tw)
+		if cw != nil {
+			if tw.err != nil {
+				c.log.Error("failed to write cached file", "err", tw.err)
+			}
+			c.finish(cw, errors.Join(err, tw.err))
+		}
+		if err == nil {
+			c.granted(ctx, owner, repo)
+		}
+		c.land(filename, f, err)
+	}(context.WithoutCancel(ctx))
+
+	_, err = f.follow(ctx, w)
+	return err
+}
+
+// join returns the download of the file in progress, or starts a new one if
+// there is none, in which case the caller is the leader that must land it.
+func (c *Cache) join(filename string) (*flight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.flights[filename]; ok {
+		return f, false
+	}
+	if c.flights == nil {
+		c.flights = make(map[string]*flight)
+	}
+	f := newFlight()
+	c.flights[filename] = f
+	return f, true
+}
+
+func (c *Cache) land(filename string, f *flight, err error) {
+	c.mu.Lock()
+	delete(c.flights, filename)
+	c.mu.Unlock()
+
+	f.finish(err)
+}
+
+// finish closes the cached file, unless the download, or writing the file,
+// failed, in which case it is aborted if the storage allows it, so that the
+// partial file isn't served later on.
+func (c *Cache) finish(cw io.WriteCloser, err error) {
+	if a, ok := cw.(Aborter); ok && err != nil {
+		if err := a.Abort(); err != nil {
+			c.log.Error("failed to abort cached file", "err", err)
+		}
+		return
+	}
+	if err := cw.Close(); err != nil {
+		c.log.Error("failed to close cached file", "err", err)
+	}
+}
+
+// DescribeVersion passes the call through to the underlying repository, if it
+// is able to describe versions. The details are not cached.
+func (c *Cache) DescribeVersion(ctx context.Context, owner, repo, module, version string) (*VersionDetails, error) {
+	if d, ok := c.repo.(Describer); ok {
+		return d.DescribeVersion(ctx, owner, repo, module, version)
+	}
+	return &VersionDetails{}, nil
+}
+
+// DownloadLink passes the call through to the underlying repository. Linked
+// archives are never cached, as they are not proxied.
+func (c *Cache) DownloadLink(ctx context.Context, owner, repo, module, version string) (string, error) {
+	return downloadLink(ctx, c.repo, owner, repo, module, version)
+}
+
+// CheckAccess passes the call through to the underlying repository, without
+// remembering the result.
+func (c *Cache) CheckAccess(ctx context.Context, owner, repo string) error {
+	return checkAccess(ctx, c.repo, owner, repo)
+}
+
+// authorize checks that the caller has access to the repository, remembering
+// the answer for a while, unless the check itself failed. If it failed because
+// of an outage, callers that have been granted access before are let through.
+func (c *Cache) authorize(ctx context.Context, owner, repo string) error {
+	if _, ok := c.repo.(AccessChecker); !ok {
+		return nil
+	}
+
+	key := accessKey(auth.GetToken(ctx, ""), owner, repo)
+	if err, ok := c.access.Get(key); ok {
+		return err
+	}
+
+	err := checkAccess(ctx, c.repo, owner, repo)
+	if err != nil && !denied(err) {
+		if _, ok := c.grants.Get(key); ok && outage(err) {
+			c.log.Error("failed to check access, using earlier grant", "err", err)
+			return nil
+		}
+		return err
+	}
+	c.remember(key, err)
+	return err
+}
+
+// granted remembers that the caller has access to the repository, as the
+// repository just served a request on its behalf.
+func (c *Cache) granted(ctx context.Context, owner, repo string) {
+	if _, ok := c.repo.(AccessChecker); ok {
+		c.remember(accessKey(auth.GetToken(ctx, ""), owner, repo), nil)
+	}
+}
+
+func (c *Cache) remember(key string, err error) {
+	if c.cfg.StaleIfError > 0 {
+		if c.grants.Count() >= maxAccessEntries {
+			c.grants.Cleanup()
+		}
+		if err == nil {
+			c.grants.Set(key, struct{}{})
+		} else {
+			c.grants.Delete(key)
+		}
+	}
+
+	if c.cfg.AccessExpiration <= 0 {
+		return
+	}
+	if c.access.Count() >= maxAccessEntries {
+		c.access.Cleanup()
 	}
-	return c.repo.ProxyDownload(ctx, owner, repo, module, version, w)
+	c.access.Set(key, err)
 }
 
 // StoreInPath implements the FileStorage interface by storing files locally on
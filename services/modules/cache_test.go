@@ -0,0 +1,541 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/auth"
+	"github.com/hedlund/orbit/pkg/diskcache"
+	"github.com/hedlund/orbit/pkg/mcache"
+)
+
+func TestCacheAccess(t *testing.T) {
+	repo := &accessRepository{
+		mockRepository: mockRepository{versions: []string{"1.0.0"}},
+		tokens: map[string]error{
+			"alice": nil,
+			"bob":   statusErr(http.StatusNotFound),
+			"carol": statusErr(http.StatusForbidden),
+		},
+	}
+	dir := t.TempDir()
+	c := NewCache(CacheConfig{Expiration: time.Minute, AccessExpiration: time.Minute}, repo, mcache.New[string, []string](time.Minute), StoreInPath(dir), slog.Default())
+
+	alice := auth.WithToken(context.Background(), "alice")
+	if _, err := c.ListVersions(alice, "acme", "infra", "vpc"); err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "acme-infra-vpc-1.0.0.tar.gz"), []byte("private"), 0o644); err != nil {
+		t.Fatalf("writing cached file: %s", err)
+	}
+
+	// Served from the cache, without checking the access again, since it was
+	// granted when the versions were listed.
+	var buf strings.Builder
+	if err := c.ProxyDownload(alice, "acme", "infra", "vpc", "1.0.0", &buf); err != nil || buf.String() != "private" {
+		t.Errorf("unexpected download: %q, %v", buf.String(), err)
+	}
+	if _, err := c.ListVersions(alice, "acme", "infra", "vpc"); err != nil {
+		t.Errorf("list versions: %s", err)
+	}
+	if repo.checks != 0 {
+		t.Errorf("unexpected number of checks: %d", repo.checks)
+	}
+
+	// Callers who can't find the repository are left to the repository,
+	// which can't find it either.
+	bob := auth.WithToken(context.Background(), "bob")
+	repo.err = statusErr(http.StatusNotFound)
+	if err := c.ProxyDownload(bob, "acme", "infra", "vpc", "1.0.0", io.Discard); !notFound(err) {
+		t.Errorf("expected not found, got: %v", err)
+	}
+	if _, err := c.ListVersions(bob, "acme", "infra", "vpc"); !notFound(err) {
+		t.Errorf("expected not found, got: %v", err)
+	}
+
+	carol := auth.WithToken(context.Background(), "carol")
+	for i := 0; i < 2; i++ {
+		if _, err := c.ListVersions(carol, "acme", "infra", "vpc"); !denied(err) {
+			t.Errorf("expected forbidden, got: %v", err)
+		}
+	}
+	if exp := 2; repo.checks != exp {
+		t.Errorf("unexpected number of checks, exp: %d, got: %d", exp, repo.checks)
+	}
+
+	// Repositories that don't restrict access are served as before.
+	open := NewCache(CacheConfig{}, &mockRepository{versions: []string{"1.0.0"}}, mcache.New[string, []string](time.Minute), StoreInPath(dir), slog.Default())
+	for i := 0; i < 2; i++ {
+		versions, err := open.ListVersions(bob, "acme", "infra", "vpc")
+		if err != nil || !reflect.DeepEqual(versions, []string{"1.0.0"}) {
+			t.Errorf("unexpected versions: %v, %v", versions, err)
+		}
+	}
+}
+
+type accessRepository struct {
+	mockRepository
+	tokens map[string]error
+	checks int
+}
+
+func (m *accessRepository) CheckAccess(ctx context.Context, owner, repo string) error {
+	m.checks++
+	return m.tokens[auth.GetToken(ctx, "")]
+}
+
+func TestCacheAbort(t *testing.T) {
+	repo := &mockRepository{err: errors.New("connection reset")}
+	files := &mockStorage{}
+	c := NewCache(CacheConfig{}, repo, mcache.New[string, []string](time.Minute), files, slog.Default())
+
+	if err := c.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", io.Discard); err == nil {
+		t.Fatalf("expected an error")
+	}
+	if !files.writer.aborted || files.writer.closed {
+		t.Errorf("expected the cached file to be aborted, got: %+v", files.writer)
+	}
+
+	repo.err = nil
+	if err := c.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", io.Discard); err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+	if files.writer.aborted || !files.writer.closed {
+		t.Errorf("expected the cached file to be closed, got: %+v", files.writer)
+	}
+}
+
+type mockStorage struct {
+	writer *mockWriter
+}
+
+func (m *mockStorage) Open(filename string) (io.ReadCloser, error) {
+	return nil, os.ErrNotExist
+}
+
+func (m *mockStorage) Create(filename string) (io.WriteCloser, error) {
+	m.writer = &mockWriter{}
+	return m.writer, nil
+}
+
+type mockWriter struct {
+	aborted bool
+	closed  bool
+}
+
+func (m *mockWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (m *mockWriter) Close() error                { m.closed = true; return nil }
+func (m *mockWriter) Abort() error                { m.aborted = true; return nil }
+
+func TestCacheCoalescing(t *testing.T) {
+	const callers = 5
+	repo := &slowRepository{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		checked: make(chan struct{}, callers),
+	}
+	files, err := diskcache.New(diskcache.Config{Path: t.TempDir()}, slog.Default())
+	if err != nil {
+		t.Fatalf("new storage: %s", err)
+	}
+	c := NewCache(CacheConfig{Expiration: time.Minute, AccessExpiration: time.Minute}, repo, mcache.New[string, []string](time.Minute), files, slog.Default())
+
+	var wg sync.WaitGroup
+	results := make([]string, callers)
+	download := func(n int) {
+		defer wg.Done()
+		var buf strings.Builder
+		ctx := auth.WithToken(context.Background(), fmt.Sprintf("token-%d", n))
+		if err := c.ProxyDownload(ctx, "acme", "infra", "vpc", "1.0.0", &buf); err != nil {
+			t.Errorf("proxy download: %s", err)
+		}
+		results[n] = buf.String()
+	}
+
+	// The others join once the first download is in progress, and are let
+	// through to check their access before it completes.
+	wg.Add(callers)
+	go download(0)
+	<-repo.started
+	for n := 1; n < callers; n++ {
+		go download(n)
+	}
+	for n := 1; n < callers; n++ {
+		<-repo.checked
+	}
+	close(repo.release)
+	wg.Wait()
+
+	if repo.downloads.Load() != 1 {
+		t.Errorf("unexpected number of downloads: %d", repo.downloads.Load())
+	}
+	for n, got := range results {
+		if got != "first,second" {
+			t.Errorf("%d: unexpected content: %q", n, got)
+		}
+	}
+
+	wg.Add(callers)
+	versions := make([][]string, callers)
+	for n := 0; n < callers; n++ {
+		go func(n int) {
+			defer wg.Done()
+			v, err := c.ListVersions(context.Background(), "acme", "infra", "vpc")
+			if err != nil {
+				t.Errorf("list versions: %s", err)
+			}
+			versions[n] = v
+		}(n)
+	}
+	wg.Wait()
+
+	if repo.lists.Load() != 1 {
+		t.Errorf("unexpected number of listings: %d", repo.lists.Load())
+	}
+	for n, v := range versions {
+		if !reflect.DeepEqual(v, []string{"1.0.0"}) {
+			t.Errorf("%d: unexpected versions: %v", n, v)
+		}
+	}
+}
+
+// slowRepository writes the first part of the archive, and then waits to be
+// released before writing the rest.
+type slowRepository struct {
+	started   chan struct{}
+	release   chan struct{}
+	checked   chan struct{}
+	err       error
+	downloads atomic.Int32
+	lists     atomic.Int32
+}
+
+func (m *slowRepository) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	m.lists.Add(1)
+	time.Sleep(10 * time.Millisecond)
+	return []string{"1.0.0"}, nil
+}
+
+func (m *slowRepository) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	m.downloads.Add(1)
+	io.WriteString(w, "first,")
+	close(m.started)
+	<-m.release
+	if m.err != nil {
+		return m.err
+	}
+	_, err := io.WriteString(w, "second")
+	return err
+}
+
+func (m *slowRepository) CheckAccess(ctx context.Context, owner, repo string) error {
+	m.checked <- struct{}{}
+	return nil
+}
+
+func TestCacheFollow(t *testing.T) {
+	repo := &slowRepository{
+		started: make(chan struct{}),
+		release: make(chan struct{}),
+		checked: make(chan struct{}, 1),
+	}
+	files := &memStorage{files: make(map[string]string)}
+	c := NewCache(CacheConfig{}, repo, mcache.New[string, []string](time.Minute), files, slog.Default())
+
+	// The file being written can't be read while in progress, but the
+	// follower is still streamed the download as it's made, even after the
+	// leader gives up.
+	leader, cancel := context.WithCancel(context.Background())
+	leaderErr := make(chan error)
+	go func() {
+		leaderErr <- c.ProxyDownload(leader, "acme", "infra", "vpc", "1.0.0", io.Discard)
+	}()
+	<-repo.started
+
+	w := &chanWriter{writes: make(chan string, 2)}
+	followerErr := make(chan error)
+	go func() {
+		followerErr <- c.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", w)
+	}()
+	<-repo.checked
+	if got := <-w.writes; got != "first," {
+		t.Errorf("unexpected first part: %q", got)
+	}
+
+	cancel()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the leader to be cancelled, got: %v", err)
+	}
+	close(repo.release)
+	if err := <-followerErr; err != nil {
+		t.Fatalf("proxy download: %s", err)
+	}
+
+	if got := <-w.writes; got != "second" {
+		t.Errorf("unexpected second part: %q", got)
+	}
+	if repo.downloads.Load() != 1 {
+		t.Errorf("unexpected number of downloads: %d", repo.downloads.Load())
+	}
+	if got := files.get("acme-infra-vpc-1.0.0.tar.gz"); got != "first,second" {
+		t.Errorf("unexpected cached content: %q", got)
+	}
+}
+
+func TestCacheFollowFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		repoErr  error
+		writeErr error
+		closeErr error
+		expErr   bool
+		expBody  string
+	}{
+		{"download", errors.New("connection reset"), nil, nil, true, "first,"},
+		{"write", nil, errors.New("disk full"), nil, false, "first,second"},
+		{"close", nil, nil, errors.New("disk full"), false, "first,second"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			const callers = 3
+			repo := &slowRepository{
+				started: make(chan struct{}),
+				release: make(chan struct{}),
+				checked: make(chan struct{}, callers),
+				err:     tt.repoErr,
+			}
+			files := &memStorage{files: make(map[string]string), writeErr: tt.writeErr, closeErr: tt.closeErr}
+			c := NewCache(CacheConfig{}, repo, mcache.New[string, []string](time.Minute), files, slog.Default())
+
+			var wg sync.WaitGroup
+			results := make([]string, callers)
+			errs := make([]error, callers)
+			download := func(n int) {
+				defer wg.Done()
+				var buf strings.Builder
+				errs[n] = c.ProxyDownload(context.Background(), "acme", "infra", "vpc", "1.0.0", &buf)
+				results[n] = buf.String()
+			}
+
+			wg.Add(callers)
+			go download(0)
+			<-repo.started
+			for n := 1; n < callers; n++ {
+				go download(n)
+			}
+			for n := 1; n < callers; n++ {
+				<-repo.checked
+			}
+			close(repo.release)
+			wg.Wait()
+
+			// Neither the followers nor the leader go back to the repository,
+			// whether the download or the caching of it failed.
+			if repo.downloads.Load() != 1 {
+				t.Errorf("unexpected number of downloads: %d", repo.downloads.Load())
+			}
+			for n := range results {
+				if (errs[n] != nil) != tt.expErr {
+					t.Errorf("%d: unexpected error: %v", n, errs[n])
+				}
+				if results[n] != tt.expBody {
+					t.Errorf("%d: unexpected content: %q", n, results[n])
+				}
+			}
+			if got := files.get("acme-infra-vpc-1.0.0.tar.gz"); got != "" {
+				t.Errorf("unexpected cached content: %q", got)
+			}
+		})
+	}
+}
+
+// chanWriter sends every write on the channel, so that it can be told when
+// the parts of a download arrive.
+type chanWriter struct {
+	writes chan string
+}
+
+func (c *chanWriter) Write(p []byte) (int, error) {
+	c.writes <- string(p)
+	return len(p), nil
+}
+
+// memStorage keeps the files in memory, where they can't be read until they
+// have been written completely. Its writers have no name to follow them by,
+// and fail with the given errors, if any.
+type memStorage struct {
+	mu       sync.Mutex
+	files    map[string]string
+	writeErr error
+	closeErr error
+}
+
+func (m *memStorage) get(filename string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.files[filename]
+}
+
+func (m *memStorage) Open(filename string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if content, ok := m.files[filename]; ok {
+		return io.NopCloser(strings.NewReader(content)), nil
+	}
+	return nil, os.ErrNotExist
+}
+
+func (m *memStorage) Create(filename string) (io.WriteCloser, error) {
+	return &memWriter{storage: m, filename: filename}, nil
+}
+
+type memWriter struct {
+	strings.Builder
+	storage  *memStorage
+	filename string
+}
+
+func (m *memWriter) Write(p []byte) (int, error) {
+	if m.storage.writeErr != nil {
+		return 0, m.storage.writeErr
+	}
+	return m.Builder.Write(p)
+}
+
+// Abort discards the file, as it is only stored once closed.
+func (m *memWriter) Abort() error {
+	return nil
+}
+
+func (m *memWriter) Close() error {
+	if m.storage.closeErr != nil {
+		return m.storage.closeErr
+	}
+	m.storage.mu.Lock()
+	defer m.storage.mu.Unlock()
+	m.storage.files[m.filename] = m.String()
+	return nil
+}
+
+func TestCacheStale(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo := &mockRepository{versions: []string{"1.0.0"}}
+	cfg := CacheConfig{Expiration: 10 * time.Second, StaleWhileRevalidate: time.Minute, StaleIfError: time.Hour}
+	c := NewCache(cfg, repo, mcache.New[string, []string](mcache.NoExpiration), StoreInPath(t.TempDir()), slog.Default())
+	c.now = func() time.Time { return now }
+
+	handler := &Handler{log: slog.Default(), repo: c}
+	list := func() (*httptest.ResponseRecorder, string) {
+		rr := httptest.NewRecorder()
+		h := route("/v1/modules/:namespace/:name/:system/versions", handler.ListVersions)
+		h.ServeHTTP(rr, mockRequest(t, "/v1/modules/infra/vpc/aws/versions"))
+		return rr, strings.TrimSpace(rr.Body.String())
+	}
+	const (
+		v1 = `{"modules":[{"versions":[{"version":"1.0.0"}]}]}`
+		v2 = `{"modules":[{"versions":[{"version":"2.0.0"}]}]}`
+	)
+
+	if _, body := list(); body != v1 {
+		t.Fatalf("unexpected response: %s", body)
+	}
+
+	// Expired versions are served while being listed again.
+	now = now.Add(15 * time.Second)
+	repo.versions = []string{"2.0.0"}
+	rr, body := list()
+	if body != v1 || rr.Header().Get(StaleHeader) != StaleWhileRevalidate {
+		t.Errorf("unexpected stale response: %s, %v", body, rr.Header())
+	}
+	for deadline := time.Now().Add(time.Second); ; {
+		if _, age, _ := c.lookup("aws-infra-vpc"); age == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("versions were not revalidated")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if rr, body := list(); body != v2 || rr.Header().Get(StaleHeader) != "" {
+		t.Errorf("unexpected revalidated response: %s, %v", body, rr.Header())
+	}
+
+	// Beyond that, they are only served if the repository is down.
+	now = now.Add(5 * time.Minute)
+	repo.err = statusErr(http.StatusBadGateway)
+	if rr, body := list(); body != v2 || rr.Header().Get(StaleHeader) != StaleIfError {
+		t.Errorf("unexpected stale response: %s, %v", body, rr.Header())
+	}
+	repo.err = statusErr(http.StatusNotFound)
+	if rr, _ := list(); rr.Code != http.StatusNotFound {
+		t.Errorf("unexpected status code: %d", rr.Code)
+	}
+
+	now = now.Add(2 * time.Hour)
+	repo.err = statusErr(http.StatusBadGateway)
+	if rr, _ := list(); rr.Code != http.StatusBadGateway {
+		t.Errorf("unexpected status code: %d", rr.Code)
+	}
+}
+
+func TestCacheStaleAccess(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	repo := &accessRepository{
+		mockRepository: mockRepository{versions: []string{"1.0.0"}},
+		tokens:         map[string]error{},
+	}
+	cfg := CacheConfig{Expiration: 10 * time.Second, StaleIfError: time.Hour}
+	c := NewCache(cfg, repo, mcache.New[string, []string](mcache.NoExpiration), StoreInPath(t.TempDir()), slog.Default())
+	c.now = func() time.Time { return now }
+
+	alice := auth.WithToken(context.Background(), "alice")
+	dave := auth.WithToken(context.Background(), "dave")
+	if _, err := c.ListVersions(alice, "acme", "infra", "vpc"); err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+
+	// During an outage, the access can't be checked, so the cached versions
+	// are only served to callers that have been granted access before, both
+	// while fresh and stale.
+	repo.tokens = map[string]error{
+		"alice": statusErr(http.StatusBadGateway),
+		"dave":  statusErr(http.StatusBadGateway),
+	}
+	for _, age := range []time.Duration{time.Second, 5 * time.Minute} {
+		now = now.Add(age)
+		repo.err = statusErr(http.StatusBadGateway)
+		if v, err := c.ListVersions(alice, "acme", "infra", "vpc"); err != nil || !reflect.DeepEqual(v, []string{"1.0.0"}) {
+			t.Errorf("%s: unexpected versions: %v, %v", age, v, err)
+		}
+		if _, err := c.ListVersions(dave, "acme", "infra", "vpc"); !outage(err) {
+			t.Errorf("%s: expected an outage, got: %v", age, err)
+		}
+	}
+
+	// Callers that have since been denied are not let through.
+	repo.err = nil
+	if _, err := c.ListVersions(alice, "acme", "infra", "vpc"); err != nil {
+		t.Fatalf("list versions: %s", err)
+	}
+	repo.tokens["alice"] = statusErr(http.StatusForbidden)
+	if _, err := c.ListVersions(alice, "acme", "infra", "vpc"); !denied(err) {
+		t.Errorf("expected forbidden, got: %v", err)
+	}
+	repo.tokens["alice"] = statusErr(http.StatusBadGateway)
+	if _, err := c.ListVersions(alice, "acme", "infra", "vpc"); !outage(err) {
+		t.Errorf("expected an outage, got: %v", err)
+	}
+}
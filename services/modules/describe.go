@@ -0,0 +1,96 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Describer is implemented by repositories that can provide details about a
+// published module version, beyond the contents of the module itself.
+type Describer interface {
+	DescribeVersion(ctx context.Context, owner, repo, module, version string) (*VersionDetails, error)
+}
+
+type VersionDetails struct {
+	Commit      string
+	PublishedAt time.Time
+}
+
+// maxInspectBytes is the most that is read of any README or configuration
+// file when inspecting a module.
+const maxInspectBytes = 1 << 20
+
+type moduleRoot struct {
+	Path    string   `json:"path"`
+	Readme  string   `json:"readme"`
+	Inputs  []Input  `json:"inputs"`
+	Outputs []Output `json:"outputs"`
+}
+
+// inspect reads a module archive (gzipped tar) and extracts the README and the
+// interface of the root module.
+func inspect(r io.Reader) (*moduleRoot, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("read gzip: %w", err)
+	}
+	defer zr.Close()
+
+	root := &moduleRoot{
+		Inputs:  []Input{},
+		Outputs: []Output{},
+	}
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading tar: %w", err)
+		}
+
+		name := path.Clean(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || strings.Contains(name, "/") {
+			continue
+		}
+
+		lr := io.LimitReader(tr, maxInspectBytes)
+		switch {
+		case strings.EqualFold(name, "README.md") || strings.EqualFold(name, "README"):
+			b, err := io.ReadAll(lr)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", name, err)
+			}
+			root.Readme = string(b)
+		case strings.HasSuffix(name, ".tf"):
+			b, err := io.ReadAll(lr)
+			if err != nil {
+				return nil, fmt.Errorf("reading %s: %w", name, err)
+			}
+			inputs, outputs := parseConfig(b)
+			root.Inputs = append(root.Inputs, inputs...)
+			root.Outputs = append(root.Outputs, outputs...)
+		}
+	}
+
+	sort.Slice(root.Inputs, func(i, j int) bool {
+		return root.Inputs[i].Name < root.Inputs[j].Name
+	})
+	sort.Slice(root.Outputs, func(i, j int) bool {
+		return root.Outputs[i].Name < root.Outputs[j].Name
+	})
+	return root, nil
+}
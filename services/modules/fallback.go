@@ -0,0 +1,113 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+)
+
+// ErrNotAllowed is wrapped by the errors of repositories refusing modules that
+// aren't among the ones they are allowed to serve. As far as the fallback is
+// concerned, such modules are not found, and may be looked up elsewhere.
+var ErrNotAllowed = errors.New("not a valid repository")
+
+// NewFallback creates a repository that serves the modules of the primary
+// repository, and forwards the ones it cannot find to the secondary, such as
+// an upstream registry. Only the namespaces matching the patterns, using
+// `path.Match`, are forwarded, so that a module missing from our own
+// namespaces can't be replaced by someone publishing it upstream.
+func NewFallback(primary, secondary Repository, namespaces ...string) (*Fallback, error) {
+	for _, pattern := range namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid namespace pattern %q: %w", pattern, err)
+		}
+	}
+	return &Fallback{primary, secondary, namespaces}, nil
+}
+
+type Fallback struct {
+	primary    Repository
+	secondary  Repository
+	namespaces []string
+}
+
+func (f *Fallback) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	v, err := f.primary.ListVersions(ctx, owner, repo, module)
+	if (err == nil && len(v) > 0) || (err != nil && !notFound(err)) || !f.forwarded(repo) {
+		return v, err
+	}
+	return f.secondary.ListVersions(ctx, owner, repo, module)
+}
+
+// ProxyDownload only falls back if the primary repository has not written
+// anything, as the archive would otherwise be corrupt.
+func (f *Fallback) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	cw := &countingWriter{w: w}
+	err := f.primary.ProxyDownload(ctx, owner, repo, module, version, cw)
+	if err == nil || cw.n > 0 || !notFound(err) || !f.forwarded(repo) {
+		return err
+	}
+	return f.secondary.ProxyDownload(ctx, owner, repo, module, version, w)
+}
+
+// DescribeVersion asks the primary repository first, and the secondary if the
+// version is not found, given that they are able to describe versions.
+func (f *Fallback) DescribeVersion(ctx context.Context, owner, repo, module, version string) (*VersionDetails, error) {
+	if d, ok := f.primary.(Describer); ok {
+		v, err := d.DescribeVersion(ctx, owner, repo, module, version)
+		if err == nil || !notFound(err) || !f.forwarded(repo) {
+			return v, err
+		}
+	}
+	if d, ok := f.secondary.(Describer); ok && f.forwarded(repo) {
+		return d.DescribeVersion(ctx, owner, repo, module, version)
+	}
+	return &VersionDetails{}, nil
+}
+
+// DownloadLink asks the primary repository for a link, and leaves the modules
+// it cannot find to be proxied, since the secondary may hold them.
+func (f *Fallback) DownloadLink(ctx context.Context, owner, repo, module, version string) (string, error) {
+	link, err := downloadLink(ctx, f.primary, owner, repo, module, version)
+	if err != nil && notFound(err) && f.forwarded(repo) {
+		return "", nil
+	}
+	return link, err
+}
+
+// forwarded checks if the modules of the namespace may be looked up in the
+// secondary repository.
+func (f *Fallback) forwarded(namespace string) bool {
+	for _, pattern := range f.namespaces {
+		if match(pattern, namespace) {
+			return true
+		}
+	}
+	return false
+}
+
+func notFound(err error) bool {
+	if errors.Is(err, ErrNotAllowed) {
+		return true
+	}
+	var sc interface{ StatusCode() int }
+	return errors.As(err, &sc) && sc.StatusCode() == http.StatusNotFound
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
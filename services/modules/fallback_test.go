@@ -0,0 +1,68 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestFallback(t *testing.T) {
+	upstream := &mockRepository{versions: []string{"upstream"}}
+
+	tests := []struct {
+		name      string
+		primary   *mockRepository
+		namespace string
+		exp       []string
+		expError  bool
+	}{
+		{"found", &mockRepository{versions: []string{"1.0.0"}}, "infra", []string{"1.0.0"}, false},
+		{"empty", &mockRepository{versions: []string{}}, "infra", []string{"upstream"}, false},
+		{"not found", &mockRepository{err: statusErr(http.StatusNotFound)}, "infra", []string{"upstream"}, false},
+		{"not allowed", &mockRepository{err: fmt.Errorf("refused: %w", ErrNotAllowed)}, "infra", []string{"upstream"}, false},
+		{"failure", &mockRepository{err: statusErr(http.StatusBadGateway)}, "infra", nil, true},
+		{"other error", &mockRepository{err: errors.New("boom")}, "infra", nil, true},
+		{"own empty", &mockRepository{versions: []string{}}, "acme", []string{}, false},
+		{"own not found", &mockRepository{err: statusErr(http.StatusNotFound)}, "acme", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := NewFallback(tt.primary, upstream, "infra", "hashicorp-*")
+			if err != nil {
+				t.Fatalf("new fallback: %s", err)
+			}
+			versions, err := f.ListVersions(context.Background(), "aws", tt.namespace, "vpc")
+			if (err != nil) != tt.expError {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(versions, tt.exp) {
+				t.Errorf("unexpected versions, exp: %v, got: %v", tt.exp, versions)
+			}
+
+			err = f.ProxyDownload(context.Background(), "aws", tt.namespace, "vpc", "1.0.0", io.Discard)
+			if (err != nil) != tt.expError {
+				t.Errorf("unexpected download error: %v", err)
+			}
+		})
+	}
+}
+
+func TestFallbackPatterns(t *testing.T) {
+	if _, err := NewFallback(&mockRepository{}, &mockRepository{}, "["); err == nil {
+		t.Error("expected an invalid pattern to fail")
+	}
+}
+
+type statusErr int
+
+func (e statusErr) Error() string {
+	return http.StatusText(int(e))
+}
+
+func (e statusErr) StatusCode() int {
+	return int(e)
+}
@@ -0,0 +1,158 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// group coalesces concurrent calls with the same key into one, whose result
+// is shared by all the callers.
+type group[V any] struct {
+	mu    sync.Mutex
+	calls map[string]*call[V]
+}
+
+type call[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+}
+
+// do calls the function, unless a call with the same key is already in
+// progress, in which case its result is returned instead. The call is made in
+// the background, so that a caller giving up doesn't affect the others. The
+// returned flag tells whether the result was shared from another caller.
+func (g *group[V]) do(ctx context.Context, key string, fn func() (V, error)) (V, bool, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call[V])
+	}
+	c, shared := g.calls[key]
+	if !shared {
+		c = &call[V]{done: make(chan struct{})}
+		g.calls[key] = c
+		go func() {
+			c.val, c.err = fn()
+			g.mu.Lock()
+			delete(g.calls, key)
+			g.mu.Unlock()
+			close(c.done)
+		}()
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-c.done:
+		return c.val, shared, c.err
+	case <-ctx.Done():
+		var empty V
+		return empty, shared, ctx.Err()
+	}
+}
+
+// flight is a download in progress, which is buffered in memory as it's being
+// written, so that other callers can follow it regardless of where it's
+// cached, or whether caching it works at all.
+type flight struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	done bool
+	err  error
+}
+
+func newFlight() *flight {
+	f := &flight{}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// Write appends to the buffer, and wakes up the followers.
+func (f *flight) Write(b []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.buf = append(f.buf, b...)
+	f.cond.Broadcast()
+	return len(b), nil
+}
+
+func (f *flight) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+}
+
+// wait blocks until the condition holds, the flight is done or the context is
+// cancelled. It must be called with the lock held.
+func (f *flight) wait(ctx context.Context, cond func() bool) error {
+	stop := context.AfterFunc(ctx, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		f.cond.Broadcast()
+	})
+	defer stop()
+
+	for !cond() && !f.done {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		f.cond.Wait()
+	}
+	return ctx.Err()
+}
+
+// follow copies the download to the writer as it's being written, returning
+// the number of bytes copied along with the error of the download.
+func (f *flight) follow(ctx context.Context, w io.Writer) (int64, error) {
+	var copied int
+	for {
+		f.mu.Lock()
+		err := f.wait(ctx, func() bool { return len(f.buf) > copied })
+		// The buffer is only ever appended to, so what has been written so
+		// far can be read without holding the lock.
+		b, done, ferr := f.buf[copied:], f.done, f.err
+		f.mu.Unlock()
+		if err != nil {
+			return int64(copied), err
+		}
+
+		if len(b) > 0 {
+			n, err := w.Write(b)
+			copied += n
+			if err != nil {
+				return int64(copied), err
+			}
+			continue
+		}
+		if done {
+			return int64(copied), ferr
+		}
+	}
+}
+
+// cacheWriter writes a download to its flight, and to the cached file for as
+// long as that works. A cached file that fails doesn't fail the download, as
+// the followers are served from the flight.
+type cacheWriter struct {
+	f   *flight
+	w   io.Writer
+	err error
+}
+
+func (c *cacheWriter) Write(b []byte) (int, error) {
+	if c.w != nil && c.err == nil {
+		if _, err := c.w.Write(b); err != nil {
+			c.err = err
+		}
+	}
+	return c.f.Write(b)
+}
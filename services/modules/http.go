@@ -6,35 +6,24 @@ package modules
 
 import (
 	"context"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/hedlund/orbit/pkg/archive"
 	"github.com/hedlund/orbit/pkg/auth"
 	"github.com/hedlund/orbit/pkg/router"
 )
 
-var (
-	errInvalidToken = errors.New("invalid token")
-	errTokenExpired = errors.New("token expired")
-)
-
 type Config struct {
+	ArchiveFormat   string        `envconfig:"ARCHIVE_FORMAT" default:"tar.gz"`
 	ProxySecret     []byte        `envconfig:"PROXY_SECRET" required:"true"`
 	TokenExpiration time.Duration `envconfig:"TOKEN_EXPIRATION" default:"60s"`
-}
-
-type Cipher interface {
-	Seal(dst, nonce, plaintext, additionalData []byte) []byte
-	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
-	NonceSize() int
+	Versions        VersionsConfig
 }
 
 type Logger interface {
@@ -48,30 +37,28 @@ type Repository interface {
 }
 
 func NewHTTP(cfg Config, log Logger, r Repository) (*Handler, error) {
-	c, err := aes.NewCipher(cfg.ProxySecret)
-	if err != nil {
-		return nil, err
+	if !archive.Supported(cfg.ArchiveFormat) {
+		return nil, fmt.Errorf("%w: %q", archive.ErrUnknownFormat, cfg.ArchiveFormat)
 	}
-	gcm, err := cipher.NewGCM(c)
+
+	c, err := auth.NewCodec(cfg.ProxySecret, cfg.TokenExpiration)
 	if err != nil {
 		return nil, err
 	}
 
 	return &Handler{
-		cfg:    cfg,
-		cipher: gcm,
-		log:    log,
-		now:    time.Now,
-		repo:   r,
+		cfg:   cfg,
+		codec: c,
+		log:   log,
+		repo:  r,
 	}, nil
 }
 
 type Handler struct {
-	cfg    Config
-	cipher Cipher
-	log    Logger
-	now    func() time.Time
-	repo   Repository
+	cfg   Config
+	codec *auth.Codec
+	log   Logger
+	repo  Repository
 }
 
 func (h *Handler) ListVersions(w http.ResponseWriter, r *http.Request) {
@@ -82,14 +69,16 @@ func (h *Handler) ListVersions(w http.ResponseWriter, r *http.Request) {
 		system    = router.GetParameter(ctx, "system")
 	)
 
+	ctx, stale := trackStale(ctx)
 	versions, err := h.repo.ListVersions(ctx, system, namespace, name)
 	if err != nil {
 		h.log.Error("list versions", "err", err)
 		respErr(w, err)
 		return
 	}
+	markResponse(w, stale)
 
-	res := newListVersionsResponse(versions)
+	res := newListVersionsResponse(h.cfg.Versions.filter(versions))
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(&res); err != nil {
 		h.log.Error("encode response", "err", err)
@@ -97,10 +86,124 @@ func (h *Handler) ListVersions(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (h *Handler) GetVersion(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		name      = router.GetParameter(ctx, "name")
+		system    = router.GetParameter(ctx, "system")
+		version   = router.GetParameter(ctx, "version")
+	)
+
+	ctx, stale := trackStale(ctx)
+	var (
+		raw  string
+		root *moduleRoot
+	)
+	err := h.withVersion(ctx, system, namespace, name, version, func(v string) error {
+		var err error
+		raw = v
+		root, err = h.inspectVersion(ctx, system, namespace, name, v)
+		return err
+	})
+	if err != nil {
+		respErr(w, err)
+		return
+	}
+	markResponse(w, stale)
+
+	res := &getVersionResponse{
+		ID:        fmt.Sprintf("%s/%s/%s/%s", namespace, name, system, version),
+		Namespace: namespace,
+		Name:      name,
+		Provider:  system,
+		Version:   version,
+		Root:      root,
+	}
+	if d, ok := h.repo.(Describer); ok {
+		details, err := d.DescribeVersion(ctx, system, namespace, name, raw)
+		if err != nil {
+			h.log.Error("describe version", "err", err)
+			respErr(w, err)
+			return
+		}
+		res.Commit = details.Commit
+		if !details.PublishedAt.IsZero() {
+			res.PublishedAt = &details.PublishedAt
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&res); err != nil {
+		h.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+// inspectVersion inspects the archive of the module version as it is
+// downloaded, rather than buffering it. The rest is drained so that the
+// download can complete (and be cached), but it is cut short if the archive
+// can't be inspected.
+func (h *Handler) inspectVersion(ctx context.Context, owner, repo, module, version string) (*moduleRoot, error) {
+	pr, pw := io.Pipe()
+	downloaded := make(chan error, 1)
+	go func() {
+		err := h.repo.ProxyDownload(ctx, owner, repo, module, version, pw)
+		pw.CloseWithError(err)
+		downloaded <- err
+	}()
+	root, err := inspect(pr)
+	if err == nil {
+		io.Copy(io.Discard, pr)
+	}
+	pr.Close()
+	if derr := <-downloaded; derr != nil && !errors.Is(derr, io.ErrClosedPipe) {
+		h.log.Error("proxy download", "err", derr)
+		return nil, derr
+	}
+	if err != nil {
+		h.log.Error("inspect module", "err", err)
+		return nil, err
+	}
+	return root, nil
+}
+
 func (h *Handler) DownloadURL(w http.ResponseWriter, r *http.Request) {
-	downloadURL := "./proxy?archive=tar.gz"
+	format := r.URL.Query().Get("archive")
+	if format == "" {
+		format = h.cfg.ArchiveFormat
+	}
+	if !archive.Supported(format) {
+		http.Error(w, "unsupported archive format", http.StatusBadRequest)
+		return
+	}
+
+	// Repositories that can link to the archives directly are allowed to,
+	// unless another format than the one they hold is requested.
+	if format == archive.Default || format == "tgz" {
+		var (
+			ctx       = r.Context()
+			namespace = router.GetParameter(ctx, "namespace")
+			name      = router.GetParameter(ctx, "name")
+			system    = router.GetParameter(ctx, "system")
+			version   = router.GetParameter(ctx, "version")
+		)
+		link, err := h.downloadLink(ctx, system, namespace, name, version)
+		if err != nil {
+			h.log.Error("download link", "err", err)
+			respErr(w, err)
+			return
+		}
+		if link != "" {
+			w.Header().Add("X-Terraform-Get", link)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	downloadURL := "./proxy?archive=" + url.QueryEscape(format)
 	if token := auth.GetToken(r.Context(), ""); token != "" {
-		encoded, err := h.encodeToken(token)
+		encoded, err := h.codec.Encode(token)
 		if err != nil {
 			h.log.Error("encoding token", "err", err)
 			respErr(w, err)
@@ -112,6 +215,33 @@ func (h *Handler) DownloadURL(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// downloadLink asks the repository for a direct link to the archive. The links
+// aren't checked for existence, so the raw version has to be resolved before
+// one is handed out, but that is only worth a listing once the repository has
+// shown that it links at all.
+func (h *Handler) downloadLink(ctx context.Context, system, namespace, name, version string) (string, error) {
+	link, err := downloadLink(ctx, h.repo, system, namespace, name, version)
+	if errors.Is(err, ErrLinkUnsupported) {
+		return "", nil
+	}
+	if err != nil || link == "" {
+		return "", err
+	}
+
+	raw, err := h.resolveVersion(ctx, system, namespace, name, version)
+	if err != nil {
+		return "", err
+	}
+	if raw == version {
+		return link, nil
+	}
+	link, err = downloadLink(ctx, h.repo, system, namespace, name, raw)
+	if errors.Is(err, ErrLinkUnsupported) {
+		return "", nil
+	}
+	return link, err
+}
+
 func (h *Handler) ProxyDownload(w http.ResponseWriter, r *http.Request) {
 	var (
 		ctx       = r.Context()
@@ -120,11 +250,20 @@ func (h *Handler) ProxyDownload(w http.ResponseWriter, r *http.Request) {
 		system    = router.GetParameter(ctx, "system")
 		version   = router.GetParameter(ctx, "version")
 		token     = r.URL.Query().Get("token")
+		format    = r.URL.Query().Get("archive")
 	)
 
+	if format == "" {
+		format = archive.Default
+	}
+	if !archive.Supported(format) {
+		http.Error(w, "unsupported archive format", http.StatusBadRequest)
+		return
+	}
+
 	if token != "" {
 		var err error
-		token, err = h.decodeToken(token)
+		token, err = h.codec.Decode(token)
 		if err != nil {
 			h.log.Error("decoding token", "err", err)
 			respErr(w, err)
@@ -133,61 +272,63 @@ func (h *Handler) ProxyDownload(w http.ResponseWriter, r *http.Request) {
 		ctx = auth.WithToken(ctx, token)
 	}
 
-	// w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s-%s-%s-%s.tar.gz", owner, repo, module, version))
-	if err := h.repo.ProxyDownload(ctx, system, namespace, name, version, w); err != nil {
+	ctx, stale := trackStale(ctx)
+	w.Header().Set("Content-Type", archive.ContentType(format))
+	err := h.withVersion(ctx, system, namespace, name, version, func(raw string) error {
+		markResponse(w, stale)
+		return h.proxyDownload(ctx, system, namespace, name, raw, format, w)
+	})
+	if err != nil {
 		h.log.Error("proxy download", "err", err)
 		respErr(w, err)
 		return
 	}
 }
 
-func (h *Handler) encodeToken(token string) (string, error) {
-	b, err := json.Marshal(&encodedToken{
-		Token:     token,
-		EncodedAt: h.now().Unix(),
-	})
-	if err != nil {
-		return "", fmt.Errorf("marshalling token into JSON: %w", err)
+// proxyDownload writes the module archive in the requested format. The
+// repositories always produce the default format, so anything else is repacked
+// on the fly from the same entries.
+func (h *Handler) proxyDownload(ctx context.Context, owner, repo, module, version, format string, w io.Writer) error {
+	if format == archive.Default || format == "tgz" {
+		return h.repo.ProxyDownload(ctx, owner, repo, module, version, w)
 	}
 
-	nonce := make([]byte, h.cipher.NonceSize())
-	if _, err := rand.Read(nonce); err != nil {
-		return "", fmt.Errorf("generating token nonce: %w", err)
-	}
+	pr, pw := io.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		err := h.repo.ProxyDownload(ctx, owner, repo, module, version, pw)
+		pw.CloseWithError(err)
+		errs <- err
+	}()
 
-	encoded := h.cipher.Seal(nonce, nonce, b, nil)
-	return hex.EncodeToString(encoded), nil
-}
-
-func (h *Handler) decodeToken(encoded string) (string, error) {
-	ciphertext, err := hex.DecodeString(encoded)
+	aw, err := archive.NewWriter(format, w)
 	if err != nil {
-		return "", fmt.Errorf("decoding token string: %w", err)
+		pr.CloseWithError(err)
+		<-errs
+		return err
 	}
-
-	nonceSize := h.cipher.NonceSize()
-	if len(encoded) < nonceSize {
-		return "", fmt.Errorf("token is too short: %w", errInvalidToken)
-	}
-
-	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	b, err := h.cipher.Open(nil, nonce, []byte(ciphertext), nil)
-	if err != nil {
-		return "", fmt.Errorf("decoding token: %w", err)
+	if err := archive.Repack(aw, pr); err != nil {
+		// Prefer the error from the repository, since that's the root cause.
+		pr.CloseWithError(err)
+		if rerr := <-errs; rerr != nil {
+			return rerr
+		}
+		return err
 	}
-
-	var token encodedToken
-	if err := json.Unmarshal(b, &token); err != nil {
-		return "", fmt.Errorf("unmarshal token: %w", err)
+	// Drain anything left after the end of the tar stream, such as the gzip
+	// trailer, so that the repository isn't left blocking on the pipe.
+	io.Copy(io.Discard, pr)
+	if err := aw.Close(); err != nil {
+		return err
 	}
+	return <-errs
+}
 
-	now := h.now().UTC()
-	validUntil := time.Unix(token.EncodedAt, 0).Add(h.cfg.TokenExpiration).UTC()
-	if !now.Before(validUntil) {
-		return "", fmt.Errorf("%w: valid until %s", errTokenExpired, validUntil)
+// markResponse marks the response if it's based on stale versions.
+func markResponse(w http.ResponseWriter, stale func() string) {
+	if reason := stale(); reason != "" {
+		w.Header().Set(StaleHeader, reason)
 	}
-
-	return token.Token, nil
 }
 
 func respErr(w http.ResponseWriter, err error) {
@@ -225,7 +366,13 @@ type version struct {
 	Version string `json:"version"`
 }
 
-type encodedToken struct {
-	Token     string `json:"token"`
-	EncodedAt int64  `json:"encoded_at"`
+type getVersionResponse struct {
+	ID          string      `json:"id"`
+	Namespace   string      `json:"namespace"`
+	Name        string      `json:"name"`
+	Provider    string      `json:"provider"`
+	Version     string      `json:"version"`
+	Commit      string      `json:"commit,omitempty"`
+	PublishedAt *time.Time  `json:"published_at,omitempty"`
+	Root        *moduleRoot `json:"root"`
 }
@@ -1,6 +1,10 @@
 package modules
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
 	"context"
 	"fmt"
 	"io"
@@ -9,6 +13,7 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/hedlund/orbit/pkg/expect"
 	"github.com/hedlund/orbit/pkg/router"
@@ -91,6 +96,235 @@ func TestListVersions(t *testing.T) {
 	}
 }
 
+func TestGetVersion(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, body := range map[string]string{
+		"README.md": "# VPC",
+		"main.tf":   "variable \"cidr\" {\n  description = \"The CIDR\"\n}\n",
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	zw.Close()
+
+	tests := []struct {
+		name      string
+		repo      Repository
+		expStatus int
+		expBody   string
+	}{
+		{
+			name: "described",
+			repo: &describedRepository{
+				archiveRepository: archiveRepository{archive: buf.Bytes()},
+				details:           VersionDetails{Commit: "abc123", PublishedAt: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)},
+			},
+			expStatus: http.StatusOK,
+			expBody: `{"id":"foo/bar/baz/1.0.0","namespace":"foo","name":"bar","provider":"baz","version":"1.0.0",` +
+				`"commit":"abc123","published_at":"2024-01-02T03:04:05Z","root":{"path":"","readme":"# VPC",` +
+				`"inputs":[{"name":"cidr","description":"The CIDR","required":true}],"outputs":[]}}`,
+		},
+		{
+			name:      "success",
+			repo:      &archiveRepository{archive: buf.Bytes()},
+			expStatus: http.StatusOK,
+			expBody: `{"id":"foo/bar/baz/1.0.0","namespace":"foo","name":"bar","provider":"baz","version":"1.0.0",` +
+				`"root":{"path":"","readme":"# VPC",` +
+				`"inputs":[{"name":"cidr","description":"The CIDR","required":true}],"outputs":[]}}`,
+		},
+		{
+			name:      "not_found",
+			repo:      &archiveRepository{err: statusErr(http.StatusNotFound)},
+			expStatus: http.StatusNotFound,
+			expBody:   `Not Found`,
+		},
+		{
+			name:      "invalid_archive",
+			repo:      &archiveRepository{archive: []byte("not a tarball")},
+			expStatus: http.StatusInternalServerError,
+			expBody:   `Internal Server Error`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &Handler{
+				log:  slog.Default(),
+				repo: tt.repo,
+			}
+
+			rr := httptest.NewRecorder()
+			h := route("/v1/modules/:namespace/:name/:system/:version", handler.GetVersion)
+			h.ServeHTTP(rr, mockRequest(t, "/v1/modules/foo/bar/baz/1.0.0"))
+
+			res := rr.Result()
+			defer res.Body.Close()
+
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("reading response body: %s", err)
+			}
+			body := strings.TrimSpace(string(b))
+
+			if res.StatusCode != tt.expStatus {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expStatus, res.StatusCode)
+			}
+			if body != tt.expBody {
+				t.Errorf("unexpected response body, exp: %s, got: %s", tt.expBody, body)
+			}
+		})
+	}
+}
+
+func TestProxyDownload(t *testing.T) {
+	files := map[string]string{
+		"README.md":      "# VPC",
+		"main.tf":        "variable \"cidr\" {}",
+		"sub/outputs.tf": "output \"id\" {}",
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	for name, body := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg})
+		tw.Write([]byte(body))
+	}
+	tw.Close()
+	zw.Close()
+
+	tests := []struct {
+		name      string
+		query     string
+		repo      *archiveRepository
+		expStatus int
+		expType   string
+	}{
+		{
+			name:      "default",
+			repo:      &archiveRepository{archive: buf.Bytes()},
+			expStatus: http.StatusOK,
+			expType:   "application/gzip",
+		},
+		{
+			name:      "zip",
+			query:     "?archive=zip",
+			repo:      &archiveRepository{archive: buf.Bytes()},
+			expStatus: http.StatusOK,
+			expType:   "application/zip",
+		},
+		{
+			name:      "unsupported",
+			query:     "?archive=rar",
+			repo:      &archiveRepository{archive: buf.Bytes()},
+			expStatus: http.StatusBadRequest,
+		},
+		{
+			name:      "not_found",
+			query:     "?archive=zip",
+			repo:      &archiveRepository{err: statusErr(http.StatusNotFound)},
+			expStatus: http.StatusNotFound,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &Handler{
+				log:  slog.Default(),
+				repo: tt.repo,
+			}
+
+			rr := httptest.NewRecorder()
+			h := route("/v1/modules/:namespace/:name/:system/:version/proxy", handler.ProxyDownload)
+			h.ServeHTTP(rr, mockRequest(t, "/v1/modules/foo/bar/baz/1.0.0/proxy"+tt.query))
+
+			res := rr.Result()
+			defer res.Body.Close()
+
+			b, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("reading response body: %s", err)
+			}
+
+			if res.StatusCode != tt.expStatus {
+				t.Fatalf("unexpected status code, exp: %d, got: %d", tt.expStatus, res.StatusCode)
+			}
+			if res.StatusCode != http.StatusOK {
+				return
+			}
+			if typ := res.Header.Get("Content-Type"); typ != tt.expType {
+				t.Errorf("unexpected content type, exp: %s, got: %s", tt.expType, typ)
+			}
+
+			if tt.expType != "application/zip" {
+				if !bytes.Equal(b, buf.Bytes()) {
+					t.Errorf("expected the archive to be passed through")
+				}
+				return
+			}
+
+			zr, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+			if err != nil {
+				t.Fatalf("reading zip: %s", err)
+			}
+			got := map[string]string{}
+			for _, f := range zr.File {
+				rc, err := f.Open()
+				if err != nil {
+					t.Fatalf("opening %s: %s", f.Name, err)
+				}
+				content, err := io.ReadAll(rc)
+				rc.Close()
+				if err != nil {
+					t.Fatalf("reading %s: %s", f.Name, err)
+				}
+				got[f.Name] = string(content)
+			}
+			if len(got) != len(files) {
+				t.Errorf("unexpected number of files, exp: %d, got: %d", len(files), len(got))
+			}
+			for name, exp := range files {
+				if got[name] != exp {
+					t.Errorf("unexpected content of %s, exp: %q, got: %q", name, exp, got[name])
+				}
+			}
+		})
+	}
+}
+
+// archiveRepository serves the same archive for every version, written in
+// small chunks to make sure that it is read as it is streamed.
+type archiveRepository struct {
+	mockRepository
+	archive []byte
+	err     error
+}
+
+func (r *archiveRepository) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	if r.err != nil {
+		return r.err
+	}
+	for b := r.archive; len(b) > 0; {
+		n := min(len(b), 16)
+		if _, err := w.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+type describedRepository struct {
+	archiveRepository
+	details VersionDetails
+}
+
+func (r *describedRepository) DescribeVersion(ctx context.Context, owner, repo, module, version string) (*VersionDetails, error) {
+	return &r.details, nil
+}
+
 // route is a helper function to wrap the router config of the handler func we
 // are testing. That we have to do this in the first place, and copy the routes
 // from main.go, is an indication that there's a poor abstraction in place that
@@ -0,0 +1,33 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrLinkUnsupported is returned by repositories, or the wrappers around them,
+// that are not able to link to archives at all, so that callers can skip the
+// work that is only needed to hand out a link.
+var ErrLinkUnsupported = errors.New("download links not supported")
+
+// Linker is implemented by repositories that can hand out a direct link to the
+// archive of a module version, in the default format, such as a presigned URL
+// to an object store. The clients are then redirected there, instead of having
+// the archive proxied. An empty link means that the archive is proxied as
+// usual, and ErrLinkUnsupported that no version of it will ever be linked.
+type Linker interface {
+	DownloadLink(ctx context.Context, owner, repo, module, version string) (string, error)
+}
+
+// downloadLink asks the repository for a direct link, if it is able to hand
+// them out, and returns ErrLinkUnsupported otherwise.
+func downloadLink(ctx context.Context, r Repository, owner, repo, module, version string) (string, error) {
+	if l, ok := r.(Linker); ok {
+		return l.DownloadLink(ctx, owner, repo, module, version)
+	}
+	return "", ErrLinkUnsupported
+}
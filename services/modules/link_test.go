@@ -0,0 +1,94 @@
+package modules
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDownloadLink(t *testing.T) {
+	tests := []struct {
+		name   string
+		repo   Repository
+		url    string
+		expGet string
+	}{
+		{"proxied", &mockRepository{}, "/v1/modules/infra/vpc/aws/1.0.0/download", "./proxy?archive=tar.gz"},
+		{"linked", &mockLinker{link: "https://bucket/vpc.tar.gz"}, "/v1/modules/infra/vpc/aws/1.0.0/download", "https://bucket/vpc.tar.gz"},
+		{"no link", &mockLinker{}, "/v1/modules/infra/vpc/aws/1.0.0/download", "./proxy?archive=tar.gz"},
+		{"other format", &mockLinker{link: "https://bucket/vpc.tar.gz"}, "/v1/modules/infra/vpc/aws/1.0.0/download?archive=zip", "./proxy?archive=zip"},
+		{"cached", NewCache(CacheConfig{}, &mockLinker{link: "https://bucket/vpc.tar.gz"}, nil, nil, slog.Default()), "/v1/modules/infra/vpc/aws/1.0.0/download", "https://bucket/vpc.tar.gz"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &Handler{
+				cfg:  Config{ArchiveFormat: "tar.gz"},
+				log:  slog.Default(),
+				repo: tt.repo,
+			}
+
+			rr := httptest.NewRecorder()
+			h := route("/v1/modules/:namespace/:name/:system/:version/download", handler.DownloadURL)
+			h.ServeHTTP(rr, mockRequest(t, tt.url))
+
+			if rr.Code != http.StatusNoContent {
+				t.Errorf("unexpected status code: %d", rr.Code)
+			}
+			if got := rr.Header().Get("X-Terraform-Get"); got != tt.expGet {
+				t.Errorf("unexpected location, exp: %s, got: %s", tt.expGet, got)
+			}
+		})
+	}
+}
+
+func TestDownloadLinkUnsupported(t *testing.T) {
+	// The repository fails to list its versions, so any attempt to resolve
+	// one before proxying the archive would fail the request.
+	unlisted := &mockRepository{err: errors.New("unavailable")}
+	router, err := NewRouter(unlisted, Route{System: "gcp", Repository: &mockLinker{link: "https://bucket/vpc.tar.gz"}})
+	if err != nil {
+		t.Fatalf("new router: %s", err)
+	}
+	fallback, err := NewFallback(unlisted, &mockLinker{link: "https://bucket/vpc.tar.gz"}, "*")
+	if err != nil {
+		t.Fatalf("new fallback: %s", err)
+	}
+
+	for name, repo := range map[string]Repository{
+		"plain":    unlisted,
+		"cached":   NewCache(CacheConfig{}, unlisted, nil, nil, slog.Default()),
+		"routed":   router,
+		"fallback": fallback,
+	} {
+		t.Run(name, func(t *testing.T) {
+			handler := &Handler{
+				cfg:  Config{ArchiveFormat: "tar.gz"},
+				log:  slog.Default(),
+				repo: repo,
+			}
+
+			rr := httptest.NewRecorder()
+			h := route("/v1/modules/:namespace/:name/:system/:version/download", handler.DownloadURL)
+			h.ServeHTTP(rr, mockRequest(t, "/v1/modules/infra/vpc/aws/1.0.0/download"))
+
+			if rr.Code != http.StatusNoContent {
+				t.Errorf("unexpected status code: %d", rr.Code)
+			}
+			if got := rr.Header().Get("X-Terraform-Get"); got != "./proxy?archive=tar.gz" {
+				t.Errorf("unexpected location: %s", got)
+			}
+		})
+	}
+}
+
+type mockLinker struct {
+	mockRepository
+	link string
+}
+
+func (m *mockLinker) DownloadLink(ctx context.Context, owner, repo, module, version string) (string, error) {
+	return m.link, nil
+}
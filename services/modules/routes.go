@@ -0,0 +1,87 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path"
+)
+
+// Route sends the modules matching the patterns to a repository. The patterns
+// are matched using `path.Match` against the system of the module, which the
+// repositories know as the owner, and its namespace, known as the repo. An
+// empty pattern matches anything.
+type Route struct {
+	System     string
+	Namespace  string
+	Repository Repository
+}
+
+// NewRouter creates a repository that dispatches to the first route that
+// matches the module, or the fallback if none of them do. It allows a single
+// instance to serve modules from several backends.
+func NewRouter(fallback Repository, routes ...Route) (*Router, error) {
+	for _, r := range routes {
+		for _, pattern := range []string{r.System, r.Namespace} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid route pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return &Router{fallback, routes}, nil
+}
+
+type Router struct {
+	fallback Repository
+	routes   []Route
+}
+
+func (r *Router) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	return r.route(owner, repo).ListVersions(ctx, owner, repo, module)
+}
+
+func (r *Router) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	return r.route(owner, repo).ProxyDownload(ctx, owner, repo, module, version, w)
+}
+
+// DescribeVersion passes the call through to the routed repository, if it is
+// able to describe versions.
+func (r *Router) DescribeVersion(ctx context.Context, owner, repo, module, version string) (*VersionDetails, error) {
+	if d, ok := r.route(owner, repo).(Describer); ok {
+		return d.DescribeVersion(ctx, owner, repo, module, version)
+	}
+	return &VersionDetails{}, nil
+}
+
+// DownloadLink passes the call through to the routed repository, if it is able
+// to link to archives.
+func (r *Router) DownloadLink(ctx context.Context, owner, repo, module, version string) (string, error) {
+	return downloadLink(ctx, r.route(owner, repo), owner, repo, module, version)
+}
+
+// CheckAccess passes the call through to the routed repository, if it
+// restricts access.
+func (r *Router) CheckAccess(ctx context.Context, owner, repo string) error {
+	return checkAccess(ctx, r.route(owner, repo), owner, repo)
+}
+
+func (r *Router) route(owner, repo string) Repository {
+	for _, route := range r.routes {
+		if match(route.System, owner) && match(route.Namespace, repo) {
+			return route.Repository
+		}
+	}
+	return r.fallback
+}
+
+func match(pattern, s string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(pattern, s)
+	return ok
+}
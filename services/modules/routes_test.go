@@ -0,0 +1,46 @@
+package modules
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestRouter(t *testing.T) {
+	var (
+		fallback = &mockRepository{versions: []string{"fallback"}}
+		gitlab   = &mockRepository{versions: []string{"gitlab"}}
+		local    = &mockRepository{versions: []string{"local"}}
+	)
+	r, err := NewRouter(fallback,
+		Route{System: "gitlab", Repository: gitlab},
+		Route{System: "aws", Namespace: "dev-*", Repository: local},
+	)
+	if err != nil {
+		t.Fatalf("new router: %s", err)
+	}
+
+	tests := []struct {
+		system    string
+		namespace string
+		exp       string
+	}{
+		{"gitlab", "infra", "gitlab"},
+		{"aws", "dev-vpc", "local"},
+		{"aws", "prod-vpc", "fallback"},
+		{"github", "infra", "fallback"},
+	}
+	for _, tt := range tests {
+		versions, err := r.ListVersions(context.Background(), tt.system, tt.namespace, "vpc")
+		if err != nil {
+			t.Fatalf("list versions: %s", err)
+		}
+		if exp := []string{tt.exp}; !reflect.DeepEqual(versions, exp) {
+			t.Errorf("%s/%s: unexpected route, exp: %s, got: %v", tt.system, tt.namespace, tt.exp, versions)
+		}
+	}
+
+	if _, err := NewRouter(fallback, Route{System: "[", Repository: local}); err == nil {
+		t.Errorf("expected an error for an invalid pattern")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+const (
+	// StaleHeader marks the responses based on stale versions, with the
+	// reason as the value.
+	StaleHeader = "X-Orbit-Stale"
+
+	StaleWhileRevalidate = "stale-while-revalidate"
+	StaleIfError         = "stale-if-error"
+)
+
+type staleKey struct{}
+
+// staleness records whether stale versions were served while handling a
+// request.
+type staleness struct {
+	mu     sync.Mutex
+	reason string
+}
+
+// trackStale returns a context in which serving stale versions is recorded,
+// and a function returning the reason, if they were.
+func trackStale(ctx context.Context) (context.Context, func() string) {
+	s := &staleness{}
+	return context.WithValue(ctx, staleKey{}, s), func() string {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.reason
+	}
+}
+
+func markStale(ctx context.Context, reason string) {
+	if s, ok := ctx.Value(staleKey{}).(*staleness); ok {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reason = reason
+	}
+}
+
+// outage tells whether the error is caused by the repository being
+// unavailable, rather than by the request.
+func outage(err error) bool {
+	var sc interface{ StatusCode() int }
+	if errors.As(err, &sc) {
+		return sc.StatusCode() >= http.StatusInternalServerError
+	}
+	var ne net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &ne)
+}
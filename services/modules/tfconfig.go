@@ -0,0 +1,369 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// Input describes a `variable` block of a module.
+type Input struct {
+	Name        string `json:"name"`
+	Type        string `json:"type,omitempty"`
+	Description string `json:"description"`
+	Default     string `json:"default,omitempty"`
+	Required    bool   `json:"required"`
+	Sensitive   bool   `json:"sensitive,omitempty"`
+}
+
+// Output describes an `output` block of a module.
+type Output struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Sensitive   bool   `json:"sensitive,omitempty"`
+}
+
+// parseConfig extracts the variables and outputs from the source of a `.tf`
+// file. It is not a complete HCL parser; it only understands enough of the
+// syntax to find the top-level blocks and their attributes, and keeps any
+// expressions (types and defaults) as their raw source text.
+func parseConfig(src []byte) ([]Input, []Output) {
+	var (
+		s       = &scanner{src: src}
+		inputs  []Input
+		outputs []Output
+	)
+	for {
+		s.skipSpace(true)
+		if s.eof() {
+			break
+		}
+
+		typ := s.ident()
+		if typ == "" {
+			// Not something we understand, so skip ahead to the next line.
+			s.skipLine()
+			continue
+		}
+
+		var labels []string
+		for {
+			s.skipSpace(false)
+			if s.peek() == '"' {
+				labels = append(labels, unquote(s.quoted()))
+			} else if label := s.ident(); label != "" {
+				labels = append(labels, label)
+			} else {
+				break
+			}
+		}
+
+		if s.peek() != '{' {
+			// A top-level attribute, or some syntax we can't make sense of.
+			s.skipExpr()
+			continue
+		}
+
+		s.pos++
+		attrs := s.body()
+		if len(labels) != 1 {
+			continue
+		}
+
+		switch typ {
+		case "variable":
+			_, hasDefault := attrs["default"]
+			inputs = append(inputs, Input{
+				Name:        labels[0],
+				Type:        attrs["type"],
+				Description: stringValue(attrs["description"]),
+				Default:     attrs["default"],
+				Required:    !hasDefault,
+				Sensitive:   attrs["sensitive"] == "true",
+			})
+		case "output":
+			outputs = append(outputs, Output{
+				Name:        labels[0],
+				Description: stringValue(attrs["description"]),
+				Sensitive:   attrs["sensitive"] == "true",
+			})
+		}
+	}
+	return inputs, outputs
+}
+
+type scanner struct {
+	src []byte
+	pos int
+}
+
+func (s *scanner) eof() bool {
+	return s.pos >= len(s.src)
+}
+
+func (s *scanner) peek() byte {
+	if s.eof() {
+		return 0
+	}
+	return s.src[s.pos]
+}
+
+func (s *scanner) hasPrefix(p string) bool {
+	return bytes.HasPrefix(s.src[s.pos:], []byte(p))
+}
+
+// skipSpace skips whitespace and comments, and optionally newlines.
+func (s *scanner) skipSpace(newlines bool) {
+	for !s.eof() {
+		switch c := s.peek(); {
+		case c == ' ' || c == '\t' || c == '\r':
+			s.pos++
+		case c == '\n':
+			if !newlines {
+				return
+			}
+			s.pos++
+		case c == '#' || s.hasPrefix("//"):
+			s.skipComment()
+		case s.hasPrefix("/*"):
+			if end := bytes.Index(s.src[s.pos+2:], []byte("*/")); end >= 0 {
+				s.pos += end + 4
+			} else {
+				s.pos = len(s.src)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// skipComment skips a line comment, but leaves the newline in place since it
+// terminates any expression that precedes it.
+func (s *scanner) skipComment() {
+	if end := bytes.IndexByte(s.src[s.pos:], '\n'); end >= 0 {
+		s.pos += end
+	} else {
+		s.pos = len(s.src)
+	}
+}
+
+func (s *scanner) skipLine() {
+	s.skipComment()
+	s.pos++
+}
+
+func (s *scanner) ident() string {
+	start := s.pos
+	for !s.eof() {
+		c := s.peek()
+		if c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || (c == '-' || c >= '0' && c <= '9') && s.pos > start {
+			s.pos++
+			continue
+		}
+		break
+	}
+	return string(s.src[start:s.pos])
+}
+
+// quoted consumes a quoted string, including any template interpolations, and
+// returns its raw source.
+func (s *scanner) quoted() string {
+	start := s.pos
+	s.pos++
+	for !s.eof() {
+		switch c := s.peek(); {
+		case c == '\\':
+			s.pos += 2
+		case c == '"':
+			s.pos++
+			return string(s.src[start:s.pos])
+		case c == '\n':
+			// Unterminated string, so bail out at the end of the line.
+			return string(s.src[start:s.pos])
+		case s.hasPrefix("${") || s.hasPrefix("%{"):
+			s.pos += 2
+			s.skipNested('}')
+		default:
+			s.pos++
+		}
+	}
+	return string(s.src[start:s.pos])
+}
+
+// heredoc consumes a heredoc string, i.e. `<<EOF` or `<<-EOF` up until the line
+// containing only the delimiter.
+func (s *scanner) heredoc() {
+	s.pos += 2
+	if s.peek() == '-' {
+		s.pos++
+	}
+	delim := s.ident()
+	s.skipComment()
+	for !s.eof() {
+		s.pos++
+		end := bytes.IndexByte(s.src[s.pos:], '\n')
+		if end < 0 {
+			end = len(s.src) - s.pos
+		}
+		line := strings.TrimSpace(string(s.src[s.pos : s.pos+end]))
+		s.pos += end
+		if line == delim {
+			return
+		}
+	}
+}
+
+// skipNested skips everything up until and including the closing character,
+// taking nested brackets, strings and comments into account.
+func (s *scanner) skipNested(closing byte) {
+	for !s.eof() {
+		s.skipSpace(true)
+		switch c := s.peek(); {
+		case c == closing:
+			s.pos++
+			return
+		case c == '"':
+			s.quoted()
+		case s.hasPrefix("<<"):
+			s.heredoc()
+		case c == '{':
+			s.pos++
+			s.skipNested('}')
+		case c == '[':
+			s.pos++
+			s.skipNested(']')
+		case c == '(':
+			s.pos++
+			s.skipNested(')')
+		case c == 0:
+			return
+		default:
+			s.pos++
+		}
+	}
+}
+
+// skipExpr skips an expression up until the end of the line, or the end of the
+// enclosing block, and returns its raw source.
+func (s *scanner) skipExpr() string {
+	start := s.pos
+	for !s.eof() {
+		switch c := s.peek(); {
+		case c == '\n' || c == '}':
+			return strings.TrimSpace(string(s.src[start:s.pos]))
+		case c == '#' || s.hasPrefix("//"):
+			end := s.pos
+			s.skipComment()
+			return strings.TrimSpace(string(s.src[start:end]))
+		case s.hasPrefix("/*"):
+			// A trailing comment is not part of the expression, even if it
+			// spans multiple lines.
+			end := s.pos
+			s.skipSpace(false)
+			if c := s.peek(); c == '\n' || c == '}' || s.eof() {
+				return strings.TrimSpace(string(s.src[start:end]))
+			}
+		case c == '"':
+			s.quoted()
+		case s.hasPrefix("<<"):
+			s.heredoc()
+		case c == '{':
+			s.pos++
+			s.skipNested('}')
+		case c == '[':
+			s.pos++
+			s.skipNested(']')
+		case c == '(':
+			s.pos++
+			s.skipNested(')')
+		default:
+			s.pos++
+		}
+	}
+	return strings.TrimSpace(string(s.src[start:s.pos]))
+}
+
+// body consumes the body of a block, after the opening brace, and returns the
+// raw source of its attributes. Nested blocks are skipped.
+func (s *scanner) body() map[string]string {
+	attrs := make(map[string]string)
+	for {
+		s.skipSpace(true)
+		if s.eof() {
+			return attrs
+		}
+		if s.peek() == '}' {
+			s.pos++
+			return attrs
+		}
+
+		name := s.ident()
+		s.skipSpace(false)
+		switch {
+		case name != "" && s.peek() == '=' && !s.hasPrefix("=="):
+			s.pos++
+			s.skipSpace(false)
+			attrs[name] = s.skipExpr()
+		case name != "" && s.peek() == '{':
+			s.pos++
+			s.skipNested('}')
+		default:
+			if name == "" {
+				s.pos++
+			}
+			s.skipExpr()
+		}
+	}
+}
+
+// stringValue returns the value of a string expression, either quoted or as
+// a heredoc. Anything else is returned as is.
+func stringValue(raw string) string {
+	if strings.HasPrefix(raw, `"`) {
+		return unquote(raw)
+	}
+	if strings.HasPrefix(raw, "<<") {
+		lines := strings.Split(raw, "\n")
+		if len(lines) < 2 {
+			return raw
+		}
+		lines = lines[1 : len(lines)-1]
+		if strings.HasPrefix(raw, "<<-") {
+			lines = trimIndent(lines)
+		}
+		return strings.Join(lines, "\n")
+	}
+	return raw
+}
+
+func unquote(s string) string {
+	if v, err := strconv.Unquote(s); err == nil {
+		return v
+	}
+	return strings.Trim(s, `"`)
+}
+
+// trimIndent removes the common leading whitespace of the lines, which is how
+// the indented heredoc form behaves.
+func trimIndent(lines []string) []string {
+	indent := -1
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		n := len(l) - len(strings.TrimLeft(l, " \t"))
+		if indent < 0 || n < indent {
+			indent = n
+		}
+	}
+	for n, l := range lines {
+		if len(l) >= indent && indent > 0 {
+			lines[n] = l[indent:]
+		}
+	}
+	return lines
+}
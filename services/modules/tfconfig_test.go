@@ -0,0 +1,209 @@
+package modules
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	src := `
+# The name of the thing.
+variable "name" {
+  type        = string
+  description = "The name of the \"thing\""
+}
+
+variable "tags" {
+  type = map(string)
+  default = {
+    "env" = "dev" # inline comment
+  }
+  description = <<-EOT
+    Tags to apply.
+    Multiple lines.
+  EOT
+}
+
+variable "secret" {
+  type      = object({ a = string, b = list(number) })
+  sensitive = true
+  default   = null
+
+  validation {
+    condition     = length(var.secret) > 0
+    error_message = "Must not be empty."
+  }
+}
+
+resource "null_resource" "this" {
+  triggers = { name = "${var.name}-{}" }
+}
+
+/* output "commented" {
+  value = 1
+} */
+
+output "id" {
+  value       = null_resource.this.id
+  description = "The ID"
+}
+
+output "hidden" {
+  value     = var.secret
+  sensitive = true
+}
+`
+	inputs, outputs := parseConfig([]byte(src))
+
+	expInputs := []Input{
+		{Name: "name", Type: "string", Description: `The name of the "thing"`, Required: true},
+		{Name: "tags", Type: "map(string)", Description: "Tags to apply.\nMultiple lines.", Default: "{\n    \"env\" = \"dev\" # inline comment\n  }"},
+		{Name: "secret", Type: "object({ a = string, b = list(number) })", Default: "null", Sensitive: true},
+	}
+	if !reflect.DeepEqual(inputs, expInputs) {
+		t.Errorf("unexpected inputs, exp: %#v, got: %#v", expInputs, inputs)
+	}
+
+	expOutputs := []Output{
+		{Name: "id", Description: "The ID"},
+		{Name: "hidden", Sensitive: true},
+	}
+	if !reflect.DeepEqual(outputs, expOutputs) {
+		t.Errorf("unexpected outputs, exp: %#v, got: %#v", expOutputs, outputs)
+	}
+}
+
+func TestParseConfigSyntax(t *testing.T) {
+	tests := []struct {
+		name       string
+		src        string
+		expInputs  []Input
+		expOutputs []Output
+	}{
+		{
+			name: "heredoc",
+			src: `
+variable "doc" {
+  description = <<EOT
+Closing braces } and "quotes" are not special here.
+EOT
+  default = <<-EOT
+    {
+    EOT
+}
+
+output "after" {
+  value = 1
+}
+`,
+			expInputs:  []Input{{Name: "doc", Description: "Closing braces } and \"quotes\" are not special here.", Default: "<<-EOT\n    {\n    EOT"}},
+			expOutputs: []Output{{Name: "after"}},
+		},
+		{
+			name: "nested_blocks",
+			src: `
+variable "rules" {
+  type = list(object({ port = number }))
+
+  validation {
+    condition     = alltrue([for r in var.rules : r.port > 0])
+    error_message = "Ports must be positive."
+  }
+
+  validation {
+    condition = length(var.rules) < 10
+    error_message = <<EOT
+Too many } rules.
+EOT
+  }
+  description = "Set after the nested blocks"
+}
+
+resource "aws_security_group" "this" {
+  dynamic "ingress" {
+    for_each = var.rules
+    content {
+      from_port = ingress.value.port
+    }
+  }
+}
+
+output "id" {
+  description = "The ID"
+  value       = aws_security_group.this.id
+}
+`,
+			expInputs:  []Input{{Name: "rules", Type: "list(object({ port = number }))", Description: "Set after the nested blocks", Required: true}},
+			expOutputs: []Output{{Name: "id", Description: "The ID"}},
+		},
+		{
+			name: "block_comments",
+			src: `
+/* variable "commented" {} */
+variable /* the name */ "name" {
+  /* type = number */
+  type = string /* trailing
+  over multiple lines */
+  description = "A name" // line comment
+}
+
+/*
+output "commented" {
+  value = 1
+}
+*/
+
+output "name" {
+  value = var.name # hash comment
+}
+`,
+			expInputs:  []Input{{Name: "name", Type: "string", Description: "A name", Required: true}},
+			expOutputs: []Output{{Name: "name"}},
+		},
+		{
+			name: "unterminated_string",
+			src: `
+variable "broken" {
+  description = "Never closed
+  type        = string
+}
+
+variable "fine" {
+  description = "Still parsed"
+}
+`,
+			expInputs: []Input{
+				{Name: "broken", Type: "string", Description: "Never closed", Required: true},
+				{Name: "fine", Description: "Still parsed", Required: true},
+			},
+		},
+		{
+			name: "interpolation",
+			src: `
+variable "prefix" {
+  description = "Used as ${var.name}-{suffix}"
+  default     = "${lookup({ "a" = "}" }, "a")}-%{ if true }x%{ endif }"
+}
+
+output "url" {
+  description = "The URL of ${var.prefix}"
+  value       = "https://${aws_lb.this.dns_name}/{path}"
+}
+`,
+			expInputs:  []Input{{Name: "prefix", Description: "Used as ${var.name}-{suffix}", Default: `"${lookup({ "a" = "}" }, "a")}-%{ if true }x%{ endif }"`}},
+			expOutputs: []Output{{Name: "url", Description: "The URL of ${var.prefix}"}},
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			inputs, outputs := parseConfig([]byte(tt.src))
+			if !reflect.DeepEqual(inputs, tt.expInputs) {
+				t.Errorf("unexpected inputs, exp: %#v, got: %#v", tt.expInputs, inputs)
+			}
+			if !reflect.DeepEqual(outputs, tt.expOutputs) {
+				t.Errorf("unexpected outputs, exp: %#v, got: %#v", tt.expOutputs, outputs)
+			}
+		})
+	}
+}
@@ -0,0 +1,239 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package modules
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// VersionsConfig controls how the versions returned by the repository are
+// presented to Terraform. The zero value passes the versions through verbatim.
+type VersionsConfig struct {
+	StripPrefix     bool `envconfig:"VERSIONS_STRIP_PREFIX" default:"true"`
+	SemverOnly      bool `envconfig:"VERSIONS_SEMVER_ONLY" default:"true"`
+	Deduplicate     bool `envconfig:"VERSIONS_DEDUPLICATE" default:"true"`
+	Sort            bool `envconfig:"VERSIONS_SORT" default:"true"`
+	HidePrereleases bool `envconfig:"VERSIONS_HIDE_PRERELEASES"`
+}
+
+// filter normalises, filters and sorts the raw versions from the repository.
+func (c *VersionsConfig) filter(raw []string) []string {
+	var (
+		seen     = make(map[string]bool, len(raw))
+		versions = make([]string, 0, len(raw))
+	)
+	for _, r := range raw {
+		v := c.normalize(r)
+
+		sv, ok := parseSemver(v)
+		if !ok && c.SemverOnly {
+			continue
+		}
+		if ok && c.HidePrereleases && sv.pre != "" {
+			continue
+		}
+		if c.Deduplicate {
+			if seen[v] {
+				continue
+			}
+			seen[v] = true
+		}
+
+		versions = append(versions, v)
+	}
+
+	if c.Sort {
+		sort.SliceStable(versions, func(i, j int) bool {
+			a, aok := parseSemver(versions[i])
+			b, bok := parseSemver(versions[j])
+			switch {
+			case aok && bok:
+				return a.compare(b) < 0
+			case aok != bok:
+				// Anything that isn't a semantic version goes last.
+				return aok
+			default:
+				return versions[i] < versions[j]
+			}
+		})
+	}
+	return versions
+}
+
+// normalize strips the leading "v" of a version, if configured.
+func (c *VersionsConfig) normalize(version string) string {
+	if c.StripPrefix && len(version) > 1 && (version[0] == 'v' || version[0] == 'V') {
+		if version[1] >= '0' && version[1] <= '9' {
+			return version[1:]
+		}
+	}
+	return version
+}
+
+// withVersion calls the function with the raw version, as known by the
+// repository. The versions are resolved through the (cached) listing rather
+// than by trial and error, since a miss costs a round trip to the repository.
+// Should the listing fail, the version is tried as presented to Terraform.
+func (h *Handler) withVersion(ctx context.Context, owner, repo, module, version string, f func(raw string) error) error {
+	raw, err := h.resolveVersion(ctx, owner, repo, module, version)
+	if err != nil {
+		h.log.Error("resolve version", "err", err)
+		raw = version
+	}
+	return f(raw)
+}
+
+// resolveVersion maps a version, as presented to Terraform, back to the raw
+// version known by the repository. Without normalisation the two are always
+// the same, so the repository only has to be consulted when the prefix may have
+// been stripped.
+func (h *Handler) resolveVersion(ctx context.Context, owner, repo, module, version string) (string, error) {
+	if !h.cfg.Versions.StripPrefix {
+		return version, nil
+	}
+
+	raw, err := h.repo.ListVersions(ctx, owner, repo, module)
+	if err != nil {
+		return "", err
+	}
+
+	resolved := version
+	for _, r := range raw {
+		if r == version {
+			return r, nil
+		}
+		if resolved == version && h.cfg.Versions.normalize(r) == version {
+			resolved = r
+		}
+	}
+	return resolved, nil
+}
+
+// semver is a parsed semantic version, as per https://semver.org/. The build
+// metadata is ignored, since it has no bearing on precedence.
+type semver struct {
+	major, minor, patch uint64
+	pre                 string
+}
+
+func parseSemver(s string) (semver, bool) {
+	var v semver
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		if !validIdentifiers(s[i+1:], false) {
+			return v, false
+		}
+		s = s[:i]
+	}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		if !validIdentifiers(s[i+1:], true) {
+			return v, false
+		}
+		v.pre = s[i+1:]
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	nums := make([]uint64, 3)
+	for n, p := range parts {
+		if !isNumeric(p) || len(p) > 1 && p[0] == '0' {
+			return v, false
+		}
+		num, err := strconv.ParseUint(p, 10, 64)
+		if err != nil {
+			return v, false
+		}
+		nums[n] = num
+	}
+	v.major, v.minor, v.patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+func (v semver) compare(o semver) int {
+	for _, c := range [][2]uint64{{v.major, o.major}, {v.minor, o.minor}, {v.patch, o.patch}} {
+		if c[0] != c[1] {
+			if c[0] < c[1] {
+				return -1
+			}
+			return 1
+		}
+	}
+
+	// A version without a pre-release has higher precedence.
+	switch {
+	case v.pre == o.pre:
+		return 0
+	case v.pre == "":
+		return 1
+	case o.pre == "":
+		return -1
+	}
+
+	a, b := strings.Split(v.pre, "."), strings.Split(o.pre, ".")
+	for n := 0; n < len(a) && n < len(b); n++ {
+		if a[n] == b[n] {
+			continue
+		}
+		an, bn := isNumeric(a[n]), isNumeric(b[n])
+		switch {
+		case an && bn:
+			x, _ := strconv.ParseUint(a[n], 10, 64)
+			y, _ := strconv.ParseUint(b[n], 10, 64)
+			if x < y {
+				return -1
+			}
+			return 1
+		case an:
+			return -1
+		case bn:
+			return 1
+		case a[n] < b[n]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	switch {
+	case len(a) < len(b):
+		return -1
+	case len(a) > len(b):
+		return 1
+	}
+	return 0
+}
+
+func validIdentifiers(s string, noLeadingZeros bool) bool {
+	for _, id := range strings.Split(s, ".") {
+		if id == "" {
+			return false
+		}
+		for _, c := range id {
+			if !(c == '-' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z') {
+				return false
+			}
+		}
+		if noLeadingZeros && isNumeric(id) && len(id) > 1 && id[0] == '0' {
+			return false
+		}
+	}
+	return true
+}
+
+func isNumeric(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
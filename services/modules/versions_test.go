@@ -0,0 +1,123 @@
+package modules
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestFilterVersions(t *testing.T) {
+	raw := []string{"v1.10.0", "latest", "1.2.3", "v1.2.3", "1.2.3-rc.1", "1.2.3-beta", "01.2.3", "2.0.0+build.5", "1.2"}
+
+	tests := []struct {
+		name string
+		cfg  VersionsConfig
+		exp  []string
+	}{
+		{
+			name: "verbatim",
+			cfg:  VersionsConfig{},
+			exp:  raw,
+		},
+		{
+			name: "defaults",
+			cfg:  VersionsConfig{StripPrefix: true, SemverOnly: true, Deduplicate: true, Sort: true},
+			exp:  []string{"1.2.3-beta", "1.2.3-rc.1", "1.2.3", "1.10.0", "2.0.0+build.5"},
+		},
+		{
+			name: "no_prereleases",
+			cfg:  VersionsConfig{StripPrefix: true, SemverOnly: true, Deduplicate: true, Sort: true, HidePrereleases: true},
+			exp:  []string{"1.2.3", "1.10.0", "2.0.0+build.5"},
+		},
+		{
+			name: "keep_invalid",
+			cfg:  VersionsConfig{StripPrefix: true, Deduplicate: true, Sort: true},
+			exp:  []string{"1.2.3-beta", "1.2.3-rc.1", "1.2.3", "1.10.0", "2.0.0+build.5", "01.2.3", "1.2", "latest"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.cfg.filter(raw)
+			if !reflect.DeepEqual(got, tt.exp) {
+				t.Errorf("unexpected versions, exp: %v, got: %v", tt.exp, got)
+			}
+		})
+	}
+}
+
+func TestWithVersion(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  string
+		listErr  error
+		expRaw   string
+		expLists int
+		expCode  int
+	}{
+		{"literal", "2.0.0", nil, "2.0.0", 1, http.StatusOK},
+		{"prefixed", "1.0.0", nil, "v1.0.0", 1, http.StatusOK},
+		{"unknown", "3.0.0", nil, "", 1, http.StatusNotFound},
+		{"list_failure", "2.0.0", statusErr(http.StatusBadGateway), "2.0.0", 1, http.StatusOK},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &taggedRepository{versions: []string{"v1.0.0", "2.0.0"}, err: tt.listErr}
+			handler := &Handler{
+				cfg:  Config{Versions: VersionsConfig{StripPrefix: true}},
+				log:  slog.Default(),
+				repo: repo,
+			}
+
+			rr := httptest.NewRecorder()
+			h := route("/v1/modules/:namespace/:name/:system/:version/proxy", handler.ProxyDownload)
+			h.ServeHTTP(rr, mockRequest(t, "/v1/modules/foo/bar/baz/"+tt.version+"/proxy"))
+
+			if rr.Code != tt.expCode {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expCode, rr.Code)
+			}
+			if repo.downloaded != tt.expRaw {
+				t.Errorf("unexpected version downloaded, exp: %q, got: %q", tt.expRaw, repo.downloaded)
+			}
+			if repo.lists != tt.expLists {
+				t.Errorf("unexpected number of listings, exp: %d, got: %d", tt.expLists, repo.lists)
+			}
+			if repo.downloads != 1 {
+				t.Errorf("expected a single download, got: %d", repo.downloads)
+			}
+		})
+	}
+}
+
+// taggedRepository only knows the versions by their raw names, and counts how
+// many times they are listed and downloaded.
+type taggedRepository struct {
+	versions   []string
+	err        error
+	lists      int
+	downloads  int
+	downloaded string
+}
+
+func (r *taggedRepository) ListVersions(ctx context.Context, owner, repo, module string) ([]string, error) {
+	r.lists++
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.versions, nil
+}
+
+func (r *taggedRepository) ProxyDownload(ctx context.Context, owner, repo, module, version string, w io.Writer) error {
+	r.downloads++
+	for _, v := range r.versions {
+		if v == version {
+			r.downloaded = v
+			return nil
+		}
+	}
+	return statusErr(http.StatusNotFound)
+}
@@ -0,0 +1,241 @@
+// Copyright 2023 Henrik Hedlund. All rights reserved.
+// Use of this source code is governed by the GNU Affero
+// GPL license that can be found in the LICENSE file.
+
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/auth"
+	"github.com/hedlund/orbit/pkg/router"
+)
+
+type Config struct {
+	ProxySecret     []byte        `envconfig:"PROXY_SECRET"`
+	TokenExpiration time.Duration `envconfig:"TOKEN_EXPIRATION" default:"60s"`
+	Protocols       []string      `envconfig:"PROTOCOLS" default:"5.0"`
+	SigningKey      struct {
+		ID         string `envconfig:"SIGNING_KEY_ID"`
+		ASCIIArmor string `envconfig:"SIGNING_KEY_ARMOR"`
+	}
+}
+
+type Logger interface {
+	Error(msg string, args ...any)
+	Info(msg string, args ...any)
+}
+
+// Repository is the backend for the provider registry protocol. The name is
+// the provider type, e.g. "aws" for "terraform-provider-aws".
+type Repository interface {
+	ListVersions(ctx context.Context, namespace, name string) ([]Version, error)
+	FindPackage(ctx context.Context, namespace, name, version, os, arch string) (*Package, error)
+	ProxyAsset(ctx context.Context, namespace, name, version, filename string, w io.Writer) error
+}
+
+type Version struct {
+	Version   string     `json:"version"`
+	Protocols []string   `json:"protocols"`
+	Platforms []Platform `json:"platforms"`
+}
+
+type Platform struct {
+	OS   string `json:"os"`
+	Arch string `json:"arch"`
+}
+
+// Package describes a single provider release for a specific platform. The
+// files are referenced by their asset names, and served through the proxy.
+type Package struct {
+	Protocols           []string
+	OS                  string
+	Arch                string
+	Filename            string
+	SHASum              string
+	SHASumsFilename     string
+	SHASumsSignFilename string
+}
+
+func NewHTTP(cfg Config, log Logger, r Repository) (*Handler, error) {
+	c, err := auth.NewCodec(cfg.ProxySecret, cfg.TokenExpiration)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handler{
+		cfg:   cfg,
+		codec: c,
+		log:   log,
+		repo:  r,
+	}, nil
+}
+
+type Handler struct {
+	cfg   Config
+	codec *auth.Codec
+	log   Logger
+	repo  Repository
+}
+
+func (h *Handler) ListVersions(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		name      = router.GetParameter(ctx, "type")
+	)
+
+	versions, err := h.repo.ListVersions(ctx, namespace, name)
+	if err != nil {
+		h.log.Error("list versions", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	for n := range versions {
+		if len(versions[n].Protocols) == 0 {
+			versions[n].Protocols = h.cfg.Protocols
+		}
+		if versions[n].Platforms == nil {
+			versions[n].Platforms = []Platform{}
+		}
+	}
+
+	res := &listVersionsResponse{
+		Versions: versions,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&res); err != nil {
+		h.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+func (h *Handler) FindPackage(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		name      = router.GetParameter(ctx, "type")
+		version   = router.GetParameter(ctx, "version")
+		os        = router.GetParameter(ctx, "os")
+		arch      = router.GetParameter(ctx, "arch")
+	)
+
+	pkg, err := h.repo.FindPackage(ctx, namespace, name, version, os, arch)
+	if err != nil {
+		h.log.Error("find package", "err", err)
+		respErr(w, err)
+		return
+	}
+
+	var query string
+	if token := auth.GetToken(ctx, ""); token != "" {
+		encoded, err := h.codec.Encode(token)
+		if err != nil {
+			h.log.Error("encoding token", "err", err)
+			respErr(w, err)
+			return
+		}
+		query = "?token=" + encoded
+	}
+	assetURL := func(filename string) string {
+		return fmt.Sprintf("/v1/providers/%s/%s/%s/assets/%s%s",
+			url.PathEscape(namespace), url.PathEscape(name), url.PathEscape(version), url.PathEscape(filename), query)
+	}
+
+	res := &findPackageResponse{
+		Protocols:           pkg.Protocols,
+		OS:                  pkg.OS,
+		Arch:                pkg.Arch,
+		Filename:            pkg.Filename,
+		DownloadURL:         assetURL(pkg.Filename),
+		SHASumsURL:          assetURL(pkg.SHASumsFilename),
+		SHASumsSignatureURL: assetURL(pkg.SHASumsSignFilename),
+		SHASum:              pkg.SHASum,
+	}
+	if len(res.Protocols) == 0 {
+		res.Protocols = h.cfg.Protocols
+	}
+	res.SigningKeys.GPGPublicKeys = []signingKey{}
+	if h.cfg.SigningKey.ASCIIArmor != "" {
+		res.SigningKeys.GPGPublicKeys = append(res.SigningKeys.GPGPublicKeys, signingKey{
+			KeyID:      h.cfg.SigningKey.ID,
+			ASCIIArmor: h.cfg.SigningKey.ASCIIArmor,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&res); err != nil {
+		h.log.Error("encode response", "err", err)
+		return
+	}
+}
+
+func (h *Handler) ProxyAsset(w http.ResponseWriter, r *http.Request) {
+	var (
+		ctx       = r.Context()
+		namespace = router.GetParameter(ctx, "namespace")
+		name      = router.GetParameter(ctx, "type")
+		version   = router.GetParameter(ctx, "version")
+		filename  = router.GetParameter(ctx, "filename")
+		token     = r.URL.Query().Get("token")
+	)
+
+	if token != "" {
+		var err error
+		token, err = h.codec.Decode(token)
+		if err != nil {
+			h.log.Error("decoding token", "err", err)
+			respErr(w, err)
+			return
+		}
+		ctx = auth.WithToken(ctx, token)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := h.repo.ProxyAsset(ctx, namespace, name, version, filename, w); err != nil {
+		h.log.Error("proxy asset", "err", err)
+		respErr(w, err)
+		return
+	}
+}
+
+func respErr(w http.ResponseWriter, err error) {
+	var code int
+	switch x := err.(type) {
+	case interface{ StatusCode() int }:
+		code = x.StatusCode()
+	default:
+		code = http.StatusInternalServerError
+	}
+	http.Error(w, http.StatusText(code), code)
+}
+
+type listVersionsResponse struct {
+	Versions []Version `json:"versions"`
+}
+
+type findPackageResponse struct {
+	Protocols           []string `json:"protocols"`
+	OS                  string   `json:"os"`
+	Arch                string   `json:"arch"`
+	Filename            string   `json:"filename"`
+	DownloadURL         string   `json:"download_url"`
+	SHASumsURL          string   `json:"shasums_url"`
+	SHASumsSignatureURL string   `json:"shasums_signature_url"`
+	SHASum              string   `json:"shasum"`
+	SigningKeys         struct {
+		GPGPublicKeys []signingKey `json:"gpg_public_keys"`
+	} `json:"signing_keys"`
+}
+
+type signingKey struct {
+	KeyID      string `json:"key_id"`
+	ASCIIArmor string `json:"ascii_armor"`
+}
@@ -0,0 +1,215 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hedlund/orbit/pkg/auth"
+	"github.com/hedlund/orbit/pkg/router"
+)
+
+func TestListVersions(t *testing.T) {
+	tests := []struct {
+		name      string
+		repo      *mockRepository
+		expStatus int
+		expBody   string
+	}{
+		{
+			name: "success",
+			repo: &mockRepository{
+				versions: []Version{
+					{Version: "1.0.0", Platforms: []Platform{{OS: "linux", Arch: "amd64"}}},
+					{Version: "2.0.0", Protocols: []string{"6.0"}},
+				},
+			},
+			expStatus: http.StatusOK,
+			expBody: `{"versions":[` +
+				`{"version":"1.0.0","protocols":["5.0"],"platforms":[{"os":"linux","arch":"amd64"}]},` +
+				`{"version":"2.0.0","protocols":["6.0"],"platforms":[]}]}`,
+		},
+		{
+			name:      "not_found",
+			repo:      &mockRepository{err: statusErr(http.StatusNotFound)},
+			expStatus: http.StatusNotFound,
+			expBody:   `Not Found`,
+		},
+		{
+			name:      "repo_error",
+			repo:      &mockRepository{err: fmt.Errorf("oopsie")},
+			expStatus: http.StatusInternalServerError,
+			expBody:   `Internal Server Error`,
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			h := newHandler(t, tt.repo)
+			status, body := serve(t, h, "/v1/providers/acme/demo/versions", nil)
+			if status != tt.expStatus {
+				t.Errorf("unexpected status code, exp: %d, got: %d", tt.expStatus, status)
+			}
+			if body != tt.expBody {
+				t.Errorf("unexpected response body, exp: %s, got: %s", tt.expBody, body)
+			}
+			if tt.repo.namespace != "acme" || tt.repo.name != "demo" {
+				t.Errorf("unexpected provider: %s/%s", tt.repo.namespace, tt.repo.name)
+			}
+		})
+	}
+}
+
+func TestFindPackage(t *testing.T) {
+	repo := &mockRepository{
+		pkg: &Package{
+			OS:                  "linux",
+			Arch:                "amd64",
+			Filename:            "terraform-provider-demo_1.0.0_linux_amd64.zip",
+			SHASum:              "abc123",
+			SHASumsFilename:     "terraform-provider-demo_1.0.0_SHA256SUMS",
+			SHASumsSignFilename: "terraform-provider-demo_1.0.0_SHA256SUMS.sig",
+		},
+		assets: map[string]string{
+			"terraform-provider-demo_1.0.0_linux_amd64.zip": "zip",
+		},
+	}
+	h := newHandler(t, repo)
+	h.cfg.SigningKey.ID = "ABCDEF"
+	h.cfg.SigningKey.ASCIIArmor = "armor"
+
+	status, body := serve(t, h, "/v1/providers/acme/demo/1.0.0/download/linux/amd64", http.Header{
+		"Authorization": {"Bearer secret"},
+	})
+	if status != http.StatusOK {
+		t.Fatalf("unexpected status code, exp: %d, got: %d", http.StatusOK, status)
+	}
+	if repo.version != "1.0.0" || repo.os != "linux" || repo.arch != "amd64" {
+		t.Errorf("unexpected package: %s %s/%s", repo.version, repo.os, repo.arch)
+	}
+
+	var res findPackageResponse
+	if err := json.Unmarshal([]byte(body), &res); err != nil {
+		t.Fatalf("decoding response: %s", err)
+	}
+	if len(res.Protocols) != 1 || res.Protocols[0] != "5.0" {
+		t.Errorf("expected the default protocols, got: %v", res.Protocols)
+	}
+	if res.SHASum != "abc123" {
+		t.Errorf("unexpected checksum: %s", res.SHASum)
+	}
+	if keys := res.SigningKeys.GPGPublicKeys; len(keys) != 1 || keys[0].KeyID != "ABCDEF" || keys[0].ASCIIArmor != "armor" {
+		t.Errorf("unexpected signing keys: %+v", keys)
+	}
+	for _, u := range []string{res.SHASumsURL, res.SHASumsSignatureURL} {
+		if !strings.HasPrefix(u, "/v1/providers/acme/demo/1.0.0/assets/terraform-provider-demo_1.0.0_SHA256SUMS") {
+			t.Errorf("unexpected asset URL: %s", u)
+		}
+	}
+
+	// The download URL carries the caller's token, which is handed to the
+	// repository when the asset is proxied.
+	u, err := url.Parse(res.DownloadURL)
+	if err != nil {
+		t.Fatalf("parsing download URL: %s", err)
+	}
+	if u.Query().Get("token") == "" {
+		t.Fatalf("expected an encoded token in the download URL: %s", res.DownloadURL)
+	}
+	status, body = serve(t, h, res.DownloadURL, nil)
+	if status != http.StatusOK || body != "zip" {
+		t.Errorf("unexpected asset response: %d %q", status, body)
+	}
+	if repo.token != "secret" {
+		t.Errorf("unexpected token passed to the repository: %q", repo.token)
+	}
+
+	status, _ = serve(t, h, "/v1/providers/acme/demo/1.0.0/assets/unknown.zip", nil)
+	if status != http.StatusNotFound {
+		t.Errorf("unexpected status code for unknown asset, exp: %d, got: %d", http.StatusNotFound, status)
+	}
+}
+
+func newHandler(t *testing.T, repo Repository) *Handler {
+	t.Helper()
+
+	cfg := Config{
+		ProxySecret:     []byte("0123456789abcdef"),
+		TokenExpiration: time.Minute,
+		Protocols:       []string{"5.0"},
+	}
+	h, err := NewHTTP(cfg, slog.Default(), repo)
+	if err != nil {
+		t.Fatalf("creating handler: %s", err)
+	}
+	return h
+}
+
+// serve routes the request the same way as main.go, and returns the status
+// code and trimmed body of the response.
+func serve(t *testing.T, h *Handler, target string, header http.Header) (int, string) {
+	t.Helper()
+
+	r := router.New()
+	r.Use(auth.TokenMiddleware)
+	r.Get("/v1/providers/:namespace/:type/versions", h.ListVersions)
+	r.Get("/v1/providers/:namespace/:type/:version/download/:os/:arch", h.FindPackage)
+	r.Get("/v1/providers/:namespace/:type/:version/assets/:filename", h.ProxyAsset)
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rr := httptest.NewRecorder()
+	r.ServeHTTP(rr, req)
+
+	res := rr.Result()
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatalf("reading response body: %s", err)
+	}
+	return res.StatusCode, strings.TrimSpace(string(b))
+}
+
+type statusErr int
+
+func (e statusErr) Error() string   { return http.StatusText(int(e)) }
+func (e statusErr) StatusCode() int { return int(e) }
+
+type mockRepository struct {
+	versions []Version
+	pkg      *Package
+	assets   map[string]string
+	err      error
+
+	namespace, name, version, os, arch, token string
+}
+
+func (m *mockRepository) ListVersions(ctx context.Context, namespace, name string) ([]Version, error) {
+	m.namespace, m.name = namespace, name
+	return m.versions, m.err
+}
+
+func (m *mockRepository) FindPackage(ctx context.Context, namespace, name, version, os, arch string) (*Package, error) {
+	m.namespace, m.name, m.version, m.os, m.arch = namespace, name, version, os, arch
+	return m.pkg, m.err
+}
+
+func (m *mockRepository) ProxyAsset(ctx context.Context, namespace, name, version, filename string, w io.Writer) error {
+	m.token = auth.GetToken(ctx, "")
+	b, ok := m.assets[filename]
+	if !ok {
+		return statusErr(http.StatusNotFound)
+	}
+	_, err := io.WriteString(w, b)
+	return err
+}